@@ -1,3 +1,4 @@
-DROP TRIGGER IF EXISTS inventory_updated_at_trigger
-DROP FUNCTION IF EXISTS inventory_updated_at;
+/* The trigger (and its function) are commented out in the up migration. */
+-- DROP TRIGGER IF EXISTS inventory_updated_at_trigger ON inventory;
+-- DROP FUNCTION IF EXISTS inventory_updated_at;
 DROP TABLE IF EXISTS inventory;
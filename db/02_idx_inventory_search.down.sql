@@ -0,0 +1 @@
+DROP INDEX IF EXISTS inventory_search_idx;
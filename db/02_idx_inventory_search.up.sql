@@ -0,0 +1,12 @@
+/*
+ * A full-text search index over the name, brand and description of an
+ * item. The expression here must match "searchDocument" in the server
+ * for the planner to pick the index up.
+ */
+CREATE INDEX IF NOT EXISTS inventory_search_idx
+    ON inventory
+    USING GIN ((
+        setweight(to_tsvector('english', item_name), 'A') ||
+        setweight(to_tsvector('english', item_brand), 'B') ||
+        setweight(to_tsvector('english', item_desc), 'C')
+    ));
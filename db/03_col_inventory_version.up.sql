@@ -0,0 +1,2 @@
+/* A row version, bumped on every write; used for the ETag of an item. */
+ALTER TABLE inventory ADD COLUMN IF NOT EXISTS item_version BIGINT NOT NULL DEFAULT 1;
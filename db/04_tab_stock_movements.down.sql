@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS stock_movements_item_idx;
+DROP TABLE IF EXISTS stock_movements;
@@ -0,0 +1,17 @@
+/*
+ * A ledger of changes to the count of an item. Rows are kept even after
+ * the item is deleted, so that counts can be reconciled later.
+ */
+CREATE TABLE IF NOT EXISTS stock_movements (
+    movement_id BIGSERIAL NOT NULL,
+    item_id CHAR(8) NOT NULL,
+    delta INT NOT NULL,
+    reason VARCHAR(32) NOT NULL,
+    actor VARCHAR(256) NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (movement_id)
+);
+
+
+CREATE INDEX IF NOT EXISTS stock_movements_item_idx
+    ON stock_movements (item_id, movement_id);
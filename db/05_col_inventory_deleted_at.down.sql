@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS inventory_deleted_at_idx;
+ALTER TABLE inventory DROP COLUMN IF EXISTS deleted_at;
@@ -0,0 +1,7 @@
+/* Items are soft-deleted (moved to the trash) by setting "deleted_at". */
+ALTER TABLE inventory ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP NULL;
+
+
+CREATE INDEX IF NOT EXISTS inventory_deleted_at_idx
+    ON inventory (deleted_at, item_id)
+    WHERE deleted_at IS NOT NULL;
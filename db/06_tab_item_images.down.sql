@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS item_images_primary_idx;
+DROP INDEX IF EXISTS item_images_item_idx;
+DROP TABLE IF EXISTS item_images;
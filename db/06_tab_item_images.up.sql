@@ -0,0 +1,30 @@
+/*
+ * The images of an item, in the order that they are shown in. One of the
+ * images of an item is its primary image. Images are stored under
+ * "image_name" in the directory of the item.
+ */
+CREATE TABLE IF NOT EXISTS item_images (
+    image_id CHAR(8) UNIQUE NOT NULL,
+    item_id CHAR(8) NOT NULL REFERENCES inventory (item_id) ON DELETE CASCADE,
+    image_name VARCHAR(64) NOT NULL,
+    position INT NOT NULL,
+    is_primary BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (image_id)
+);
+
+
+CREATE INDEX IF NOT EXISTS item_images_item_idx
+    ON item_images (item_id, position, image_id);
+
+
+CREATE UNIQUE INDEX IF NOT EXISTS item_images_primary_idx
+    ON item_images (item_id)
+    WHERE is_primary;
+
+
+/* The existing (single) image of every item becomes its primary image. */
+INSERT INTO item_images
+    (image_id, item_id, image_name, position, is_primary, created_at)
+    SELECT item_id, item_id, 'original', 0, TRUE, created_at FROM inventory
+    ON CONFLICT DO NOTHING;
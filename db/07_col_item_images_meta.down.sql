@@ -0,0 +1,4 @@
+ALTER TABLE item_images DROP COLUMN IF EXISTS image_mime;
+ALTER TABLE item_images DROP COLUMN IF EXISTS image_size;
+ALTER TABLE item_images DROP COLUMN IF EXISTS image_height;
+ALTER TABLE item_images DROP COLUMN IF EXISTS image_width;
@@ -0,0 +1,8 @@
+/*
+ * What is known about an image: its size in pixels and bytes, and its MIME
+ * type. These are NULL for images uploaded before they were recorded.
+ */
+ALTER TABLE item_images ADD COLUMN IF NOT EXISTS image_width INT NULL;
+ALTER TABLE item_images ADD COLUMN IF NOT EXISTS image_height INT NULL;
+ALTER TABLE item_images ADD COLUMN IF NOT EXISTS image_size BIGINT NULL;
+ALTER TABLE item_images ADD COLUMN IF NOT EXISTS image_mime VARCHAR(32) NULL;
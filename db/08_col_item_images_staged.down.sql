@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS item_images_staged_idx;
+ALTER TABLE item_images DROP COLUMN IF EXISTS staged_name;
@@ -0,0 +1,11 @@
+/*
+ * The staged upload of an image, while it is being published (see
+ * publishItemImage); a crash can leave this set, in which case the upload
+ * is published (or discarded) on the next start-up.
+ */
+ALTER TABLE item_images ADD COLUMN IF NOT EXISTS staged_name VARCHAR(64) NULL;
+
+
+CREATE INDEX IF NOT EXISTS item_images_staged_idx
+    ON item_images (image_id)
+    WHERE staged_name IS NOT NULL;
@@ -0,0 +1,2 @@
+ALTER TABLE inventory DROP COLUMN IF EXISTS item_currency;
+ALTER TABLE inventory ALTER COLUMN item_price TYPE REAL USING item_price::REAL;
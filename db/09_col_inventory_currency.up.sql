@@ -0,0 +1,7 @@
+/*
+ * Exact prices, in the currency (ISO 4217) of the item. Existing prices
+ * are taken to be in US dollars, and are rounded to the cent; a REAL only
+ * kept about six significant digits, so that is all they have anyway.
+ */
+ALTER TABLE inventory ALTER COLUMN item_price TYPE NUMERIC(18, 4) USING ROUND(item_price::NUMERIC, 2);
+ALTER TABLE inventory ADD COLUMN IF NOT EXISTS item_currency CHAR(3) NOT NULL DEFAULT 'USD';
@@ -0,0 +1,11 @@
+// Package db holds the schema migrations of the inventory database, which
+// are embedded in the server (see "migrate" in the server).
+//
+// Migrations are named "<version>_<name>.up.sql" (and ".down.sql" for the
+// migration that undoes it); versions are applied in ascending order.
+package db
+
+import "embed"
+
+//go:embed *.sql
+var Migrations embed.FS
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An ImageStore that keeps track of the thumbnails in the store underneath,
+// and evicts the least recently used ones when they take up more than the
+// quota. Everything else is passed through as is.
+type thumbCache struct {
+	ImageStore
+
+	mu    sync.Mutex
+	quota int64
+	used  int64
+	lru   *list.List // Of *thumbCacheEntry, most recently used first.
+	items map[string]map[string]*list.Element
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+type thumbCacheEntry struct {
+	itemID string
+	name   string
+	size   int64
+}
+
+// A quota of zero (or less) means that the cache is not bounded.
+func newThumbCache(store ImageStore, quota int64) *thumbCache {
+	return &thumbCache{
+		ImageStore: store,
+		quota:      quota,
+		lru:        list.New(),
+		items:      make(map[string]map[string]*list.Element),
+	}
+}
+
+func isThumbName(name string) bool {
+	return strings.HasPrefix(name, imgThumbPrefix)
+}
+
+func (c *thumbCache) Put(itemID, name string, in io.Reader, size int64) error {
+	var (
+		info    imageInfo
+		victims []*thumbCacheEntry
+		err     error
+	)
+
+	if err = c.ImageStore.Put(itemID, name, in, size); err != nil {
+		return err
+	}
+
+	if !isThumbName(name) {
+		return nil
+	}
+
+	// The size is not always known up front.
+	if size < 0 {
+		if info, err = c.ImageStore.Stat(itemID, name); err != nil {
+			return nil
+		}
+		size = info.Size
+	}
+
+	c.mu.Lock()
+	c.remove(itemID, name)
+	c.insert(&thumbCacheEntry{itemID, name, size}, true)
+	victims = c.evict()
+	c.mu.Unlock()
+
+	c.deleteVictims(victims)
+
+	return nil
+}
+
+func (c *thumbCache) Get(itemID,
+	name string) (io.ReadSeekCloser, imageInfo, error) {
+
+	var (
+		in   io.ReadSeekCloser
+		info imageInfo
+		err  error
+	)
+
+	if in, info, err = c.ImageStore.Get(itemID, name); err != nil {
+		return in, info, err
+	}
+
+	if isThumbName(name) {
+		c.mu.Lock()
+		c.touch(itemID, name)
+		c.mu.Unlock()
+	}
+
+	return in, info, nil
+}
+
+func (c *thumbCache) Stat(itemID, name string) (imageInfo, error) {
+	var (
+		info imageInfo
+		err  error
+	)
+
+	if info, err = c.ImageStore.Stat(itemID, name); err != nil {
+		return info, err
+	}
+
+	if isThumbName(name) {
+		c.mu.Lock()
+		c.touch(itemID, name)
+		c.mu.Unlock()
+	}
+
+	return info, nil
+}
+
+func (c *thumbCache) Move(itemID, from, to string) error {
+	var err error
+
+	if err = c.ImageStore.Move(itemID, from, to); err != nil {
+		return err
+	}
+
+	if isThumbName(from) || isThumbName(to) {
+		c.mu.Lock()
+		c.remove(itemID, from)
+		c.remove(itemID, to)
+		c.mu.Unlock()
+	}
+
+	return nil
+}
+
+func (c *thumbCache) Delete(itemID, name string) error {
+	var err error
+
+	if err = c.ImageStore.Delete(itemID, name); err != nil {
+		return err
+	}
+
+	if isThumbName(name) {
+		c.mu.Lock()
+		c.remove(itemID, name)
+		c.mu.Unlock()
+	}
+
+	return nil
+}
+
+func (c *thumbCache) DeleteAll(itemID string) error {
+	var err error
+
+	if err = c.ImageStore.DeleteAll(itemID); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	for name := range c.items[itemID] {
+		c.remove(itemID, name)
+	}
+	c.mu.Unlock()
+
+	return nil
+}
+
+// Counts a request for a thumbnail, as a miss if the thumbnail had to be
+// generated for it; this is a no-op on a nil cache (i.e., when the store is
+// not a cache).
+func (c *thumbCache) count(miss bool) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	if miss {
+		c.misses++
+	} else {
+		c.hits++
+	}
+	c.mu.Unlock()
+}
+
+func (c *thumbCache) Stats() thumbCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return thumbCacheStats{
+		Entries:   c.lru.Len(),
+		Bytes:     c.used,
+		Quota:     c.quota,
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+	}
+}
+
+// The methods below expect the lock to be held.
+
+func (c *thumbCache) insert(entry *thumbCacheEntry, recent bool) {
+	var elem *list.Element
+
+	if recent {
+		elem = c.lru.PushFront(entry)
+	} else {
+		elem = c.lru.PushBack(entry)
+	}
+
+	if c.items[entry.itemID] == nil {
+		c.items[entry.itemID] = make(map[string]*list.Element)
+	}
+	c.items[entry.itemID][entry.name] = elem
+	c.used += entry.size
+}
+
+func (c *thumbCache) touch(itemID, name string) {
+	var (
+		elem *list.Element
+		ok   bool
+	)
+
+	if elem, ok = c.items[itemID][name]; ok {
+		c.lru.MoveToFront(elem)
+	}
+}
+
+func (c *thumbCache) remove(itemID, name string) {
+	var (
+		elem *list.Element
+		ok   bool
+	)
+
+	if elem, ok = c.items[itemID][name]; !ok {
+		return
+	}
+
+	c.lru.Remove(elem)
+	c.used -= elem.Value.(*thumbCacheEntry).size
+
+	if delete(c.items[itemID], name); len(c.items[itemID]) <= 0 {
+		delete(c.items, itemID)
+	}
+}
+
+// Drops the least recently used entries until the cache is within quota;
+// the most recent entry is always kept. The thumbnails themselves are to be
+// deleted (without the lock) with deleteVictims.
+func (c *thumbCache) evict() []*thumbCacheEntry {
+	var (
+		victims []*thumbCacheEntry
+		entry   *thumbCacheEntry
+	)
+
+	for c.quota > 0 && c.used > c.quota && c.lru.Len() > 1 {
+		entry = c.lru.Back().Value.(*thumbCacheEntry)
+		c.remove(entry.itemID, entry.name)
+		c.evictions++
+		victims = append(victims, entry)
+	}
+
+	return victims
+}
+
+// A victim may have been generated (and put) again since it was evicted;
+// such a victim is not deleted. If it is put again while it is deleted,
+// its new entry is dropped should the thumbnail turn out to be gone, so
+// that it does not count against the quota.
+func (c *thumbCache) deleteVictims(victims []*thumbCacheEntry) {
+	var (
+		ok  bool
+		err error
+	)
+
+	for _, entry := range victims {
+		c.mu.Lock()
+		_, ok = c.items[entry.itemID][entry.name]
+		c.mu.Unlock()
+
+		if ok {
+			continue
+		}
+
+		if err = c.ImageStore.Delete(entry.itemID, entry.name); err != nil {
+			log.Printf(
+				"img: failed to evict %s/%s: %v",
+				entry.itemID, entry.name, err,
+			)
+			continue
+		}
+
+		c.mu.Lock()
+		_, ok = c.items[entry.itemID][entry.name]
+		c.mu.Unlock()
+
+		if !ok {
+			continue
+		}
+
+		_, err = c.ImageStore.Stat(entry.itemID, entry.name)
+		if errors.Is(err, errImageNotFound) {
+			c.mu.Lock()
+			c.remove(entry.itemID, entry.name)
+			c.mu.Unlock()
+		}
+	}
+}
+
+// Adds the thumbnails that are in the store already (from before a restart)
+// to the cache. These are older than anything used since, so they go to the
+// back, newest first.
+func loadThumbCache(inv InventoryStore, c *thumbCache) {
+	type foundThumb struct {
+		entry thumbCacheEntry
+		at    time.Time
+	}
+
+	var (
+		itemIDs []string
+		names   []string
+		found   []foundThumb
+		info    imageInfo
+		victims []*thumbCacheEntry
+		err     error
+	)
+
+	if itemIDs, err = inv.ItemIDs(); err != nil {
+		log.Printf("img: failed to load thumbnail cache: %v", err)
+		return
+	}
+
+	for _, itemID := range itemIDs {
+		if names, err = c.ImageStore.List(itemID, imgThumbPrefix); err != nil {
+			log.Printf("img: failed to list thumbnails: %v", err)
+			continue
+		}
+
+		for _, name := range names {
+			if info, err = c.ImageStore.Stat(itemID, name); err != nil {
+				continue
+			}
+			found = append(found, foundThumb{
+				thumbCacheEntry{itemID, name, info.Size}, info.ModTime,
+			})
+		}
+	}
+
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].at.After(found[j].at)
+	})
+
+	c.mu.Lock()
+	for i := range found {
+		if _, ok := c.items[found[i].entry.itemID][found[i].entry.name]; !ok {
+			c.insert(&found[i].entry, false)
+		}
+	}
+	victims = c.evict()
+	c.mu.Unlock()
+
+	c.deleteVictims(victims)
+
+	log.Printf("img: loaded %d thumbnails into the cache", len(found))
+}
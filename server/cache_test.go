@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// An image store that has a thumbnail put again (through the cache) just
+// before it is deleted, as if it were generated again while being evicted.
+type racingImageStore struct {
+	ImageStore
+	cache *thumbCache
+	name  string
+}
+
+func (s *racingImageStore) Delete(itemID, name string) error {
+	if name == s.name {
+		s.name = ""
+		s.cache.Put(itemID, name, strings.NewReader("again"), 5)
+	}
+
+	return s.ImageStore.Delete(itemID, name)
+}
+
+// Evicts everything but an empty thumbnail that is added as the most
+// recent one, and returns the victims.
+func evictTestThumbs(c *thumbCache, itemID, name string) []*thumbCacheEntry {
+	var (
+		quota   int64
+		victims []*thumbCacheEntry
+	)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	quota, c.quota = c.quota, 1
+	c.insert(&thumbCacheEntry{itemID, name, 0}, true)
+	victims = c.evict()
+	c.quota = quota
+
+	return victims
+}
+
+func TestThumbCacheSparesRegeneratedVictims(t *testing.T) {
+	var (
+		local   *localImageStore
+		store   *racingImageStore
+		cache   *thumbCache
+		itemID  = genItemHash()
+		victims []*thumbCacheEntry
+		err     error
+	)
+
+	if local, err = newLocalImageStore(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	store = &racingImageStore{ImageStore: local}
+	cache = newThumbCache(store, 1<<10)
+	store.cache = cache
+
+	// Put again after it was evicted (but before it was deleted): the
+	// thumbnail is kept.
+	putTestImage(t, cache, itemID, "thumb_a", "first")
+	victims = evictTestThumbs(cache, itemID, "thumb_x")
+	putTestImage(t, cache, itemID, "thumb_a", "again")
+	cache.deleteVictims(victims)
+
+	if body := readTestImage(t, cache, itemID, "thumb_a"); body != "again" {
+		t.Fatalf("got %q, want the thumbnail put again", body)
+	}
+
+	// Put again while it was deleted: the entry goes with the thumbnail.
+	store.name = "thumb_a"
+	cache.deleteVictims(evictTestThumbs(cache, itemID, "thumb_y"))
+
+	if hasImage(t, cache, itemID, "thumb_a") {
+		t.Fatal("thumb_a was not deleted")
+	}
+
+	if stats := cache.Stats(); stats.Entries != 1 || stats.Bytes != 0 {
+		t.Fatalf("got %+v, want only thumb_y", stats)
+	}
+}
@@ -1,5 +1,12 @@
 package main
 
+import (
+	"runtime"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
 const (
 	defaultRnHost string = "0.0.0.0"
 	defaultRnPort int    = 8080
@@ -10,42 +17,397 @@ const (
 	maxPortRange int = 65535
 	minPortRange int = 0
 
-	dbType    string = "postgres"
-	dbSiteKey string = "shopify-db"
-	dbDSN     string = "%s://%s:%s@%s:%d/%s?sslmode=disable"
-	dbTable   string = "inventory"
+	dbType  string = "postgres"
+	dbDSN   string = "%s://%s:%s@%s:%d/%s?sslmode=disable"
+	dbTable string = "inventory"
+
+	dbMovementTable  string = "stock_movements"
+	dbImageTable     string = "item_images"
+	dbMigrationTable string = "schema_migrations"
+
+	// Key of the advisory lock held while migrating, so that replicas that
+	// start together take turns.
+	migrateLockKey int64 = 0x73686f70
+
+	// Key of the advisory lock held while reconciling images, so that only
+	// one replica does it at a time.
+	reconcileLockKey int64 = 0x73686f71
+
+	// Prices are kept as a number of ten-thousandths (the finest minor
+	// unit of any currency), in a NUMERIC(18, 4) column.
+	defaultCurrency string = "USD"
+	priceDigits     int    = 4
+	maxPriceUnits   int64  = 999999999999999999
+
+	// Counts are kept in an INT column.
+	maxItemCount int64 = 2147483647
 
 	hashStrSize int    = 8
 	hashCharSet string = "abcdefghijklmnopqrstuvwxyz" +
 		"ABCDEFGHIJKLMNOPQRSTUVWXYZ" +
 		"0123456789"
 
-	maxImageThumbPx uint = 8192
+	maxImageThumbPx  uint  = 8192
+	maxImagePixels   int64 = 50000000
+	maxGifPixels     int64 = 200000000
+	maxImageExifSize int64 = 64 << 10
+	imgWebpQuality   int   = 80
+	imgOrientQuality int   = 95
+
+	imgModeFit        string = "fit"
+	imgModeFill       string = "fill"
+	imgModeSmart      string = "smart"
+	imgModeExact      string = "exact"
+	imgSmartCropSteps int    = 32
+
+	defaultImgPresets string = "small=64x64:fit,card=320x240:fill," +
+		"zoom=1024x1024:fit"
+	defaultPregenWorkers int = 2
+	thumbPregenQueueSize int = 1024
+
+	defaultThumbQuota int64 = 1 << 30
+
+	cursorSep string = "|"
+
+	exportFlushRows int    = 256
+	excelBOM        string = "\ufeff"
+
+	defaultTrashRetention time.Duration = 30 * 24 * time.Hour
+	defaultPurgeInterval  time.Duration = time.Hour
+
+	// How long an upload can take (from being staged, to being published)
+	// on any replica; the reconciler leaves younger images alone.
+	defaultReconcileGrace time.Duration = time.Hour
+
+	defaultStockReason string = "correction"
+	initialStockReason string = "initial"
+
+	maxImportLineSize  int           = 32 << 20
+	maxImportImageSize int           = 16 << 20
+	importFetchTimeout time.Duration = 30 * time.Second
+	maxImportRedirects int           = 5
+
+	uploadImageField   string = "image"
+	imgSniffSize       int    = 3072
+	maxUploadImageSize int64  = 16 << 20
+	maxUploadFieldSize int64  = 64 << 10
+	maxUploadFormSize  int64  = maxUploadImageSize + (1 << 20)
+
+	actorHeader  string = "X-Actor"
+	maxActorSize int    = 256
 
-	muxSiteKey string = "imgFsMux"
+	maxSearchTerms int    = 16
+	searchConfig   string = "english"
+	// Highlights are marked with characters from the private use area,
+	// so that the text can be escaped before they become "<mark>" tags.
+	searchHlStart string = "\uE000"
+	searchHlStop  string = "\uE001"
+	searchHlOpts  string = "StartSel=" + searchHlStart + ", " +
+		"StopSel=" + searchHlStop + ", " +
+		"MaxFragments=2, MaxWords=24, MinWords=8"
+
+	// This must match the expression in "inventory_search_idx".
+	searchDocument string = "(" +
+		"setweight(to_tsvector('english', item_name), 'A') || " +
+		"setweight(to_tsvector('english', item_brand), 'B') || " +
+		"setweight(to_tsvector('english', item_desc), 'C'))"
+
+	invSiteKey      string = "inventory"
+	muxSiteKey      string = "imgFsMux"
+	imgStoreSiteKey string = "imgStore"
+
+	defaultInvStore string = "postgres"
+
+	defaultImgStore string = "local"
+	defaultImgRoot  string = "/tmp/shopify-pe"
+
+	imgImagePrefix string = "image_"
+	imgStagePrefix string = "staged_"
+	imgThumbPrefix string = "thumb_"
+	imgTempPrefix  string = ".tmp_"
 )
 
 var (
-	imageRootDir = "/tmp/shopify-pe"
+	// Directory that "image_path" in imports is relative to; paths are
+	// not allowed in imports if this is empty.
+	importRootDir = ""
+
+	// Named thumbnail sizes (see "-presets"); if "imgPresetsOnly" is set,
+	// thumbnails can only be asked for by preset.
+	imgPresets     = map[string]imgPreset{}
+	imgPresetsOnly = false
+
+	// Keep the metadata (EXIF, XMP, etc.) of uploaded images (see
+	// "-keepexif"); it is stripped by default.
+	imgKeepMeta = false
+
+	// Shares the generation of a thumbnail between concurrent requests for
+	// it, by the path of the thumbnail in the store.
+	thumbFlight singleflight.Group
+
+	// Slots for thumbnail generation (see "-thumbworkers").
+	thumbSlots = make(chan struct{}, runtime.NumCPU())
+
+	// Images whose preset thumbnails are to be generated in the background;
+	// nil if pre-generation is disabled.
+	thumbPregenQueue chan thumbPregenJob
+
+	imgModes = []string{imgModeFit, imgModeFill, imgModeSmart, imgModeExact}
+
+	exportColumns = []string{
+		"item_id",
+		"created_at",
+		"updated_at",
+		"item_count",
+		"item_price",
+		"item_currency",
+		"item_brand",
+		"item_name",
+		"item_desc",
+	}
+
+	importColumns = []string{
+		"item_count",
+		"item_price",
+		"item_currency",
+		"item_brand",
+		"item_name",
+		"item_desc",
+		"image_url",
+		"image_path",
+	}
+
+	// Digits in the minor unit of each (active) ISO 4217 currency.
+	currencyDigits = map[string]int{
+		"AED": 2, "AFN": 2, "ALL": 2, "AMD": 2, "ANG": 2, "AOA": 2,
+		"ARS": 2, "AUD": 2, "AWG": 2, "AZN": 2, "BAM": 2, "BBD": 2,
+		"BDT": 2, "BGN": 2, "BHD": 3, "BIF": 0, "BMD": 2, "BND": 2,
+		"BOB": 2, "BOV": 2, "BRL": 2, "BSD": 2, "BTN": 2, "BWP": 2,
+		"BYN": 2, "BZD": 2, "CAD": 2, "CDF": 2, "CHE": 2, "CHF": 2,
+		"CHW": 2, "CLF": 4, "CLP": 0, "CNY": 2, "COP": 2, "COU": 2,
+		"CRC": 2, "CUP": 2, "CVE": 2, "CZK": 2, "DJF": 0, "DKK": 2,
+		"DOP": 2, "DZD": 2, "EGP": 2, "ERN": 2, "ETB": 2, "EUR": 2,
+		"FJD": 2, "FKP": 2, "GBP": 2, "GEL": 2, "GHS": 2, "GIP": 2,
+		"GMD": 2, "GNF": 0, "GTQ": 2, "GYD": 2, "HKD": 2, "HNL": 2,
+		"HTG": 2, "HUF": 2, "IDR": 2, "ILS": 2, "INR": 2, "IQD": 3,
+		"IRR": 2, "ISK": 0, "JMD": 2, "JOD": 3, "JPY": 0, "KES": 2,
+		"KGS": 2, "KHR": 2, "KMF": 0, "KPW": 2, "KRW": 0, "KWD": 3,
+		"KYD": 2, "KZT": 2, "LAK": 2, "LBP": 2, "LKR": 2, "LRD": 2,
+		"LSL": 2, "LYD": 3, "MAD": 2, "MDL": 2, "MGA": 2, "MKD": 2,
+		"MMK": 2, "MNT": 2, "MOP": 2, "MRU": 2, "MUR": 2, "MVR": 2,
+		"MWK": 2, "MXN": 2, "MXV": 2, "MYR": 2, "MZN": 2, "NAD": 2,
+		"NGN": 2, "NIO": 2, "NOK": 2, "NPR": 2, "NZD": 2, "OMR": 3,
+		"PAB": 2, "PEN": 2, "PGK": 2, "PHP": 2, "PKR": 2, "PLN": 2,
+		"PYG": 0, "QAR": 2, "RON": 2, "RSD": 2, "RUB": 2, "RWF": 0,
+		"SAR": 2, "SBD": 2, "SCR": 2, "SDG": 2, "SEK": 2, "SGD": 2,
+		"SHP": 2, "SLE": 2, "SOS": 2, "SRD": 2, "SSP": 2, "STN": 2,
+		"SVC": 2, "SYP": 2, "SZL": 2, "THB": 2, "TJS": 2, "TMT": 2,
+		"TND": 3, "TOP": 2, "TRY": 2, "TTD": 2, "TWD": 2, "TZS": 2,
+		"UAH": 2, "UGX": 0, "USD": 2, "USN": 2, "UYI": 0, "UYU": 2,
+		"UYW": 4, "UZS": 2, "VED": 2, "VES": 2, "VND": 0, "VUV": 0,
+		"WST": 2, "XAF": 0, "XCD": 2, "XCG": 2, "XOF": 0, "XPF": 0,
+		"YER": 2, "ZAR": 2, "ZMW": 2, "ZWG": 2,
+	}
+
+	imgFormatMIMETypes = map[string]string{
+		"png":  "image/png",
+		"jpeg": "image/jpeg",
+		"gif":  "image/gif",
+		"webp": "image/webp",
+	}
+
+	// Formats that any image can be converted to for thumbnails, in the
+	// order of preference.
+	imgOutputFormats = []string{"webp", "jpeg", "png"}
 
 	allowedImgMIMETypes = []string{
 		"image/png",
 		"image/jpeg",
+		"image/gif",
+		"image/webp",
 	}
 
 	queryAddItem string = "INSERT INTO %s (item_id, created_at, " +
-		"updated_at, item_count, item_price, item_brand, item_name, " +
-		"item_desc) values (:item_id, :created_at, :updated_at, " +
-		":item_count, :item_price, :item_brand, :item_name, " +
-		":item_desc)"
+		"updated_at, item_count, item_price, item_currency, item_brand, " +
+		"item_name, item_desc) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)"
+
+	queryGetItem string = "SELECT * from %s where item_id = $1 " +
+		"AND deleted_at IS NULL LIMIT 1"
+
+	// Filters that are NULL match every item.
+	queryListFilter string = "WHERE deleted_at IS NULL " +
+		"AND ($1::VARCHAR IS NULL OR item_brand = $1::VARCHAR) " +
+		"AND ($2::NUMERIC IS NULL OR item_price >= $2::NUMERIC) " +
+		"AND ($3::NUMERIC IS NULL OR item_price <= $3::NUMERIC) " +
+		"AND ($4::BIGINT IS NULL OR item_count >= $4::BIGINT) " +
+		"AND ($5::BIGINT IS NULL OR item_count <= $5::BIGINT)"
+
+	// Formatted with the column to order by, the order, and the operator
+	// that compares the cursor in that order ("<" for "desc").
+	queryListItems string = "SELECT * FROM %[1]s " + queryListFilter +
+		" AND ($6::TIMESTAMP IS NULL OR " +
+		"(%[2]s, item_id) %[4]s ($6::TIMESTAMP, $7)) " +
+		"ORDER BY %[2]s %[3]s, item_id %[3]s LIMIT $8"
+
+	queryCountItems string = "SELECT COUNT(*) FROM %s " + queryListFilter
+
+	querySearchItems string = "SELECT %[1]s.*, ts_rank(%[2]s, q) AS rank, " +
+		"ts_headline('%[3]s', item_name, q, $4) AS item_name_hl, " +
+		"ts_headline('%[3]s', item_brand, q, $4) AS item_brand_hl, " +
+		"ts_headline('%[3]s', item_desc, q, $4) AS item_desc_hl " +
+		"FROM %[1]s, to_tsquery('%[3]s', $1) q WHERE %[2]s @@ q " +
+		"AND deleted_at IS NULL ORDER BY rank DESC, item_id " +
+		"LIMIT $2 OFFSET $3"
+
+	queryCountSearch string = "SELECT COUNT(*) FROM %[1]s, " +
+		"to_tsquery('%[3]s', $1) q WHERE %[2]s @@ q AND deleted_at IS NULL"
+
+	// Fields that are NULL are left as they are; "item_version" has to be
+	// one of $9 (if it is not NULL, see "If-Match"). The price is returned
+	// to be checked against the currency (see checkPrice).
+	queryUpdateItem string = "UPDATE %s SET " +
+		"item_count = COALESCE($1::INT, item_count), " +
+		"item_price = COALESCE($2::NUMERIC, item_price), " +
+		"item_currency = COALESCE($3::VARCHAR, item_currency), " +
+		"item_brand = COALESCE($4::VARCHAR, item_brand), " +
+		"item_name = COALESCE($5::VARCHAR, item_name), " +
+		"item_desc = COALESCE($6::VARCHAR, item_desc), " +
+		"updated_at = $7, item_version = item_version + 1 " +
+		"WHERE item_id = $8 AND deleted_at IS NULL " +
+		"AND ($9::BIGINT[] IS NULL OR item_version = ANY($9::BIGINT[])) " +
+		"RETURNING item_price, item_currency"
+
+	queryAdjustStock string = "UPDATE %s SET item_count = item_count + $1, " +
+		"updated_at = $2, item_version = item_version + 1 " +
+		"WHERE item_id = $3 AND deleted_at IS NULL " +
+		"AND item_count::BIGINT + $1 BETWEEN 0 AND 2147483647 " +
+		"AND ($4::BIGINT[] IS NULL OR item_version = ANY($4::BIGINT[])) " +
+		"RETURNING item_count"
+
+	queryAddMovement string = "INSERT INTO %s (item_id, delta, reason, " +
+		"actor, created_at) VALUES ($1, $2, $3, $4, $5)"
+
+	queryAddCountChange string = "INSERT INTO %s (item_id, delta, reason, " +
+		"actor, created_at) SELECT item_id, $2 - item_count, $3, $4, $5 " +
+		"FROM %s WHERE item_id = $1 AND deleted_at IS NULL " +
+		"AND item_count <> $2 FOR UPDATE"
+
+	queryListMovements string = "SELECT * FROM %s WHERE item_id = $1 " +
+		"AND movement_id < $2 ORDER BY movement_id DESC LIMIT $3"
+
+	queryCountMovements string = "SELECT COUNT(*) FROM %s " +
+		"WHERE item_id = $1"
+
+	queryImportSavepoint string = "SAVEPOINT import_row"
+	queryImportRollback  string = "ROLLBACK TO SAVEPOINT import_row"
+	queryImportRelease   string = "RELEASE SAVEPOINT import_row"
+
+	queryDeleteItem string = "DELETE from %s WHERE item_id = $1 " +
+		"AND ($2::BIGINT[] IS NULL OR item_version = ANY($2::BIGINT[]))"
+
+	queryTrashItem string = "UPDATE %s SET deleted_at = $1, " +
+		"updated_at = $1, item_version = item_version + 1 " +
+		"WHERE item_id = $2 AND deleted_at IS NULL " +
+		"AND ($3::BIGINT[] IS NULL OR item_version = ANY($3::BIGINT[]))"
+
+	queryRestoreItem string = "UPDATE %s SET deleted_at = NULL, " +
+		"updated_at = $1, item_version = item_version + 1 " +
+		"WHERE item_id = $2 AND deleted_at IS NOT NULL " +
+		"AND ($3::BIGINT[] IS NULL OR item_version = ANY($3::BIGINT[]))"
+
+	queryListTrash string = "SELECT * FROM %s WHERE deleted_at IS NOT NULL " +
+		"AND (CAST($1 AS TIMESTAMP) IS NULL OR " +
+		"(deleted_at, item_id) < (CAST($1 AS TIMESTAMP), $2)) " +
+		"ORDER BY deleted_at DESC, item_id DESC LIMIT $3"
+
+	queryCountTrash string = "SELECT COUNT(*) FROM %s " +
+		"WHERE deleted_at IS NOT NULL"
+
+	queryPurgeTrash string = "DELETE FROM %s WHERE deleted_at IS NOT NULL " +
+		"AND deleted_at < $1 RETURNING item_id"
+
+	queryItemExists string = "SELECT EXISTS (SELECT 1 FROM %s " +
+		"WHERE item_id = $1 AND deleted_at IS NULL)"
+
+	queryItemTrashed string = "SELECT EXISTS (SELECT 1 FROM %s " +
+		"WHERE item_id = $1 AND deleted_at IS NOT NULL)"
+
+	queryAnyItemExists string = "SELECT EXISTS (SELECT 1 FROM %s " +
+		"WHERE item_id = $1)"
+
+	queryAddImage string = "INSERT INTO %s (image_id, item_id, image_name, " +
+		"position, is_primary, created_at, image_width, image_height, " +
+		"image_size, image_mime, staged_name) SELECT $1, $2, $3, " +
+		"COALESCE(MAX(position) + 1, 0), " +
+		"COUNT(*) FILTER (WHERE is_primary) = 0, $4::TIMESTAMP, " +
+		"$5::INT, $6::INT, $7::BIGINT, $8::VARCHAR, $9::VARCHAR " +
+		"FROM %s WHERE item_id = $2 RETURNING *"
+
+	queryReplaceImage string = "UPDATE %s SET image_width = $3, " +
+		"image_height = $4, image_size = $5, image_mime = $6, " +
+		"staged_name = $7 WHERE item_id = $1 AND image_id = $2 RETURNING *"
+
+	queryClearStaged string = "UPDATE %s SET staged_name = NULL " +
+		"WHERE image_id = $1 AND staged_name = $2"
+
+	queryListStagedImages string = "SELECT * FROM %s " +
+		"WHERE staged_name IS NOT NULL"
+
+	queryListPublishedImages string = "SELECT * FROM %s " +
+		"WHERE staged_name IS NULL ORDER BY item_id, position, image_id"
+
+	// The images of trashed items are not found (as the items are not).
+	queryGetPrimaryImage string = "SELECT img.* FROM %s img " +
+		"JOIN %s inv ON inv.item_id = img.item_id " +
+		"WHERE img.item_id = $1 AND inv.deleted_at IS NULL " +
+		"AND img.is_primary"
+
+	queryGetImage string = "SELECT img.* FROM %s img " +
+		"JOIN %s inv ON inv.item_id = img.item_id " +
+		"WHERE img.item_id = $1 AND inv.deleted_at IS NULL " +
+		"AND img.image_id = $2"
+
+	queryGetImageAt string = "SELECT img.* FROM %s img " +
+		"JOIN %s inv ON inv.item_id = img.item_id " +
+		"WHERE img.item_id = $1 AND inv.deleted_at IS NULL " +
+		"ORDER BY img.position, img.image_id OFFSET $2 LIMIT 1"
+
+	queryListImages string = "SELECT * FROM %s WHERE item_id = $1 " +
+		"ORDER BY position, image_id"
+
+	queryListImageIDs string = "SELECT image_id FROM %s " +
+		"WHERE item_id = $1 FOR UPDATE"
+
+	queryOrderImages string = "UPDATE %s SET " +
+		"position = array_position($2::TEXT[], image_id::TEXT) - 1 " +
+		"WHERE item_id = $1"
+
+	queryClearPrimary string = "UPDATE %s SET is_primary = FALSE " +
+		"WHERE item_id = $1 AND is_primary"
+
+	querySetPrimary string = "UPDATE %s SET is_primary = TRUE " +
+		"WHERE item_id = $1 AND image_id = $2 RETURNING *"
+
+	queryDeleteImage string = "DELETE FROM %s WHERE item_id = $1 " +
+		"AND image_id = $2 RETURNING *"
+
+	queryPromoteImage string = "UPDATE %[1]s SET is_primary = TRUE " +
+		"WHERE image_id = (SELECT image_id FROM %[1]s WHERE item_id = $1 " +
+		"ORDER BY position, image_id LIMIT 1)"
 
-	queryGetItem string = "SELECT * from %s where item_id = $1 LIMIT 1"
+	queryListItemIDs string = "SELECT item_id FROM %s"
 
-	queryListItems string = "SELECT * FROM %s ORDER BY {{ .OrderBy }} " +
-		"{{ .Order }}"
+	// The table has (at most) one row, as for "golang-migrate/migrate", so
+	// that databases migrated by it carry on from where they are.
+	queryCreateMigrations string = "CREATE TABLE IF NOT EXISTS %s " +
+		"(version BIGINT NOT NULL PRIMARY KEY, dirty BOOLEAN NOT NULL)"
 
-	queryUpdateItem string = "UPDATE %s SET %s = $1, updated_at = $2 " +
-		"WHERE item_id = $3"
+	queryGetMigration   string = "SELECT version, dirty FROM %s LIMIT 1"
+	queryClearMigration string = "DELETE FROM %s"
+	querySetMigration   string = "INSERT INTO %s (version, dirty) " +
+		"VALUES ($1, $2)"
 
-	queryDeleteItem string = "DELETE from %s WHERE item_id = $1"
+	queryAdvisoryLock    string = "SELECT pg_advisory_lock($1)"
+	queryAdvisoryTryLock string = "SELECT pg_try_advisory_lock($1)"
+	queryAdvisoryUnlock  string = "SELECT pg_advisory_unlock($1)"
 )
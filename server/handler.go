@@ -1,23 +1,21 @@
 package main
 
 import (
-	"bytes"
-	"database/sql"
 	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"net/http"
-	"os"
-	"path"
-	"reflect"
-	"sync"
-	"text/template"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/gabriel-vasile/mimetype"
 	"github.com/gin-gonic/gin"
-	"github.com/jmoiron/sqlx"
 )
 
 func noRouteHandler(ctx *gin.Context) {
@@ -30,24 +28,26 @@ func pingHandler(ctx *gin.Context) {
 
 func addHandler(ctx *gin.Context) {
 	var (
-		dbConn   *sqlx.DB
-		dbTx     *sql.Tx
-		dbQuery  string
-		mux      *sync.Mutex
-		item     inventoryRow
-		reqBody  apiRequestAddBody
-		imgBuff  []byte
-		imgMIME  *mimetype.MIME
-		imgDir   string
-		imgFile  *os.File
-		itemHash string
-		currUnix time.Time
-		currLoc  *time.Location
-		err      error
+		inv       InventoryStore
+		mux       *itemLocker
+		item      inventoryRow
+		reqBody   apiRequestAddBody
+		imgBuff   []byte
+		imgMIME   *mimetype.MIME
+		imgStaged string
+		imgMeta   imageMeta
+		image     imageRow
+		store     ImageStore
+		itemHash  string
+		status    int
+		statusMsg string
+		currUnix  time.Time
+		currLoc   *time.Location
+		err       error
 	)
 
-	if dbConn, err = ensureDbMiddleware(ctx); err != nil {
-		log.Printf("route: database precondition failed: %v", err)
+	if inv, err = ensureInventoryMiddleware(ctx); err != nil {
+		log.Printf("route: inventory precondition failed: %v", err)
 		ctx.JSON(http.StatusInternalServerError, apiResponse{
 			Error: "Internal Server Error",
 		})
@@ -62,29 +62,78 @@ func addHandler(ctx *gin.Context) {
 		return
 	}
 
-	if err = ctx.ShouldBindJSON(&reqBody); err != nil {
-		log.Printf("route: malformed request: %v", err)
-		ctx.JSON(http.StatusBadRequest, apiResponse{
-			Error: "Malformed Request",
+	if store, err = ensureImgStoreMiddleware(ctx); err != nil {
+		log.Printf("route: image store precondition failed: %v", err)
+		ctx.JSON(http.StatusInternalServerError, apiResponse{
+			Error: "Internal Server Error",
 		})
 		return
 	}
 
-	imgBuff, err = base64.StdEncoding.DecodeString(reqBody.ImgBase64)
-	if err != nil {
-		log.Printf("enc: bad base64 image upload: %v", err)
-		ctx.JSON(http.StatusBadRequest, apiResponse{
-			Error: "Bad Base64 Image Encoding",
-		})
-		return
+	itemHash = genItemHash()
+
+	// Multipart bodies carry the image as a file, which is streamed to the
+	// store; JSON bodies carry it as a base64 string.
+	if isMultipartRequest(ctx) {
+		imgStaged, imgMeta, err = bindMultipartUpload(
+			ctx, store, itemHash, &reqBody.itemData,
+		)
+		if err != nil {
+			log.Printf("route: bad multipart upload: %v", err)
+			status, statusMsg = uploadErrorStatus(err)
+			ctx.JSON(status, apiResponse{Error: statusMsg})
+			return
+		}
+
+		if len(imgStaged) <= 0 {
+			log.Printf("route: malformed request: %v", errors.New("no image"))
+			ctx.JSON(http.StatusBadRequest, apiResponse{
+				Error: "Malformed Request",
+			})
+			return
+		}
+	} else {
+		if err = ctx.ShouldBindJSON(&reqBody); err != nil {
+			log.Printf("route: malformed request: %v", err)
+			ctx.JSON(http.StatusBadRequest, apiResponse{
+				Error: "Malformed Request",
+			})
+			return
+		}
+
+		imgBuff, err = base64.StdEncoding.DecodeString(reqBody.ImgBase64)
+		if err != nil {
+			log.Printf("enc: bad base64 image upload: %v", err)
+			ctx.JSON(http.StatusBadRequest, apiResponse{
+				Error: "Bad Base64 Image Encoding",
+			})
+			return
+		}
+
+		imgMIME = mimetype.Detect(imgBuff)
+		if !mimetype.EqualsAny(imgMIME.String(), allowedImgMIMETypes...) {
+			log.Printf("enc: bad base64 image upload: %v", err)
+			ctx.JSON(http.StatusBadRequest, apiResponse{
+				Error: "Bad Image MIME type",
+			})
+			return
+		}
+
+		imgStaged, imgMeta, err = stageItemImage(
+			store, itemHash, imgBuff,
+		)
+		if err != nil {
+			log.Printf("fs: failed to stage image: %v", err)
+			status, statusMsg = uploadErrorStatus(err)
+			ctx.JSON(status, apiResponse{Error: statusMsg})
+			return
+		}
 	}
 
-	imgMIME = mimetype.Detect(imgBuff)
-	if !mimetype.EqualsAny(imgMIME.String(), allowedImgMIMETypes...) {
-		log.Printf("enc: bad base64 image upload: %v", err)
-		ctx.JSON(http.StatusBadRequest, apiResponse{
-			Error: "Bad Image MIME type",
-		})
+	if err = checkItemPrice(&reqBody.itemData); err != nil {
+		log.Printf("route: bad price: %v", err)
+		respondInventoryError(ctx, err)
+		store.DeleteAll(itemHash)
 		return
 	}
 
@@ -93,15 +142,16 @@ func addHandler(ctx *gin.Context) {
 		ctx.JSON(http.StatusBadRequest, apiResponse{
 			Error: "Clock Error",
 		})
+		store.DeleteAll(itemHash)
 		return
 	}
 
-	itemHash = genItemHash()
 	currUnix = time.Now().In(currLoc)
 	{
 		item.ItemID = itemHash
 		item.ItemCount = reqBody.ItemCount
 		item.ItemPrice = reqBody.ItemPrice
+		item.ItemCurrency = reqBody.ItemCurrency
 		item.ItemBrand = reqBody.ItemBrand
 		item.ItemName = reqBody.ItemName
 		item.ItemDesc = reqBody.ItemDesc
@@ -109,81 +159,171 @@ func addHandler(ctx *gin.Context) {
 		item.UpdatedAt = currUnix
 	}
 
-	if dbTx, err = dbConn.Begin(); err != nil {
-		log.Printf("db: failed to acquire lock: %v", err)
+	image, err = inv.AddItem(item, imgStaged, imgMeta, requestActor(ctx))
+	if err != nil {
+		respondInventoryError(ctx, err)
+		store.DeleteAll(itemHash)
+		return
+	}
+
+	mux.Lock(itemHash)
+	if err = publishItemImage(inv, store, image, imgStaged); err != nil {
+		log.Printf("fs: failed to publish image: %v", err)
+		ctx.JSON(http.StatusInternalServerError, apiResponse{
+			Error: "Image Write Failed",
+		})
+		mux.Unlock(itemHash)
+		return
+	}
+	mux.Unlock(itemHash)
+
+	ctx.JSON(http.StatusCreated, apiResponse{Data: itemID{itemHash}})
+}
+
+func importHandler(ctx *gin.Context) {
+	var (
+		inv         InventoryStore
+		mux         *itemLocker
+		store       ImageStore
+		importQuery apiRequestImportQuery
+		reader      importReader
+		row         importRow
+		item        importItem
+		batch       []importItem
+		report      importReport
+		rowErr      *importRowError
+		actor       string
+		currUnix    time.Time
+		currLoc     *time.Location
+		err         error
+	)
+
+	if inv, err = ensureInventoryMiddleware(ctx); err != nil {
+		log.Printf("route: inventory precondition failed: %v", err)
 		ctx.JSON(http.StatusInternalServerError, apiResponse{
 			Error: "Internal Server Error",
 		})
 		return
 	}
 
-	dbQuery = fmt.Sprintf(queryAddItem, dbTable)
-	if _, err = dbConn.NamedExec(dbQuery, item); err != nil {
-		log.Printf("db: failed to insert row: %v", err)
+	if mux, err = ensureMuxMiddleware(ctx); err != nil {
+		log.Printf("route: mutex precondition failed: %v", err)
 		ctx.JSON(http.StatusInternalServerError, apiResponse{
 			Error: "Internal Server Error",
 		})
 		return
 	}
 
-	if err = dbTx.Commit(); err != nil {
-		log.Printf("db: failed to commit transaction: %v", err)
+	if store, err = ensureImgStoreMiddleware(ctx); err != nil {
+		log.Printf("route: image store precondition failed: %v", err)
 		ctx.JSON(http.StatusInternalServerError, apiResponse{
 			Error: "Internal Server Error",
 		})
 		return
 	}
 
-	imgDir = path.Join(imageRootDir, itemHash)
-	if _, err = os.Stat(imgDir); errors.Is(err, os.ErrNotExist) {
-		if err = os.MkdirAll(imgDir, os.ModePerm); err != nil {
-			log.Printf("fs: failed to create directory: %v", err)
-			ctx.JSON(http.StatusInternalServerError, apiResponse{
-				Error: "Image Write Failed",
+	if err = ctx.ShouldBindQuery(&importQuery); err != nil {
+		log.Printf("route: query string parse failed: %v", err)
+		ctx.JSON(http.StatusBadRequest, apiResponse{
+			Error: "Malformed Request",
+		})
+		return
+	}
+
+	if len(importQuery.Format) <= 0 {
+		importQuery.Format = "jsonl"
+		if ctx.ContentType() == "text/csv" {
+			importQuery.Format = "csv"
+		}
+	}
+
+	if importQuery.Format == "csv" {
+		if reader, err = newCSVImportReader(ctx.Request.Body); err != nil {
+			log.Printf("route: malformed request: %v", err)
+			ctx.JSON(http.StatusBadRequest, apiResponse{
+				Error: "Malformed CSV Header",
 			})
 			return
 		}
+	} else {
+		reader = newJSONLImportReader(ctx.Request.Body)
 	}
 
-	mux.Lock()
-	imgFile, err = os.Create(path.Join(imgDir, "original"))
-	if err != nil {
-		log.Printf("fs: failed to open file: %v", err)
-		ctx.JSON(http.StatusInternalServerError, apiResponse{
-			Error: "Image Write Failed",
+	if currLoc, err = time.LoadLocation("UTC"); err != nil {
+		log.Printf("enc: failed to load time-zone: %v", err)
+		ctx.JSON(http.StatusBadRequest, apiResponse{
+			Error: "Clock Error",
 		})
-		mux.Unlock()
 		return
 	}
-	defer imgFile.Close()
 
-	if _, err = imgFile.Write(imgBuff); err != nil {
-		log.Printf("fs: failed to write image: %v", err)
-		ctx.JSON(http.StatusInternalServerError, apiResponse{
-			Error: "Image Write Failed",
-		})
-		mux.Unlock()
-		return
+	actor = requestActor(ctx)
+	report.Rows = []importResult{}
+
+	// Rows are read one at a time, and inserted in batches; images are
+	// staged on disk as they are read, so that a batch does not have to
+	// hold all of them in memory.
+	for rowNum := 1; ; rowNum++ {
+		if row, err = reader.Next(); err == io.EOF {
+			break
+		}
+
+		if errors.As(err, &rowErr) {
+			report.Failed++
+			report.Rows = append(report.Rows, importResult{
+				Row: rowNum, Error: rowErr.Error(),
+			})
+			continue
+		}
+
+		if err != nil {
+			log.Printf("route: import read failed: %v", err)
+			flushImportBatch(inv, mux, store, batch, actor, &report)
+			sort.Slice(report.Rows, func(i, j int) bool {
+				return report.Rows[i].Row < report.Rows[j].Row
+			})
+			ctx.JSON(http.StatusBadRequest, apiResponse{
+				Data:  report,
+				Error: "Malformed Request",
+			})
+			return
+		}
+
+		currUnix = time.Now().In(currLoc)
+		if item, err = prepareImportItem(store, &row, currUnix); err != nil {
+			report.Failed++
+			report.Rows = append(report.Rows, importResult{
+				Row: rowNum, Error: err.Error(),
+			})
+			continue
+		}
 
+		item.row = rowNum
+		batch = append(batch, item)
+		if len(batch) >= importQuery.BatchSize {
+			flushImportBatch(inv, mux, store, batch, actor, &report)
+			batch = batch[:0]
+		}
 	}
-	mux.Unlock()
+	flushImportBatch(inv, mux, store, batch, actor, &report)
 
-	ctx.JSON(http.StatusCreated, apiResponse{Data: itemID{itemHash}})
+	sort.Slice(report.Rows, func(i, j int) bool {
+		return report.Rows[i].Row < report.Rows[j].Row
+	})
+
+	ctx.JSON(http.StatusOK, apiResponse{Data: report})
 }
 
 func getHandler(ctx *gin.Context) {
 	var (
-		dbConn  *sqlx.DB
-		dbRow   *sqlx.Row
-		dbStmt  *sqlx.Stmt
-		dbQuery string
+		inv     InventoryStore
 		itemURI itemID
 		item    inventoryRow
 		err     error
 	)
 
-	if dbConn, err = ensureDbMiddleware(ctx); err != nil {
-		log.Printf("route: database precondition failed: %v", err)
+	if inv, err = ensureInventoryMiddleware(ctx); err != nil {
+		log.Printf("route: inventory precondition failed: %v", err)
 		ctx.JSON(http.StatusInternalServerError, apiResponse{
 			Error: "Internal Server Error",
 		})
@@ -198,20 +338,10 @@ func getHandler(ctx *gin.Context) {
 		return
 	}
 
-	dbQuery = fmt.Sprintf(queryGetItem, dbTable)
-	dbStmt, err = dbConn.Preparex(dbQuery)
-	if err != nil {
-		log.Printf("db: prepare failed: %v", err)
-		ctx.JSON(http.StatusInternalServerError, apiResponse{
-			Error: "Database Connnection Failure",
-		})
-		return
-	}
-	defer dbStmt.Close()
-
-	dbRow = dbStmt.QueryRowx(itemURI.ItemID)
-	if err = dbRow.StructScan(&item); err != nil {
-		if err == sql.ErrNoRows {
+	// The primary image is described along with the item, so that clients
+	// can lay it out without fetching it.
+	if item, err = inv.GetItem(itemURI.ItemID); err != nil {
+		if errors.Is(err, errItemNotFound) {
 			ctx.JSON(http.StatusNotFound, apiResponse{
 				Error: "No Such Item",
 			})
@@ -225,6 +355,12 @@ func getHandler(ctx *gin.Context) {
 		return
 	}
 
+	ctx.Header("ETag", itemETag(item.Version))
+	if ifNoneMatch(ctx, item.Version) {
+		ctx.Status(http.StatusNotModified)
+		return
+	}
+
 	ctx.JSON(http.StatusOK, apiResponse{
 		Data: item,
 	})
@@ -232,21 +368,18 @@ func getHandler(ctx *gin.Context) {
 
 func listHandler(ctx *gin.Context) {
 	var (
-		dbConn      *sqlx.DB
-		dbStmt      *sqlx.Stmt
-		dbTmpl      *template.Template
-		dbRows      *sqlx.Rows
-		dbQuery     string
-		dbQueryTmpl bytes.Buffer
-		item        inventoryRow
-		listQuery   apiRequestListQuery
-		err         error
-
-		rows = []inventoryRow{}
+		inv       InventoryStore
+		rows      []inventoryRow
+		item      inventoryRow
+		listQuery apiRequestListQuery
+		cur       *listCursor
+		tmp       listCursor
+		page      apiResponsePage
+		err       error
 	)
 
-	if dbConn, err = ensureDbMiddleware(ctx); err != nil {
-		log.Printf("route: database precondition failed: %v", err)
+	if inv, err = ensureInventoryMiddleware(ctx); err != nil {
+		log.Printf("route: inventory precondition failed: %v", err)
 		ctx.JSON(http.StatusInternalServerError, apiResponse{
 			Error: "Internal Server Error",
 		})
@@ -261,36 +394,75 @@ func listHandler(ctx *gin.Context) {
 		return
 	}
 
-	dbQuery = fmt.Sprintf(queryListItems, dbTable)
-	dbTmpl, err = template.New("queryListItems").Parse(dbQuery)
+	if len(listQuery.Cursor) > 0 {
+		if tmp, err = decodeListCursor(listQuery.Cursor); err != nil {
+			log.Printf("route: bad cursor: %v", err)
+			ctx.JSON(http.StatusBadRequest, apiResponse{
+				Error: "Invalid Cursor",
+			})
+			return
+		}
+		cur = &tmp
+	}
+
+	// One extra row is fetched to find out if there is a next page.
+	rows, page.Total, err = inv.ListItems(
+		&listQuery.listFilter, listQuery.Limit+1, cur,
+	)
 	if err != nil {
-		log.Printf("db: template parse failed: %v", err)
+		log.Printf("db: query failed: %v", err)
 		ctx.JSON(http.StatusInternalServerError, apiResponse{
-			Error: "Query Parse Failure",
+			Error: "Database Query Failure",
 		})
 		return
 	}
 
-	if err = dbTmpl.Execute(&dbQueryTmpl, &listQuery); err != nil {
-		log.Printf("db: template execute failed: %v", err)
+	page.Limit = listQuery.Limit
+	if uint(len(rows)) > listQuery.Limit {
+		rows = rows[:listQuery.Limit]
+		item = rows[len(rows)-1]
+
+		tmp = listCursor{At: item.UpdatedAt, ID: item.ItemID}
+		if listQuery.OrderBy == "created_at" {
+			tmp.At = item.CreatedAt
+		}
+		page.NextCursor = encodeListCursor(tmp)
+	}
+
+	ctx.JSON(http.StatusOK, apiResponse{Data: rows, Page: &page})
+}
+
+func exportHandler(ctx *gin.Context) {
+	var (
+		inv         InventoryStore
+		dbRows      itemRows
+		row         exportRow
+		exportQuery apiRequestExportQuery
+		csvOut      *csv.Writer
+		jsonOut     *json.Encoder
+		baseURL     string
+		fileName    string
+		numRows     int
+		err         error
+	)
+
+	if inv, err = ensureInventoryMiddleware(ctx); err != nil {
+		log.Printf("route: inventory precondition failed: %v", err)
 		ctx.JSON(http.StatusInternalServerError, apiResponse{
-			Error: "Query Parse Failure",
+			Error: "Internal Server Error",
 		})
 		return
 	}
 
-	dbStmt, err = dbConn.Preparex(dbQueryTmpl.String())
-	if err != nil {
-		log.Printf("db: prepare failed: %v", err)
-		ctx.JSON(http.StatusInternalServerError, apiResponse{
-			Error: "Database Connnection Failure",
+	if err = ctx.ShouldBindQuery(&exportQuery); err != nil {
+		log.Printf("route: query string parse failed: %v", err)
+		ctx.JSON(http.StatusBadRequest, apiResponse{
+			Error: "Malformed Request",
 		})
 		return
 	}
-	defer dbStmt.Close()
 
-	dbRows, err = dbStmt.Queryx()
-	if err != nil {
+	if dbRows, err = inv.ExportItems(&exportQuery.listFilter); err != nil {
 		log.Printf("db: query failed: %v", err)
 		ctx.JSON(http.StatusInternalServerError, apiResponse{
 			Error: "Database Query Failure",
@@ -299,55 +471,173 @@ func listHandler(ctx *gin.Context) {
 	}
 	defer dbRows.Close()
 
-	for dbRows.Next() {
-		err = dbRows.StructScan(&item)
-		if err != nil {
-			log.Printf("db: failed to fetch row: %v", err)
-			ctx.JSON(http.StatusInternalServerError, apiResponse{
-				Error: "Database Query Failure",
+	if exportQuery.Images {
+		baseURL = requestBaseURL(ctx)
+	}
+
+	fileName = fmt.Sprintf(
+		"inventory-%s.%s",
+		time.Now().UTC().Format("20060102T150405Z"), exportQuery.Format,
+	)
+	ctx.Header(
+		"Content-Disposition",
+		fmt.Sprintf("attachment; filename=%q", fileName),
+	)
+
+	// Rows are written out as they are read from the database; once the
+	// first byte is out, errors can only be logged (and the response is
+	// cut short).
+	if exportQuery.Format == "csv" {
+		ctx.Header("Content-Type", "text/csv; charset=utf-8")
+		ctx.Status(http.StatusOK)
+
+		if exportQuery.Excel {
+			ctx.Writer.WriteString(excelBOM)
+		}
+
+		csvOut = csv.NewWriter(ctx.Writer)
+		csvOut.UseCRLF = exportQuery.Excel
+
+		if exportQuery.Images {
+			err = csvOut.Write(append(exportColumns, "image_url"))
+		} else {
+			err = csvOut.Write(exportColumns)
+		}
+	} else {
+		ctx.Header("Content-Type", "application/x-ndjson")
+		ctx.Status(http.StatusOK)
+
+		jsonOut = json.NewEncoder(ctx.Writer)
+	}
+
+	for err == nil && dbRows.Next() {
+		if err = dbRows.Scan(&row.inventoryRow); err != nil {
+			break
+		}
+
+		if exportQuery.Images {
+			row.ImageURL = fmt.Sprintf("%s/img/%s", baseURL, row.ItemID)
+		}
+
+		if csvOut != nil {
+			err = csvOut.Write(exportCSVRecord(&row, exportQuery.Excel))
+		} else {
+			err = jsonOut.Encode(&row)
+		}
+
+		if numRows++; numRows%exportFlushRows == 0 {
+			if csvOut != nil {
+				csvOut.Flush()
+			}
+			ctx.Writer.Flush()
+		}
+	}
+
+	if err == nil {
+		err = dbRows.Err()
+	}
+
+	if csvOut != nil {
+		csvOut.Flush()
+		if err == nil {
+			err = csvOut.Error()
+		}
+	}
+
+	if err != nil {
+		log.Printf("route: export failed after %d rows: %v", numRows, err)
+		ctx.Abort()
+	}
+}
+
+func searchHandler(ctx *gin.Context) {
+	var (
+		inv         InventoryStore
+		rows        []searchRow
+		terms       []string
+		searchQuery apiRequestSearchQuery
+		offset      uint64
+		page        apiResponsePage
+		err         error
+	)
+
+	if inv, err = ensureInventoryMiddleware(ctx); err != nil {
+		log.Printf("route: inventory precondition failed: %v", err)
+		ctx.JSON(http.StatusInternalServerError, apiResponse{
+			Error: "Internal Server Error",
+		})
+		return
+	}
+
+	if err = ctx.ShouldBindQuery(&searchQuery); err != nil {
+		log.Printf("route: query string parse failed: %v", err)
+		ctx.JSON(http.StatusBadRequest, apiResponse{
+			Error: "Malformed Request",
+		})
+		return
+	}
+
+	if len(searchQuery.Cursor) > 0 {
+		if offset, err = decodeNumCursor(searchQuery.Cursor); err != nil {
+			log.Printf("route: bad cursor: %v", err)
+			ctx.JSON(http.StatusBadRequest, apiResponse{
+				Error: "Invalid Cursor",
 			})
 			return
 		}
+	}
 
-		rows = append(rows, item)
+	if terms, err = searchTerms(searchQuery.Query); err != nil {
+		log.Printf("route: bad search query: %v", err)
+		ctx.JSON(http.StatusBadRequest, apiResponse{
+			Error: "Invalid Search Query",
+		})
+		return
 	}
 
-	if err = dbRows.Err(); err != nil {
-		log.Printf("db: row fetch failed: %v", err)
+	rows, page.Total, err = inv.SearchItems(
+		terms, searchQuery.Prefix, searchQuery.Limit, offset,
+	)
+	if err != nil {
+		log.Printf("db: query failed: %v", err)
 		ctx.JSON(http.StatusInternalServerError, apiResponse{
 			Error: "Database Query Failure",
 		})
 		return
 	}
 
-	ctx.JSON(http.StatusOK, apiResponse{Data: rows})
+	page.Limit = searchQuery.Limit
+	if len(rows) > 0 && int64(offset)+int64(len(rows)) < page.Total {
+		page.NextCursor = encodeNumCursor(offset + uint64(len(rows)))
+	}
+
+	ctx.JSON(http.StatusOK, apiResponse{Data: rows, Page: &page})
 }
 
 func updateHandler(ctx *gin.Context) {
 	var (
 		itemURI     itemID
-		dbConn      *sqlx.DB
-		dbTx        *sql.Tx
-		dbStmt      *sqlx.Stmt
-		dbRes       sql.Result
-		mux         *sync.Mutex
+		inv         InventoryStore
+		mux         *itemLocker
 		imgBuff     []byte
 		imgMIME     *mimetype.MIME
-		imgDir      string
-		imgFile     *os.File
-		dbQuery     string
+		imgStaged   string
+		imgMeta     imageMeta
+		image       imageRow
+		store       ImageStore
+		change      itemChange
 		err         error
-		ok          bool
+		isImage     bool
+		status      int
+		statusMsg   string
 		upField     apiRequestUpdateQuery
 		upValidator apiRequestUpdateBody
-		upVal       interface{}
 		currUnix    time.Time
 		currLoc     *time.Location
-		tmp         int64
 	)
 
-	if dbConn, err = ensureDbMiddleware(ctx); err != nil {
-		log.Printf("route: database precondition failed: %v", err)
+	if inv, err = ensureInventoryMiddleware(ctx); err != nil {
+		log.Printf("route: inventory precondition failed: %v", err)
 		ctx.JSON(http.StatusInternalServerError, apiResponse{
 			Error: "Internal Server Error",
 		})
@@ -362,6 +652,14 @@ func updateHandler(ctx *gin.Context) {
 		return
 	}
 
+	if store, err = ensureImgStoreMiddleware(ctx); err != nil {
+		log.Printf("route: image store precondition failed: %v", err)
+		ctx.JSON(http.StatusInternalServerError, apiResponse{
+			Error: "Internal Server Error",
+		})
+		return
+	}
+
 	if err = ctx.ShouldBindUri(&itemURI); err != nil {
 		log.Printf("route: invalid URI: %v", err)
 		ctx.JSON(http.StatusBadRequest, apiResponse{
@@ -378,7 +676,36 @@ func updateHandler(ctx *gin.Context) {
 		return
 	}
 
-	if err = ctx.ShouldBindJSON(&upValidator); err != nil {
+	isImage = upField.UpdateField == "image_base64" ||
+		upField.UpdateField == uploadImageField
+
+	// Multipart bodies carry the image as a file, which is streamed to the
+	// store (and published once the item is updated).
+	if isMultipartRequest(ctx) {
+		imgStaged, imgMeta, err = bindMultipartUpload(
+			ctx, store, itemURI.ItemID, &upValidator,
+		)
+		if err != nil {
+			log.Printf("route: bad multipart upload: %v", err)
+			status, statusMsg = uploadErrorStatus(err)
+			ctx.JSON(status, apiResponse{Error: statusMsg})
+			return
+		}
+
+		if isImage != (len(imgStaged) > 0) {
+			log.Printf(
+				"route: malformed request: %v",
+				errors.New("image does not match update field"),
+			)
+			ctx.JSON(http.StatusBadRequest, apiResponse{
+				Error: "Malformed Request",
+			})
+			if len(imgStaged) > 0 {
+				store.Delete(itemURI.ItemID, imgStaged)
+			}
+			return
+		}
+	} else if err = ctx.ShouldBindJSON(&upValidator); err != nil {
 		log.Printf("route: malformed request: %v", err)
 		ctx.JSON(http.StatusBadRequest, apiResponse{
 			Error: "Malformed Request",
@@ -386,190 +713,921 @@ func updateHandler(ctx *gin.Context) {
 		return
 	}
 
-	if upField.UpdateField != "image_base64" {
-		dbQuery = fmt.Sprintf(
-			queryUpdateItem, dbTable, upField.UpdateField,
-		)
+	if currLoc, err = time.LoadLocation("UTC"); err != nil {
+		log.Printf("enc: failed to load time-zone: %v", err)
+		ctx.JSON(http.StatusBadRequest, apiResponse{
+			Error: "Clock Error",
+		})
+		if len(imgStaged) > 0 {
+			store.Delete(itemURI.ItemID, imgStaged)
+		}
+		return
+	}
 
-		if dbTx, err = dbConn.Begin(); err != nil {
-			log.Printf("db: failed to acquire lock: %v", err)
-			ctx.JSON(http.StatusInternalServerError, apiResponse{
-				Error: "Internal Server Error",
+	currUnix = time.Now().In(currLoc)
+
+	switch upField.UpdateField {
+	case "item_count":
+		change.ItemCount = &upValidator.ItemCount
+	case "item_price":
+		change.ItemPrice = &upValidator.ItemPrice
+	case "item_currency":
+		upValidator.ItemCurrency = strings.ToUpper(upValidator.ItemCurrency)
+		change.ItemCurrency = &upValidator.ItemCurrency
+	case "item_brand":
+		change.ItemBrand = &upValidator.ItemBrand
+	case "item_name":
+		change.ItemName = &upValidator.ItemName
+	case "item_desc":
+		change.ItemDesc = &upValidator.ItemDesc
+	}
+
+	if isImage && len(imgStaged) <= 0 {
+		imgBuff, err = base64.StdEncoding.DecodeString(upValidator.ImageBase64)
+		if err != nil {
+			log.Printf("enc: bad base64 image upload: %v", err)
+			ctx.JSON(http.StatusBadRequest, apiResponse{
+				Error: "Bad Base64 Image Encoding",
 			})
 			return
 		}
 
-		if currLoc, err = time.LoadLocation("UTC"); err != nil {
-			log.Printf("enc: failed to load time-zone: %v", err)
+		imgMIME = mimetype.Detect(imgBuff)
+		if !mimetype.EqualsAny(imgMIME.String(), allowedImgMIMETypes...) {
+			log.Printf("enc: bad base64 image upload: %v", err)
 			ctx.JSON(http.StatusBadRequest, apiResponse{
-				Error: "Clock Error",
+				Error: "Bad Image MIME type",
 			})
 			return
 		}
 
-		currUnix = time.Now().In(currLoc)
-
-		dbStmt, err = dbConn.Preparex(dbQuery)
+		imgStaged, imgMeta, err = stageItemImage(
+			store, itemURI.ItemID, imgBuff,
+		)
 		if err != nil {
-			log.Printf("db: prepare failed: %v", err)
-			ctx.JSON(http.StatusInternalServerError, apiResponse{
-				Error: "Database Connnection Failure",
-			})
-			dbTx.Rollback()
+			log.Printf("fs: failed to stage image: %v", err)
+			status, statusMsg = uploadErrorStatus(err)
+			ctx.JSON(status, apiResponse{Error: statusMsg})
 			return
 		}
+	}
+	change.Staged, change.Meta = imgStaged, imgMeta
 
-		upVal, ok = getFieldFromTag(
-			"json", upField.UpdateField, upValidator,
-		)
-		if !ok {
+	// The version of the item is bumped even if only the image changes; the
+	// upload replaces the primary image of the item.
+	image, err = inv.UpdateItem(
+		itemURI.ItemID, change, requestWrite(ctx, currUnix),
+	)
+	if err != nil {
+		respondInventoryError(ctx, err)
+		if len(imgStaged) > 0 {
+			store.Delete(itemURI.ItemID, imgStaged)
+		}
+		return
+	}
+
+	if len(imgStaged) > 0 {
+		mux.Lock(itemURI.ItemID)
+		err = publishItemImage(inv, store, image, imgStaged)
+		if err != nil {
+			log.Printf("fs: failed to publish image: %v", err)
+			ctx.JSON(http.StatusInternalServerError, apiResponse{
+				Error: "Image Write Failed",
+			})
+			mux.Unlock(itemURI.ItemID)
+			return
+		}
+		mux.Unlock(itemURI.ItemID)
+	}
+
+	ctx.JSON(http.StatusCreated, apiResponse{Data: itemURI})
+}
+
+func patchHandler(ctx *gin.Context) {
+	var (
+		itemURI   itemID
+		inv       InventoryStore
+		change    itemChange
+		status    int
+		statusMsg string
+		mux       *itemLocker
+		reqBody   apiRequestPatchBody
+		imgBuff   []byte
+		imgMIME   *mimetype.MIME
+		imgStaged string
+		imgMeta   imageMeta
+		image     imageRow
+		store     ImageStore
+		currUnix  time.Time
+		currLoc   *time.Location
+		err       error
+	)
+
+	if inv, err = ensureInventoryMiddleware(ctx); err != nil {
+		log.Printf("route: inventory precondition failed: %v", err)
+		ctx.JSON(http.StatusInternalServerError, apiResponse{
+			Error: "Internal Server Error",
+		})
+		return
+	}
+
+	if mux, err = ensureMuxMiddleware(ctx); err != nil {
+		log.Printf("route: mutex precondition failed: %v", err)
+		ctx.JSON(http.StatusInternalServerError, apiResponse{
+			Error: "Internal Server Error",
+		})
+		return
+	}
+
+	if store, err = ensureImgStoreMiddleware(ctx); err != nil {
+		log.Printf("route: image store precondition failed: %v", err)
+		ctx.JSON(http.StatusInternalServerError, apiResponse{
+			Error: "Internal Server Error",
+		})
+		return
+	}
+
+	if err = ctx.ShouldBindUri(&itemURI); err != nil {
+		log.Printf("route: invalid URI: %v", err)
+		ctx.JSON(http.StatusBadRequest, apiResponse{
+			Error: "Invalid URI",
+		})
+		return
+	}
+
+	// Multipart bodies carry the image as a file, which is streamed to the
+	// store (and published once the item is updated).
+	if isMultipartRequest(ctx) {
+		imgStaged, imgMeta, err = bindMultipartUpload(
+			ctx, store, itemURI.ItemID, &reqBody,
+		)
+		if err != nil {
+			log.Printf("route: bad multipart upload: %v", err)
+			status, statusMsg = uploadErrorStatus(err)
+			ctx.JSON(status, apiResponse{Error: statusMsg})
+			return
+		}
+
+		if len(imgStaged) > 0 && reqBody.ImageBase64 != nil {
 			log.Printf(
 				"route: malformed request: %v",
-				errors.New("could not find field"),
+				errors.New("more than one image"),
 			)
 			ctx.JSON(http.StatusBadRequest, apiResponse{
 				Error: "Malformed Request",
 			})
-			dbTx.Rollback()
+			store.Delete(itemURI.ItemID, imgStaged)
 			return
 		}
+	} else if err = ctx.ShouldBindJSON(&reqBody); err != nil {
+		log.Printf("route: malformed request: %v", err)
+		ctx.JSON(http.StatusBadRequest, apiResponse{
+			Error: "Malformed Request",
+		})
+		return
+	}
 
-		switch reflect.TypeOf(upVal).Kind() {
-		case reflect.String:
-			dbRes, err = dbStmt.Exec(
-				upVal.(string), currUnix, itemURI.ItemID,
-			)
-		case reflect.Uint64:
-			dbRes, err = dbStmt.Exec(
-				upVal.(uint64), currUnix, itemURI.ItemID,
-			)
-		case reflect.Float64:
-			log.Println("float")
-			dbRes, err = dbStmt.Exec(
-				upVal.(float64), currUnix, itemURI.ItemID,
+	if reqBody.ItemCurrency != nil {
+		*reqBody.ItemCurrency = strings.ToUpper(*reqBody.ItemCurrency)
+	}
+
+	change = itemChange{
+		ItemCount:    reqBody.ItemCount,
+		ItemPrice:    reqBody.ItemPrice,
+		ItemCurrency: reqBody.ItemCurrency,
+		ItemBrand:    reqBody.ItemBrand,
+		ItemName:     reqBody.ItemName,
+		ItemDesc:     reqBody.ItemDesc,
+	}
+	if change == (itemChange{}) && reqBody.ImageBase64 == nil &&
+		len(imgStaged) <= 0 {
+		ctx.JSON(http.StatusBadRequest, apiResponse{
+			Error: "Nothing To Update",
+		})
+		return
+	}
+
+	// Validate the image before touching the database, so that a bad
+	// upload does not need a rollback.
+	if reqBody.ImageBase64 != nil {
+		imgBuff, err = base64.StdEncoding.DecodeString(*reqBody.ImageBase64)
+		if err != nil {
+			log.Printf("enc: bad base64 image upload: %v", err)
+			ctx.JSON(http.StatusBadRequest, apiResponse{
+				Error: "Bad Base64 Image Encoding",
+			})
+			return
+		}
+
+		imgMIME = mimetype.Detect(imgBuff)
+		if !mimetype.EqualsAny(imgMIME.String(), allowedImgMIMETypes...) {
+			log.Printf("enc: bad image MIME type: %s", imgMIME.String())
+			ctx.JSON(http.StatusBadRequest, apiResponse{
+				Error: "Bad Image MIME type",
+			})
+			return
+		}
+
+		// The image is staged next to the original, and only swapped in
+		// once the row update has committed.
+		imgStaged, imgMeta, err = stageItemImage(
+			store, itemURI.ItemID, imgBuff,
+		)
+		if err != nil {
+			log.Printf("fs: failed to stage image: %v", err)
+			status, statusMsg = uploadErrorStatus(err)
+			ctx.JSON(status, apiResponse{Error: statusMsg})
+			return
+		}
+	}
+
+	if currLoc, err = time.LoadLocation("UTC"); err != nil {
+		log.Printf("enc: failed to load time-zone: %v", err)
+		ctx.JSON(http.StatusBadRequest, apiResponse{
+			Error: "Clock Error",
+		})
+		if len(imgStaged) > 0 {
+			store.Delete(itemURI.ItemID, imgStaged)
+		}
+		return
+	}
+
+	currUnix = time.Now().In(currLoc)
+	change.Staged, change.Meta = imgStaged, imgMeta
+
+	// An image-only update still bumps "updated_at".
+	image, err = inv.UpdateItem(
+		itemURI.ItemID, change, requestWrite(ctx, currUnix),
+	)
+	if err != nil {
+		respondInventoryError(ctx, err)
+		if len(imgStaged) > 0 {
+			store.Delete(itemURI.ItemID, imgStaged)
+		}
+		return
+	}
+
+	if len(imgStaged) > 0 {
+		mux.Lock(itemURI.ItemID)
+		err = publishItemImage(inv, store, image, imgStaged)
+		mux.Unlock(itemURI.ItemID)
+
+		if err != nil {
+			log.Printf("fs: failed to publish image: %v", err)
+			ctx.JSON(http.StatusInternalServerError, apiResponse{
+				Error: "Image Write Failed",
+			})
+			return
+		}
+	}
+
+	ctx.JSON(http.StatusOK, apiResponse{Data: itemURI})
+}
+
+func stockHandler(ctx *gin.Context) {
+	var (
+		itemURI  itemID
+		inv      InventoryStore
+		reqBody  apiRequestStockBody
+		result   stockResult
+		currUnix time.Time
+		currLoc  *time.Location
+		err      error
+	)
+
+	if inv, err = ensureInventoryMiddleware(ctx); err != nil {
+		log.Printf("route: inventory precondition failed: %v", err)
+		ctx.JSON(http.StatusInternalServerError, apiResponse{
+			Error: "Internal Server Error",
+		})
+		return
+	}
+
+	if err = ctx.ShouldBindUri(&itemURI); err != nil {
+		log.Printf("route: invalid URI: %v", err)
+		ctx.JSON(http.StatusBadRequest, apiResponse{
+			Error: "Invalid URI",
+		})
+		return
+	}
+
+	if err = ctx.ShouldBindJSON(&reqBody); err != nil {
+		log.Printf("route: malformed request: %v", err)
+		ctx.JSON(http.StatusBadRequest, apiResponse{
+			Error: "Malformed Request",
+		})
+		return
+	}
+
+	if len(reqBody.Reason) <= 0 {
+		reqBody.Reason = defaultStockReason
+	}
+
+	if currLoc, err = time.LoadLocation("UTC"); err != nil {
+		log.Printf("enc: failed to load time-zone: %v", err)
+		ctx.JSON(http.StatusBadRequest, apiResponse{
+			Error: "Clock Error",
+		})
+		return
+	}
+
+	currUnix = time.Now().In(currLoc)
+
+	result.ItemCount, err = inv.AdjustStock(
+		itemURI.ItemID, reqBody.Delta, reqBody.Reason,
+		requestWrite(ctx, currUnix),
+	)
+	if err != nil {
+		respondInventoryError(ctx, err)
+		return
+	}
+
+	result.ItemID = itemURI.ItemID
+	result.Delta = reqBody.Delta
+	result.Reason = reqBody.Reason
+
+	ctx.JSON(http.StatusOK, apiResponse{Data: result})
+}
+
+func historyHandler(ctx *gin.Context) {
+	var (
+		itemURI      itemID
+		inv          InventoryStore
+		rows         []stockMovement
+		historyQuery apiRequestHistoryQuery
+		cursor       uint64 = math.MaxInt64
+		page         apiResponsePage
+		err          error
+	)
+
+	if inv, err = ensureInventoryMiddleware(ctx); err != nil {
+		log.Printf("route: inventory precondition failed: %v", err)
+		ctx.JSON(http.StatusInternalServerError, apiResponse{
+			Error: "Internal Server Error",
+		})
+		return
+	}
+
+	if err = ctx.ShouldBindUri(&itemURI); err != nil {
+		log.Printf("route: invalid URI: %v", err)
+		ctx.JSON(http.StatusBadRequest, apiResponse{
+			Error: "Invalid URI",
+		})
+		return
+	}
+
+	if err = ctx.ShouldBindQuery(&historyQuery); err != nil {
+		log.Printf("route: query string parse failed: %v", err)
+		ctx.JSON(http.StatusBadRequest, apiResponse{
+			Error: "Malformed Request",
+		})
+		return
+	}
+
+	if len(historyQuery.Cursor) > 0 {
+		if cursor, err = decodeNumCursor(historyQuery.Cursor); err != nil {
+			log.Printf("route: bad cursor: %v", err)
+			ctx.JSON(http.StatusBadRequest, apiResponse{
+				Error: "Invalid Cursor",
+			})
+			return
+		}
+	}
+
+	// One extra row is fetched to find out if there is a next page.
+	rows, page.Total, err = inv.ListMovements(
+		itemURI.ItemID, cursor, historyQuery.Limit+1,
+	)
+	if err != nil {
+		log.Printf("db: query failed: %v", err)
+		ctx.JSON(http.StatusInternalServerError, apiResponse{
+			Error: "Database Query Failure",
+		})
+		return
+	}
+
+	page.Limit = historyQuery.Limit
+	if uint(len(rows)) > historyQuery.Limit {
+		rows = rows[:historyQuery.Limit]
+		page.NextCursor = encodeNumCursor(
+			uint64(rows[len(rows)-1].MovementID),
+		)
+	}
+
+	ctx.JSON(http.StatusOK, apiResponse{Data: rows, Page: &page})
+}
+
+func imgHandler(ctx *gin.Context) {
+	var (
+		imgURI    itemID
+		imgThumb  imgRequestGetQuery
+		spec      imgThumbSpec
+		image     imageRow
+		inv       InventoryStore
+		imgName   string
+		imgFormat string
+		preset    imgPreset
+		imgFile   io.ReadSeekCloser
+		imgInfo   imageInfo
+		ok        bool
+		store     ImageStore
+		mux       *itemLocker
+		locked    bool
+		err       error
+	)
+
+	if inv, err = ensureInventoryMiddleware(ctx); err != nil {
+		log.Printf("route: inventory precondition failed: %v", err)
+		ctx.Data(http.StatusInternalServerError, gin.MIMEPlain, nil)
+		return
+	}
+
+	if mux, err = ensureMuxMiddleware(ctx); err != nil {
+		log.Printf("route: mutex precondition failed: %v", err)
+		ctx.Data(http.StatusInternalServerError, gin.MIMEPlain, nil)
+		return
+	}
+
+	if store, err = ensureImgStoreMiddleware(ctx); err != nil {
+		log.Printf("route: image store precondition failed: %v", err)
+		ctx.Data(http.StatusInternalServerError, gin.MIMEPlain, nil)
+		return
+	}
+
+	if err = ctx.ShouldBindUri(&imgURI); err != nil {
+		log.Printf("route: invalid URI: %v", err)
+		ctx.JSON(http.StatusBadRequest, apiResponse{
+			Error: "Invalid URI",
+		})
+		return
+	}
+
+	if err = ctx.ShouldBindQuery(&imgThumb); err != nil {
+		log.Printf("route: query string parse failed: %v", err)
+		ctx.Data(http.StatusBadRequest, gin.MIMEPlain, nil)
+		return
+	}
+
+	if len(imgThumb.Preset) > 0 {
+		if preset, ok = imgPresets[imgThumb.Preset]; !ok {
+			log.Printf("route: unknown preset: %s", imgThumb.Preset)
+			ctx.Data(http.StatusBadRequest, gin.MIMEPlain, nil)
+			return
+		}
+
+		imgThumb.Height = uint16(preset.Height)
+		imgThumb.Width = uint16(preset.Width)
+		imgThumb.Mode = preset.Mode
+		imgThumb.Quality = preset.Quality
+	} else if imgPresetsOnly && !(imgThumb.Height == 0 && imgThumb.Width == 0) {
+		log.Printf("route: thumbnail sizes other than presets are disabled")
+		ctx.Data(http.StatusBadRequest, gin.MIMEPlain, nil)
+		return
+	}
+
+	// Hold the read lock until the image (or thumbnail) is open, so that
+	// it is not replaced half-way; once open, it can be served without it.
+	mux.RLock(imgURI.ItemID)
+	locked = true
+	defer func() {
+		if locked {
+			mux.RUnlock(imgURI.ItemID)
+		}
+	}()
+
+	// An image is addressed by its ID, or its index in the gallery of the
+	// item; the primary image is served otherwise.
+	switch {
+	case len(imgThumb.Image) > 0:
+		image, err = inv.GetImage(imgURI.ItemID, imgThumb.Image)
+	case imgThumb.Index != nil:
+		image, err = inv.GetImageAt(imgURI.ItemID, *imgThumb.Index)
+	default:
+		image, err = inv.GetPrimaryImage(imgURI.ItemID)
+	}
+	if err != nil {
+		if errors.Is(err, errNoSuchImage) {
+			log.Printf("route: image not found: %v", err)
+			ctx.Data(http.StatusNotFound, gin.MIMEPlain, nil)
+			return
+		}
+
+		log.Printf("db: failed to fetch image: %v", err)
+		ctx.Data(http.StatusInternalServerError, gin.MIMEPlain, nil)
+		return
+	}
+
+	// The format is recorded for images uploaded since metadata has been;
+	// older ones are sniffed.
+	if image.MIMEType != nil {
+		imgFormat, err = imageFormat(*image.MIMEType)
+	} else {
+		imgFormat, err = detectItemImage(
+			store, imgURI.ItemID, image.ImageName,
+		)
+	}
+	if err != nil {
+		if errors.Is(err, errImageNotFound) {
+			log.Printf("route: file not found: %v", err)
+			ctx.Data(http.StatusNotFound, gin.MIMEPlain, nil)
+			return
+		}
+
+		log.Printf("img: failed to detect image format: %v", err)
+		ctx.Data(http.StatusInternalServerError, gin.MIMEPlain, nil)
+		return
+	}
+
+	imgName = image.ImageName
+	if !(imgThumb.Height == 0 && imgThumb.Width == 0) {
+		// An explicit format wins over the "Accept" header.
+		if len(imgThumb.Format) > 0 {
+			imgFormat = imgThumb.Format
+		} else {
+			ctx.Header("Vary", "Accept")
+			imgFormat, ok = negotiateImageFormat(
+				ctx.GetHeader("Accept"), imgFormat,
 			)
-		default:
-			log.Printf(
-				"route: bad field type: %v",
-				errors.New("reflect failed for parsed value"),
+			if !ok {
+				log.Printf("route: no acceptable image format")
+				ctx.Data(http.StatusNotAcceptable, gin.MIMEPlain, nil)
+				return
+			}
+		}
+
+		spec = imgThumbSpec{
+			Image:   image.ImageName,
+			Height:  uint(imgThumb.Height),
+			Width:   uint(imgThumb.Width),
+			Mode:    imgThumb.Mode,
+			Format:  imgFormat,
+			Quality: imageQuality(imgFormat, imgThumb.Quality),
+		}
+
+		imgName, err = genImageThumb(spec, imgURI.ItemID, store)
+		if err != nil {
+			log.Printf("img: thumbnail generation failed: %v", err)
+			ctx.Data(
+				http.StatusInternalServerError,
+				gin.MIMEPlain, nil,
 			)
+			return
+		}
+	}
+
+	imgFile, imgInfo, err = store.Get(imgURI.ItemID, imgName)
+
+	// The thumbnail may have been evicted from the cache (by a request for
+	// another one) since it was generated; it is generated once more.
+	if errors.Is(err, errImageNotFound) && imgName != image.ImageName {
+		log.Printf("img: thumbnail evicted, regenerating: %s", imgName)
+
+		imgName, err = genImageThumb(spec, imgURI.ItemID, store)
+		if err != nil {
+			log.Printf("img: thumbnail generation failed: %v", err)
+			ctx.Data(http.StatusInternalServerError, gin.MIMEPlain, nil)
+			return
+		}
+
+		imgFile, imgInfo, err = store.Get(imgURI.ItemID, imgName)
+	}
+	if err != nil {
+		if errors.Is(err, errImageNotFound) {
+			log.Printf("route: file not found: %v", err)
+			ctx.Data(http.StatusNotFound, gin.MIMEPlain, nil)
+			return
+		}
+
+		log.Printf("img: failed to open image: %v", err)
+		ctx.Data(http.StatusInternalServerError, gin.MIMEPlain, nil)
+		return
+	}
+	defer imgFile.Close()
+
+	mux.RUnlock(imgURI.ItemID)
+	locked = false
+
+	http.ServeContent(ctx.Writer, ctx.Request, imgName, imgInfo.ModTime, imgFile)
+}
+
+func addImageHandler(ctx *gin.Context) {
+	var (
+		itemURI   itemID
+		inv       InventoryStore
+		mux       *itemLocker
+		store     ImageStore
+		reqBody   itemImage
+		image     imageRow
+		imgBuff   []byte
+		imgMIME   *mimetype.MIME
+		imgStaged string
+		imgMeta   imageMeta
+		status    int
+		statusMsg string
+		currUnix  time.Time
+		currLoc   *time.Location
+		err       error
+	)
+
+	if inv, err = ensureInventoryMiddleware(ctx); err != nil {
+		log.Printf("route: inventory precondition failed: %v", err)
+		ctx.JSON(http.StatusInternalServerError, apiResponse{
+			Error: "Internal Server Error",
+		})
+		return
+	}
+
+	if mux, err = ensureMuxMiddleware(ctx); err != nil {
+		log.Printf("route: mutex precondition failed: %v", err)
+		ctx.JSON(http.StatusInternalServerError, apiResponse{
+			Error: "Internal Server Error",
+		})
+		return
+	}
+
+	if store, err = ensureImgStoreMiddleware(ctx); err != nil {
+		log.Printf("route: image store precondition failed: %v", err)
+		ctx.JSON(http.StatusInternalServerError, apiResponse{
+			Error: "Internal Server Error",
+		})
+		return
+	}
+
+	if err = ctx.ShouldBindUri(&itemURI); err != nil {
+		log.Printf("route: invalid URI: %v", err)
+		ctx.JSON(http.StatusBadRequest, apiResponse{
+			Error: "Invalid URI",
+		})
+		return
+	}
+
+	if isMultipartRequest(ctx) {
+		imgStaged, imgMeta, err = bindMultipartUpload(
+			ctx, store, itemURI.ItemID, &struct{}{},
+		)
+		if err == nil && len(imgStaged) <= 0 {
+			err = &uploadError{errors.New("missing image")}
+		}
+		if err != nil {
+			log.Printf("route: bad multipart upload: %v", err)
+			status, statusMsg = uploadErrorStatus(err)
+			ctx.JSON(status, apiResponse{Error: statusMsg})
+			return
+		}
+	} else {
+		if err = ctx.ShouldBindJSON(&reqBody); err != nil {
+			log.Printf("route: malformed request: %v", err)
 			ctx.JSON(http.StatusBadRequest, apiResponse{
-				Error: "Bad Field Type",
+				Error: "Malformed Request",
 			})
-			dbTx.Rollback()
 			return
 		}
 
+		imgBuff, err = base64.StdEncoding.DecodeString(reqBody.ImgBase64)
 		if err != nil {
-			log.Printf("db: failed to update row: %v", err)
-			ctx.JSON(http.StatusInternalServerError, apiResponse{
-				Error: "Internal Server Error",
+			log.Printf("enc: bad base64 image upload: %v", err)
+			ctx.JSON(http.StatusBadRequest, apiResponse{
+				Error: "Bad Base64 Image Encoding",
 			})
-			dbTx.Rollback()
 			return
 		}
 
-		if err = dbTx.Commit(); err != nil {
-			log.Printf("db: failed to commit transaction: %v", err)
-			ctx.JSON(http.StatusInternalServerError, apiResponse{
-				Error: "Internal Server Error",
-			})
-			dbTx.Rollback()
-			return
-		}
+		imgMIME = mimetype.Detect(imgBuff)
+		if !mimetype.EqualsAny(imgMIME.String(), allowedImgMIMETypes...) {
+			log.Printf("enc: bad image MIME type: %s", imgMIME.String())
+			ctx.JSON(http.StatusBadRequest, apiResponse{
+				Error: "Bad Image MIME type",
+			})
+			return
+		}
+
+		imgStaged, imgMeta, err = stageItemImage(
+			store, itemURI.ItemID, imgBuff,
+		)
+		if err != nil {
+			log.Printf("fs: failed to stage image: %v", err)
+			status, statusMsg = uploadErrorStatus(err)
+			ctx.JSON(status, apiResponse{Error: statusMsg})
+			return
+		}
+	}
+
+	if currLoc, err = time.LoadLocation("UTC"); err != nil {
+		log.Printf("enc: failed to load time-zone: %v", err)
+		ctx.JSON(http.StatusBadRequest, apiResponse{
+			Error: "Clock Error",
+		})
+		store.Delete(itemURI.ItemID, imgStaged)
+		return
+	}
+
+	currUnix = time.Now().In(currLoc)
+
+	image, err = inv.AddImage(
+		itemURI.ItemID, imgStaged, imgMeta, requestWrite(ctx, currUnix),
+	)
+	if err != nil {
+		respondInventoryError(ctx, err)
+		store.Delete(itemURI.ItemID, imgStaged)
+		return
+	}
+
+	mux.Lock(itemURI.ItemID)
+	err = publishItemImage(inv, store, image, imgStaged)
+	mux.Unlock(itemURI.ItemID)
+
+	if err != nil {
+		log.Printf("fs: failed to publish image: %v", err)
+		ctx.JSON(http.StatusInternalServerError, apiResponse{
+			Error: "Image Write Failed",
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, apiResponse{Data: image})
+}
 
-		if tmp, err = dbRes.RowsAffected(); err != nil {
-			log.Printf("db: failed to fetch query result: %v", err)
-			ctx.JSON(http.StatusInternalServerError, apiResponse{
-				Error: "Internal Server Error",
-			})
-			return
-		}
+func listImagesHandler(ctx *gin.Context) {
+	var (
+		itemURI itemID
+		inv     InventoryStore
+		images  []imageRow
+		err     error
+	)
+
+	if inv, err = ensureInventoryMiddleware(ctx); err != nil {
+		log.Printf("route: inventory precondition failed: %v", err)
+		ctx.JSON(http.StatusInternalServerError, apiResponse{
+			Error: "Internal Server Error",
+		})
+		return
+	}
+
+	if err = ctx.ShouldBindUri(&itemURI); err != nil {
+		log.Printf("route: invalid URI: %v", err)
+		ctx.JSON(http.StatusBadRequest, apiResponse{
+			Error: "Invalid URI",
+		})
+		return
+	}
 
-		if tmp <= 0 {
+	if images, err = inv.ListImages(itemURI.ItemID); err != nil {
+		if errors.Is(err, errItemNotFound) {
 			ctx.JSON(http.StatusNotFound, apiResponse{
 				Error: "Item Not Found",
 			})
 			return
 		}
 
-		ctx.JSON(http.StatusCreated, apiResponse{Data: itemURI})
+		log.Printf("db: query failed: %v", err)
+		ctx.JSON(http.StatusInternalServerError, apiResponse{
+			Error: "Database Query Failure",
+		})
 		return
 	}
 
-	imgBuff, err = base64.StdEncoding.DecodeString(upValidator.ImageBase64)
-	if err != nil {
-		log.Printf("enc: bad base64 image upload: %v", err)
-		ctx.JSON(http.StatusBadRequest, apiResponse{
-			Error: "Bad Base64 Image Encoding",
+	ctx.JSON(http.StatusOK, apiResponse{Data: images})
+}
+
+func orderImagesHandler(ctx *gin.Context) {
+	var (
+		itemURI  itemID
+		inv      InventoryStore
+		reqBody  apiRequestImageOrderBody
+		images   []imageRow
+		currUnix time.Time
+		currLoc  *time.Location
+		err      error
+	)
+
+	if inv, err = ensureInventoryMiddleware(ctx); err != nil {
+		log.Printf("route: inventory precondition failed: %v", err)
+		ctx.JSON(http.StatusInternalServerError, apiResponse{
+			Error: "Internal Server Error",
 		})
 		return
 	}
 
-	imgMIME = mimetype.Detect(imgBuff)
-	if !mimetype.EqualsAny(imgMIME.String(), allowedImgMIMETypes...) {
-		log.Printf("enc: bad base64 image upload: %v", err)
+	if err = ctx.ShouldBindUri(&itemURI); err != nil {
+		log.Printf("route: invalid URI: %v", err)
 		ctx.JSON(http.StatusBadRequest, apiResponse{
-			Error: "Bad Image MIME type",
+			Error: "Invalid URI",
 		})
 		return
 	}
 
-	mux.Lock()
-	imgDir = path.Join(imageRootDir, itemURI.ItemID)
-	if _, err = os.Stat(imgDir); err == nil {
-		if err = os.RemoveAll(imgDir); err != nil {
-			log.Printf("fs: failed to delete directory: %v", err)
-			ctx.JSON(http.StatusInternalServerError, apiResponse{
-				Error: "Image Update Failed",
-			})
-			mux.Unlock()
-			return
-		}
+	if err = ctx.ShouldBindJSON(&reqBody); err != nil {
+		log.Printf("route: malformed request: %v", err)
+		ctx.JSON(http.StatusBadRequest, apiResponse{
+			Error: "Malformed Request",
+		})
+		return
+	}
 
-		if err = os.MkdirAll(imgDir, os.ModePerm); err != nil {
-			log.Printf("fs: failed to create directory: %v", err)
-			ctx.JSON(http.StatusInternalServerError, apiResponse{
-				Error: "Image Write Failed",
-			})
-			mux.Unlock()
-			return
-		}
+	if currLoc, err = time.LoadLocation("UTC"); err != nil {
+		log.Printf("enc: failed to load time-zone: %v", err)
+		ctx.JSON(http.StatusBadRequest, apiResponse{
+			Error: "Clock Error",
+		})
+		return
 	}
 
-	imgFile, err = os.Create(path.Join(imgDir, "original"))
+	currUnix = time.Now().In(currLoc)
+
+	images, err = inv.OrderImages(
+		itemURI.ItemID, reqBody.ImageIDs, requestWrite(ctx, currUnix),
+	)
 	if err != nil {
-		log.Printf("fs: failed to open file: %v", err)
+		respondInventoryError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, apiResponse{Data: images})
+}
+
+func primaryImageHandler(ctx *gin.Context) {
+	var (
+		imgURI   imageID
+		inv      InventoryStore
+		image    imageRow
+		currUnix time.Time
+		currLoc  *time.Location
+		err      error
+	)
+
+	if inv, err = ensureInventoryMiddleware(ctx); err != nil {
+		log.Printf("route: inventory precondition failed: %v", err)
 		ctx.JSON(http.StatusInternalServerError, apiResponse{
-			Error: "Image Write Failed",
+			Error: "Internal Server Error",
 		})
-		mux.Unlock()
 		return
 	}
-	defer imgFile.Close()
 
-	if _, err = imgFile.Write(imgBuff); err != nil {
-		log.Printf("fs: failed to write image: %v", err)
-		ctx.JSON(http.StatusInternalServerError, apiResponse{
-			Error: "Image Write Failed",
+	if err = ctx.ShouldBindUri(&imgURI); err != nil {
+		log.Printf("route: invalid URI: %v", err)
+		ctx.JSON(http.StatusBadRequest, apiResponse{
+			Error: "Invalid URI",
 		})
-		mux.Unlock()
 		return
 	}
-	mux.Unlock()
 
-	ctx.JSON(http.StatusCreated, apiResponse{Data: itemURI})
+	if currLoc, err = time.LoadLocation("UTC"); err != nil {
+		log.Printf("enc: failed to load time-zone: %v", err)
+		ctx.JSON(http.StatusBadRequest, apiResponse{
+			Error: "Clock Error",
+		})
+		return
+	}
+
+	currUnix = time.Now().In(currLoc)
+
+	image, err = inv.SetPrimaryImage(
+		imgURI.ItemID, imgURI.ImageID, requestWrite(ctx, currUnix),
+	)
+	if err != nil {
+		respondInventoryError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, apiResponse{Data: image})
 }
 
-func imgHandler(ctx *gin.Context) {
+func deleteImageHandler(ctx *gin.Context) {
 	var (
-		imgURI   itemID
-		imgDir   string
-		imgThumb imgRequestGetQuery
-		imgPath  string
+		imgURI   imageID
+		inv      InventoryStore
+		mux      *itemLocker
+		store    ImageStore
+		image    imageRow
+		currUnix time.Time
+		currLoc  *time.Location
 		err      error
 	)
 
+	if inv, err = ensureInventoryMiddleware(ctx); err != nil {
+		log.Printf("route: inventory precondition failed: %v", err)
+		ctx.JSON(http.StatusInternalServerError, apiResponse{
+			Error: "Internal Server Error",
+		})
+		return
+	}
+
+	if mux, err = ensureMuxMiddleware(ctx); err != nil {
+		log.Printf("route: mutex precondition failed: %v", err)
+		ctx.JSON(http.StatusInternalServerError, apiResponse{
+			Error: "Internal Server Error",
+		})
+		return
+	}
+
+	if store, err = ensureImgStoreMiddleware(ctx); err != nil {
+		log.Printf("route: image store precondition failed: %v", err)
+		ctx.JSON(http.StatusInternalServerError, apiResponse{
+			Error: "Internal Server Error",
+		})
+		return
+	}
+
 	if err = ctx.ShouldBindUri(&imgURI); err != nil {
 		log.Printf("route: invalid URI: %v", err)
 		ctx.JSON(http.StatusBadRequest, apiResponse{
@@ -578,52 +1636,49 @@ func imgHandler(ctx *gin.Context) {
 		return
 	}
 
-	if err = ctx.ShouldBindQuery(&imgThumb); err != nil {
-		log.Printf("route: query string parse failed: %v", err)
-		ctx.Data(http.StatusBadRequest, gin.MIMEPlain, nil)
+	if currLoc, err = time.LoadLocation("UTC"); err != nil {
+		log.Printf("enc: failed to load time-zone: %v", err)
+		ctx.JSON(http.StatusBadRequest, apiResponse{
+			Error: "Clock Error",
+		})
 		return
 	}
 
-	imgDir = path.Join(imageRootDir, imgURI.ItemID)
-	if _, err = os.Stat(imgDir); errors.Is(err, os.ErrNotExist) {
-		log.Printf("route: file not found: %v", err)
-		ctx.Data(http.StatusNotFound, gin.MIMEPlain, nil)
+	currUnix = time.Now().In(currLoc)
+
+	image, err = inv.DeleteImage(
+		imgURI.ItemID, imgURI.ImageID, requestWrite(ctx, currUnix),
+	)
+	if err != nil {
+		respondInventoryError(ctx, err)
 		return
 	}
 
-	imgPath = path.Join(imgDir, "original")
-	if !(imgThumb.Height == 0 && imgThumb.Width == 0) {
-		imgPath, err = genImageThumb(
-			uint(imgThumb.Height), uint(imgThumb.Width), imgDir,
-		)
-		if err != nil {
-			log.Printf("img: thumbnail generation failed: %v", err)
-			ctx.Data(
-				http.StatusInternalServerError,
-				gin.MIMEPlain, nil,
-			)
-			return
-		}
+	mux.Lock(imgURI.ItemID)
+	err = deleteItemImage(store, imgURI.ItemID, image.ImageName)
+	mux.Unlock(imgURI.ItemID)
+
+	if err != nil {
+		log.Printf("fs: failed to delete image: %v", err)
 	}
 
-	ctx.File(imgPath)
+	ctx.JSON(http.StatusOK, apiResponse{Data: imgURI})
 }
 
 func deleteHandler(ctx *gin.Context) {
 	var (
-		dbConn  *sqlx.DB
-		dbTx    *sql.Tx
-		dbRes   sql.Result
-		dbQuery string
-		mux     *sync.Mutex
-		itemURI itemID
-		imgDir  string
-		err     error
-		tmp     int64
+		inv      InventoryStore
+		mux      *itemLocker
+		itemURI  itemID
+		delQuery apiRequestDeleteQuery
+		store    ImageStore
+		err      error
+		currUnix time.Time
+		currLoc  *time.Location
 	)
 
-	if dbConn, err = ensureDbMiddleware(ctx); err != nil {
-		log.Printf("route: database precondition failed: %v", err)
+	if inv, err = ensureInventoryMiddleware(ctx); err != nil {
+		log.Printf("route: inventory precondition failed: %v", err)
 		ctx.JSON(http.StatusInternalServerError, apiResponse{
 			Error: "Internal Server Error",
 		})
@@ -638,6 +1693,14 @@ func deleteHandler(ctx *gin.Context) {
 		return
 	}
 
+	if store, err = ensureImgStoreMiddleware(ctx); err != nil {
+		log.Printf("route: image store precondition failed: %v", err)
+		ctx.JSON(http.StatusInternalServerError, apiResponse{
+			Error: "Internal Server Error",
+		})
+		return
+	}
+
 	if err = ctx.ShouldBindUri(&itemURI); err != nil {
 		log.Printf("route: invalid URI: %v", err)
 		ctx.JSON(http.StatusBadRequest, apiResponse{
@@ -646,60 +1709,182 @@ func deleteHandler(ctx *gin.Context) {
 		return
 	}
 
-	if dbTx, err = dbConn.Begin(); err != nil {
-		log.Printf("db: failed to acquire lock: %v", err)
-		ctx.JSON(http.StatusInternalServerError, apiResponse{
-			Error: "Internal Server Error",
+	if err = ctx.ShouldBindQuery(&delQuery); err != nil {
+		log.Printf("route: query string parse failed: %v", err)
+		ctx.JSON(http.StatusBadRequest, apiResponse{
+			Error: "Malformed Request",
+		})
+		return
+	}
+
+	if currLoc, err = time.LoadLocation("UTC"); err != nil {
+		log.Printf("enc: failed to load time-zone: %v", err)
+		ctx.JSON(http.StatusBadRequest, apiResponse{
+			Error: "Clock Error",
 		})
 		return
 	}
 
-	dbQuery = fmt.Sprintf(queryDeleteItem, dbTable)
-	dbRes, err = dbConn.Exec(dbQuery, itemURI.ItemID)
+	currUnix = time.Now().In(currLoc)
+
+	// Items are moved to the trash, unless they are to be purged right
+	// away; trashed items are purged in the background after a while.
+	if delQuery.Purge {
+		err = inv.DeleteItem(itemURI.ItemID, requestWrite(ctx, currUnix))
+	} else {
+		err = inv.TrashItem(itemURI.ItemID, requestWrite(ctx, currUnix))
+	}
 	if err != nil {
-		log.Printf("db: failed to delete row: %v", err)
+		respondInventoryError(ctx, err)
+		return
+	}
+
+	if !delQuery.Purge {
+		ctx.JSON(http.StatusOK, apiResponse{Data: "OK"})
+		return
+	}
+
+	mux.Lock(itemURI.ItemID)
+	if err = store.DeleteAll(itemURI.ItemID); err != nil {
+		log.Printf("fs: failed to delete images: %v", err)
 		ctx.JSON(http.StatusInternalServerError, apiResponse{
-			Error: "Internal Server Error",
+			Error: "Image Delete Failed",
 		})
+		mux.Unlock(itemURI.ItemID)
 		return
 	}
+	mux.Unlock(itemURI.ItemID)
+
+	ctx.JSON(http.StatusOK, apiResponse{Data: "OK"})
+}
+
+func cacheHandler(ctx *gin.Context) {
+	var (
+		store ImageStore
+		cache *thumbCache
+		ok    bool
+		err   error
+	)
 
-	if tmp, err = dbRes.RowsAffected(); err != nil {
-		log.Printf("db: failed to fetch query result: %v", err)
+	if store, err = ensureImgStoreMiddleware(ctx); err != nil {
+		log.Printf("route: image store precondition failed: %v", err)
 		ctx.JSON(http.StatusInternalServerError, apiResponse{
 			Error: "Internal Server Error",
 		})
 		return
 	}
 
-	if tmp <= 0 {
+	if cache, ok = store.(*thumbCache); !ok {
+		log.Printf("route: thumbnail cache is not enabled")
 		ctx.JSON(http.StatusNotFound, apiResponse{
-			Error: "Item Not Found",
+			Error: "Thumbnail Cache Not Enabled",
 		})
 		return
 	}
 
-	if err = dbTx.Commit(); err != nil {
-		log.Printf("db: failed to commit transaction: %v", err)
+	ctx.JSON(http.StatusOK, apiResponse{Data: cache.Stats()})
+}
+
+func trashHandler(ctx *gin.Context) {
+	var (
+		inv        InventoryStore
+		rows       []inventoryRow
+		trashQuery apiRequestTrashQuery
+		cur        *listCursor
+		tmp        listCursor
+		page       apiResponsePage
+		err        error
+	)
+
+	if inv, err = ensureInventoryMiddleware(ctx); err != nil {
+		log.Printf("route: inventory precondition failed: %v", err)
 		ctx.JSON(http.StatusInternalServerError, apiResponse{
 			Error: "Internal Server Error",
 		})
 		return
 	}
 
-	mux.Lock()
-	imgDir = path.Join(imageRootDir, itemURI.ItemID)
-	if _, err = os.Stat(imgDir); err == nil {
-		if err = os.RemoveAll(imgDir); err != nil {
-			log.Printf("fs: failed to delete directory: %v", err)
-			ctx.JSON(http.StatusInternalServerError, apiResponse{
-				Error: "Image Delete Failed",
+	if err = ctx.ShouldBindQuery(&trashQuery); err != nil {
+		log.Printf("route: query string parse failed: %v", err)
+		ctx.JSON(http.StatusBadRequest, apiResponse{
+			Error: "Malformed Request",
+		})
+		return
+	}
+
+	if len(trashQuery.Cursor) > 0 {
+		if tmp, err = decodeListCursor(trashQuery.Cursor); err != nil {
+			log.Printf("route: bad cursor: %v", err)
+			ctx.JSON(http.StatusBadRequest, apiResponse{
+				Error: "Invalid Cursor",
 			})
-			mux.Unlock()
 			return
 		}
+		cur = &tmp
 	}
-	mux.Unlock()
 
-	ctx.JSON(http.StatusOK, apiResponse{Data: "OK"})
+	// One extra row is fetched to find out if there is a next page.
+	rows, page.Total, err = inv.ListTrash(cur, trashQuery.Limit+1)
+	if err != nil {
+		log.Printf("db: query failed: %v", err)
+		ctx.JSON(http.StatusInternalServerError, apiResponse{
+			Error: "Database Query Failure",
+		})
+		return
+	}
+
+	page.Limit = trashQuery.Limit
+	if uint(len(rows)) > trashQuery.Limit {
+		rows = rows[:trashQuery.Limit]
+		page.NextCursor = encodeListCursor(listCursor{
+			At: *rows[len(rows)-1].DeletedAt,
+			ID: rows[len(rows)-1].ItemID,
+		})
+	}
+
+	ctx.JSON(http.StatusOK, apiResponse{Data: rows, Page: &page})
+}
+
+func restoreHandler(ctx *gin.Context) {
+	var (
+		inv      InventoryStore
+		itemURI  itemID
+		currUnix time.Time
+		currLoc  *time.Location
+		err      error
+	)
+
+	if inv, err = ensureInventoryMiddleware(ctx); err != nil {
+		log.Printf("route: inventory precondition failed: %v", err)
+		ctx.JSON(http.StatusInternalServerError, apiResponse{
+			Error: "Internal Server Error",
+		})
+		return
+	}
+
+	if err = ctx.ShouldBindUri(&itemURI); err != nil {
+		log.Printf("route: invalid URI: %v", err)
+		ctx.JSON(http.StatusBadRequest, apiResponse{
+			Error: "Invalid URI",
+		})
+		return
+	}
+
+	if currLoc, err = time.LoadLocation("UTC"); err != nil {
+		log.Printf("enc: failed to load time-zone: %v", err)
+		ctx.JSON(http.StatusBadRequest, apiResponse{
+			Error: "Clock Error",
+		})
+		return
+	}
+
+	currUnix = time.Now().In(currLoc)
+
+	err = inv.RestoreItem(itemURI.ItemID, requestWrite(ctx, currUnix))
+	if err != nil {
+		respondInventoryError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, apiResponse{Data: itemURI})
 }
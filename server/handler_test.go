@@ -0,0 +1,713 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A server on an in-memory inventory, and images in a temporary directory.
+type testServer struct {
+	inv    *memInventoryStore
+	router *gin.Engine
+}
+
+// What the API responds with, with "data" left to be decoded.
+type testResponse struct {
+	Data  json.RawMessage  `json:"data"`
+	Error interface{}      `json:"error"`
+	Page  *apiResponsePage `json:"page"`
+}
+
+func newTestServer(t *testing.T) *testServer {
+	var (
+		store *localImageStore
+		err   error
+	)
+
+	if store, err = newLocalImageStore(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	return newTestServerOn(t, newThumbCache(store, 0))
+}
+
+func newTestServerOn(t *testing.T, store ImageStore) *testServer {
+	var srv testServer
+
+	gin.SetMode(gin.TestMode)
+
+	if err := registerPriceBinding(); err != nil {
+		t.Fatal(err)
+	}
+
+	srv.inv = newMemInventoryStore()
+	srv.router = newRouter(srv.inv, newItemLocker(), store)
+
+	return &srv
+}
+
+// Sends a request with a JSON body (unless it is nil), and decodes the
+// response.
+func (srv *testServer) do(t *testing.T, method, url string, body interface{},
+	header http.Header) (*httptest.ResponseRecorder, testResponse) {
+
+	var (
+		rec  = httptest.NewRecorder()
+		buf  bytes.Buffer
+		req  *http.Request
+		resp testResponse
+	)
+
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req = httptest.NewRequest(method, url, &buf)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for key := range header {
+		req.Header.Set(key, header.Get(key))
+	}
+
+	srv.router.ServeHTTP(rec, req)
+
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%s %s: bad response %q: %v", method, url, rec.Body, err)
+	}
+
+	return rec, resp
+}
+
+func testImageBase64(t *testing.T) string {
+	var (
+		img = image.NewRGBA(image.Rect(0, 0, 4, 4))
+		buf bytes.Buffer
+	)
+
+	for x := 0; x < 4; x++ {
+		for y := 0; y < 4; y++ {
+			img.Set(x, y, color.RGBA{R: 0xff, A: 0xff})
+		}
+	}
+
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+// Adds an item through the API, and returns its ID.
+func (srv *testServer) addItem(t *testing.T, name, price string) string {
+	var (
+		rec  *httptest.ResponseRecorder
+		resp testResponse
+		id   itemID
+	)
+
+	rec, resp = srv.do(t, http.MethodPost, "/api/add", map[string]interface{}{
+		"item_count":   3,
+		"item_price":   price,
+		"item_brand":   "Brand",
+		"item_name":    name,
+		"item_desc":    "A thing.",
+		"image_base64": testImageBase64(t),
+	}, nil)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("add: got %d (%v), want %d", rec.Code, resp.Error,
+			http.StatusCreated)
+	}
+
+	if err := json.Unmarshal(resp.Data, &id); err != nil {
+		t.Fatal(err)
+	}
+
+	return id.ItemID
+}
+
+func (srv *testServer) getItem(t *testing.T,
+	itemID string) (*httptest.ResponseRecorder, inventoryRow) {
+
+	var (
+		rec  *httptest.ResponseRecorder
+		resp testResponse
+		item inventoryRow
+	)
+
+	rec, resp = srv.do(t, http.MethodGet, "/api/get/"+itemID, nil, nil)
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(resp.Data, &item); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return rec, item
+}
+
+func TestAddHandler(t *testing.T) {
+	var (
+		srv    = newTestServer(t)
+		itemID = srv.addItem(t, "Pixels", "19.99")
+		rec    *httptest.ResponseRecorder
+		resp   testResponse
+		item   inventoryRow
+	)
+
+	if rec, item = srv.getItem(t, itemID); rec.Code != http.StatusOK {
+		t.Fatalf("get: got %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	if item.ItemName != "Pixels" || item.ItemCount != 3 ||
+		item.ItemPrice.String() != "19.99" ||
+		item.ItemCurrency != defaultCurrency || item.Image == nil {
+		t.Fatalf("got item %+v", item)
+	}
+
+	if !strings.Contains(rec.Body.String(), `"item_price":19.99,`) {
+		t.Fatalf("price is not exact: %s", rec.Body)
+	}
+
+	for _, body := range []map[string]interface{}{
+		// No price.
+		{
+			"item_count": 1, "item_brand": "b", "item_name": "n",
+			"item_desc": "d", "image_base64": testImageBase64(t),
+		},
+		// No image.
+		{
+			"item_count": 1, "item_price": 1, "item_brand": "b",
+			"item_name": "n", "item_desc": "d",
+		},
+		// A fraction of a yen.
+		{
+			"item_count": 1, "item_price": "1.5", "item_currency": "JPY",
+			"item_brand": "b", "item_name": "n", "item_desc": "d",
+			"image_base64": testImageBase64(t),
+		},
+	} {
+		rec, resp = srv.do(t, http.MethodPost, "/api/add", body, nil)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("add %v: got %d (%v), want %d", body, rec.Code,
+				resp.Error, http.StatusBadRequest)
+		}
+	}
+
+	// Currency codes are not case sensitive.
+	rec, resp = srv.do(t, http.MethodPost, "/api/add", map[string]interface{}{
+		"item_count": 1, "item_price": "1.5", "item_currency": "gbp",
+		"item_brand": "b", "item_name": "n", "item_desc": "d",
+		"image_base64": testImageBase64(t),
+	}, nil)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("add: got %d (%v), want %d", rec.Code, resp.Error,
+			http.StatusCreated)
+	}
+}
+
+func TestUpdateHandler(t *testing.T) {
+	var (
+		srv    = newTestServer(t)
+		itemID = srv.addItem(t, "Pixels", "19.99")
+		rec    *httptest.ResponseRecorder
+		resp   testResponse
+		item   inventoryRow
+	)
+
+	rec, resp = srv.do(
+		t, http.MethodPut, "/api/update/"+itemID+"?update_field=item_name",
+		map[string]interface{}{"item_name": "Voxels"}, nil,
+	)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("update: got %d (%v), want %d", rec.Code, resp.Error,
+			http.StatusCreated)
+	}
+
+	if _, item = srv.getItem(t, itemID); item.ItemName != "Voxels" ||
+		item.Version != 2 {
+		t.Fatalf("got item %+v", item)
+	}
+
+	// The price (19.99) has cents, which yen do not.
+	rec, _ = srv.do(
+		t, http.MethodPut,
+		"/api/update/"+itemID+"?update_field=item_currency",
+		map[string]interface{}{"item_currency": "JPY"}, nil,
+	)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("update: got %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	rec, _ = srv.do(
+		t, http.MethodPut, "/api/update/nosuchid?update_field=item_name",
+		map[string]interface{}{"item_name": "Voxels"}, nil,
+	)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("update: got %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestPatchHandler(t *testing.T) {
+	var (
+		srv    = newTestServer(t)
+		itemID = srv.addItem(t, "Pixels", "19.99")
+		rec    *httptest.ResponseRecorder
+		resp   testResponse
+		item   inventoryRow
+		change = map[string]interface{}{
+			"item_count":    12,
+			"item_price":    39.5,
+			"item_currency": "eur",
+			"item_desc":     "Another thing.",
+		}
+	)
+
+	rec, _ = srv.do(t, http.MethodPatch, "/api/items/"+itemID, change,
+		http.Header{"If-Match": {itemETag(2)}})
+	if rec.Code != http.StatusPreconditionFailed {
+		t.Fatalf("patch: got %d, want %d", rec.Code,
+			http.StatusPreconditionFailed)
+	}
+
+	rec, resp = srv.do(t, http.MethodPatch, "/api/items/"+itemID, change,
+		http.Header{"If-Match": {itemETag(1)}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("patch: got %d (%v), want %d", rec.Code, resp.Error,
+			http.StatusOK)
+	}
+
+	_, item = srv.getItem(t, itemID)
+	if item.ItemCount != 12 || item.ItemPrice.String() != "39.5" ||
+		item.ItemCurrency != "EUR" || item.ItemDesc != "Another thing." ||
+		item.ItemName != "Pixels" || item.Version != 2 {
+		t.Fatalf("got item %+v", item)
+	}
+
+	rec, _ = srv.do(t, http.MethodPatch, "/api/items/"+itemID,
+		map[string]interface{}{}, nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("patch: got %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestDeleteHandler(t *testing.T) {
+	var (
+		srv    = newTestServer(t)
+		itemID = srv.addItem(t, "Pixels", "19.99")
+		rec    *httptest.ResponseRecorder
+		img    *httptest.ResponseRecorder
+		resp   testResponse
+		trash  []inventoryRow
+	)
+
+	rec, resp = srv.do(t, http.MethodDelete, "/api/delete/"+itemID, nil, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("delete: got %d (%v), want %d", rec.Code, resp.Error,
+			http.StatusOK)
+	}
+
+	if rec, _ = srv.getItem(t, itemID); rec.Code != http.StatusNotFound {
+		t.Fatalf("get: got %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	_, resp = srv.do(t, http.MethodGet, "/api/trash", nil, nil)
+	if err := json.Unmarshal(resp.Data, &trash); err != nil {
+		t.Fatal(err)
+	}
+	if len(trash) != 1 || trash[0].ItemID != itemID {
+		t.Fatalf("got trash %+v", trash)
+	}
+
+	// The images of trashed items are not served either.
+	img = httptest.NewRecorder()
+	srv.router.ServeHTTP(img, httptest.NewRequest(
+		http.MethodGet, "/img/"+itemID, nil,
+	))
+	if img.Code != http.StatusNotFound {
+		t.Fatalf("img: got %d, want %d", img.Code, http.StatusNotFound)
+	}
+
+	// Trashing the item bumped its version.
+	rec, _ = srv.do(
+		t, http.MethodDelete, "/api/delete/"+itemID+"?purge=true", nil,
+		http.Header{"If-Match": {itemETag(1)}},
+	)
+	if rec.Code != http.StatusPreconditionFailed {
+		t.Fatalf("purge: got %d, want %d", rec.Code,
+			http.StatusPreconditionFailed)
+	}
+
+	rec, _ = srv.do(
+		t, http.MethodDelete, "/api/delete/"+itemID+"?purge=true", nil,
+		http.Header{"If-Match": {itemETag(2)}},
+	)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("purge: got %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	rec, _ = srv.do(t, http.MethodDelete, "/api/delete/"+itemID, nil, nil)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("delete: got %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestListHandler(t *testing.T) {
+	var (
+		srv   = newTestServer(t)
+		ids   = make(map[string]bool)
+		seen  = make(map[string]bool)
+		url   = "/api/list?limit=2&order=asc"
+		rec   *httptest.ResponseRecorder
+		resp  testResponse
+		items []inventoryRow
+	)
+
+	for _, price := range []string{"5", "10.25", "20"} {
+		ids[srv.addItem(t, "Item "+price, price)] = true
+	}
+
+	for pages := 0; ; pages++ {
+		if pages > len(ids) {
+			t.Fatal("list: too many pages")
+		}
+
+		rec, resp = srv.do(t, http.MethodGet, url, nil, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("list: got %d (%v), want %d", rec.Code, resp.Error,
+				http.StatusOK)
+		}
+
+		if err := json.Unmarshal(resp.Data, &items); err != nil {
+			t.Fatal(err)
+		}
+		if len(items) > 2 || resp.Page == nil ||
+			resp.Page.Total != int64(len(ids)) {
+			t.Fatalf("list: got %d items, page %+v", len(items), resp.Page)
+		}
+
+		for _, item := range items {
+			if !ids[item.ItemID] || seen[item.ItemID] {
+				t.Fatalf("list: unexpected item %s", item.ItemID)
+			}
+			seen[item.ItemID] = true
+		}
+
+		if len(resp.Page.NextCursor) <= 0 {
+			break
+		}
+		url = "/api/list?limit=2&order=asc&cursor=" + resp.Page.NextCursor
+	}
+
+	if len(seen) != len(ids) {
+		t.Fatalf("list: got %d items, want %d", len(seen), len(ids))
+	}
+
+	_, resp = srv.do(
+		t, http.MethodGet, "/api/list?min_price=10&max_price=10.25", nil,
+		nil,
+	)
+	if err := json.Unmarshal(resp.Data, &items); err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].ItemPrice.String() != "10.25" {
+		t.Fatalf("list: got %+v", items)
+	}
+
+	rec, _ = srv.do(t, http.MethodGet, "/api/list?min_price=abc", nil, nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("list: got %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+// An image store that loses the thumbnails that have not been read yet, as
+// if another request got them evicted from the cache.
+type evictingImageStore struct {
+	ImageStore
+	evicted map[string]bool
+}
+
+func (s *evictingImageStore) Get(itemID,
+	name string) (io.ReadSeekCloser, imageInfo, error) {
+
+	if isThumbName(name) && !s.evicted[name] {
+		s.evicted[name] = true
+		s.ImageStore.Delete(itemID, name)
+	}
+
+	return s.ImageStore.Get(itemID, name)
+}
+
+func TestImgHandlerRegeneratesEvictedThumb(t *testing.T) {
+	var (
+		store *localImageStore
+		srv   *testServer
+		rec   = httptest.NewRecorder()
+		err   error
+	)
+
+	if store, err = newLocalImageStore(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	srv = newTestServerOn(t, &evictingImageStore{
+		ImageStore: store,
+		evicted:    make(map[string]bool),
+	})
+
+	srv.router.ServeHTTP(rec, httptest.NewRequest(
+		http.MethodGet, "/img/"+srv.addItem(t, "Item", "1")+"?w=2&fmt=png",
+		nil,
+	))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("img: got %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	if _, err = png.Decode(rec.Body); err != nil {
+		t.Fatalf("img: bad thumbnail: %v", err)
+	}
+}
+
+func TestImgHandlerCountsCacheHits(t *testing.T) {
+	var (
+		srv   = newTestServer(t)
+		url   = "/img/" + srv.addItem(t, "Item", "1") + "?w=2&fmt=png"
+		rec   *httptest.ResponseRecorder
+		resp  testResponse
+		stats thumbCacheStats
+	)
+
+	for i := 0; i < 3; i++ {
+		rec = httptest.NewRecorder()
+		srv.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("img: got %d, want %d", rec.Code, http.StatusOK)
+		}
+	}
+
+	_, resp = srv.do(t, http.MethodGet, "/api/cache", nil, nil)
+	if err := json.Unmarshal(resp.Data, &stats); err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Misses != 1 || stats.Hits != 2 {
+		t.Fatalf("cache: got %d misses and %d hits, want 1 and 2",
+			stats.Misses, stats.Hits)
+	}
+}
+
+func TestImgHandlerScalesToHeight(t *testing.T) {
+	var (
+		srv    = newTestServer(t)
+		itemID = srv.addItem(t, "Item", "1")
+		rec    *httptest.ResponseRecorder
+		img    image.Image
+		err    error
+	)
+
+	// The test image is 4x4, so every mode should give a 2x2 thumbnail.
+	for _, mode := range imgModes {
+		rec = httptest.NewRecorder()
+		srv.router.ServeHTTP(rec, httptest.NewRequest(
+			http.MethodGet, "/img/"+itemID+"?h=2&fmt=png&mode="+mode, nil,
+		))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("img (%s): got %d, want %d", mode, rec.Code,
+				http.StatusOK)
+		}
+
+		if img, err = png.Decode(rec.Body); err != nil {
+			t.Fatalf("img (%s): bad thumbnail: %v", mode, err)
+		}
+
+		if size := img.Bounds().Size(); size != image.Pt(2, 2) {
+			t.Errorf("img (%s): got %v, want (2,2)", mode, size)
+		}
+	}
+}
+
+func TestSearchHandlerEscapesHighlights(t *testing.T) {
+	var (
+		srv  = newTestServer(t)
+		rec  *httptest.ResponseRecorder
+		resp testResponse
+		rows []searchRow
+	)
+
+	srv.addItem(t, `Tom & <b onclick="x">Jerry</b>`, "1")
+
+	rec, resp = srv.do(t, http.MethodGet, "/api/search?q=jerry", nil, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("search: got %d (%v), want %d", rec.Code, resp.Error,
+			http.StatusOK)
+	}
+
+	if err := json.Unmarshal(resp.Data, &rows); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "Tom &amp; &lt;b onclick=&#34;x&#34;&gt;" +
+		"<mark>Jerry</mark>&lt;/b&gt;"
+	if len(rows) != 1 || rows[0].NameHl != want {
+		t.Fatalf("search: got %+v, want a highlight of %q", rows, want)
+	}
+}
+
+func TestStockHandler(t *testing.T) {
+	var (
+		srv  = newTestServer(t)
+		id   = srv.addItem(t, "Item", "1")
+		url  = "/api/items/" + id + "/stock"
+		rec  *httptest.ResponseRecorder
+		resp testResponse
+		item inventoryRow
+	)
+
+	rec, resp = srv.do(t, http.MethodPost, url, map[string]interface{}{
+		"delta": -2, "reason": "sale",
+	}, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("stock: got %d (%v), want %d", rec.Code, resp.Error,
+			http.StatusOK)
+	}
+
+	if _, item = srv.getItem(t, id); item.ItemCount != 1 {
+		t.Fatalf("stock: got count %d, want 1", item.ItemCount)
+	}
+
+	rec, _ = srv.do(t, http.MethodPost, url, map[string]interface{}{
+		"delta": 1,
+	}, http.Header{"If-Match": {itemETag(1)}})
+	if rec.Code != http.StatusPreconditionFailed {
+		t.Fatalf("stock: got %d, want %d", rec.Code,
+			http.StatusPreconditionFailed)
+	}
+
+	for _, delta := range []int64{1 << 31, -(1 << 31) - 1} {
+		rec, _ = srv.do(t, http.MethodPost, url, map[string]interface{}{
+			"delta": delta,
+		}, nil)
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("stock %d: got %d, want %d", delta, rec.Code,
+				http.StatusBadRequest)
+		}
+	}
+
+	// The count (of 1) would not fit in its column.
+	rec, _ = srv.do(t, http.MethodPost, url, map[string]interface{}{
+		"delta": maxItemCount,
+	}, nil)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("stock: got %d, want %d", rec.Code, http.StatusConflict)
+	}
+
+	if _, item = srv.getItem(t, id); item.ItemCount != 1 {
+		t.Fatalf("stock: got count %d, want 1", item.ItemCount)
+	}
+
+	rec, _ = srv.do(t, http.MethodPatch, "/api/items/"+id,
+		map[string]interface{}{"item_count": maxItemCount + 1}, nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("patch: got %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestRestoreHandler(t *testing.T) {
+	var (
+		srv  = newTestServer(t)
+		id   = srv.addItem(t, "Item", "1")
+		url  = "/api/items/" + id + "/restore"
+		rec  *httptest.ResponseRecorder
+		resp testResponse
+		item inventoryRow
+	)
+
+	rec, _ = srv.do(t, http.MethodPost, url, nil, nil)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("restore: got %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	rec, resp = srv.do(t, http.MethodDelete, "/api/delete/"+id, nil, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("delete: got %d (%v), want %d", rec.Code, resp.Error,
+			http.StatusOK)
+	}
+
+	rec, _ = srv.do(t, http.MethodPost, url, nil,
+		http.Header{"If-Match": {itemETag(1)}})
+	if rec.Code != http.StatusPreconditionFailed {
+		t.Fatalf("restore: got %d, want %d", rec.Code,
+			http.StatusPreconditionFailed)
+	}
+
+	rec, resp = srv.do(t, http.MethodPost, url, nil,
+		http.Header{"If-Match": {itemETag(2)}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("restore: got %d (%v), want %d", rec.Code, resp.Error,
+			http.StatusOK)
+	}
+
+	if rec, item = srv.getItem(t, id); rec.Code != http.StatusOK ||
+		item.Version != 3 {
+		t.Fatalf("get: got %d, item %+v", rec.Code, item)
+	}
+}
+
+func TestPatchHandlerMultipart(t *testing.T) {
+	var (
+		srv    = newTestServer(t)
+		itemID = srv.addItem(t, "Pixels", "19.99")
+		before inventoryRow
+		item   inventoryRow
+		body   bytes.Buffer
+		form   = multipart.NewWriter(&body)
+		part   io.Writer
+		img    []byte
+		rec    = httptest.NewRecorder()
+		req    *http.Request
+		err    error
+	)
+
+	_, before = srv.getItem(t, itemID)
+
+	img, err = base64.StdEncoding.DecodeString(testImageBase64(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	form.WriteField("item_count", "7")
+	if part, err = form.CreateFormFile(uploadImageField, "a.png"); err != nil {
+		t.Fatal(err)
+	}
+	part.Write(img)
+	form.Close()
+
+	req = httptest.NewRequest(http.MethodPatch, "/api/items/"+itemID, &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	srv.router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("patch: got %d (%s), want %d", rec.Code, rec.Body,
+			http.StatusOK)
+	}
+
+	_, item = srv.getItem(t, itemID)
+	if item.ItemCount != 7 || item.ItemName != "Pixels" ||
+		item.Image == nil || before.Image == nil ||
+		item.Image.ImageID != before.Image.ImageID ||
+		item.Version != before.Version+1 {
+		t.Fatalf("got item %+v, was %+v", item, before)
+	}
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/lib/pq"
+)
+
+var (
+	// Fetches the images of imports; it only talks to public addresses, so
+	// that an import cannot be used to reach the network of the server.
+	importHTTPClient = &http.Client{
+		Timeout: importFetchTimeout,
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout: importFetchTimeout,
+				Control: checkImportDial,
+			}).DialContext,
+			TLSHandshakeTimeout: importFetchTimeout,
+		},
+		CheckRedirect: checkImportRedirect,
+	}
+
+	errImportAddress = errors.New("image URL address is not allowed")
+)
+
+// A row-level error; the import carries on with the next row.
+type importRowError struct {
+	err error
+}
+
+func (e *importRowError) Error() string {
+	return e.err.Error()
+}
+
+type importReader interface {
+	Next() (importRow, error)
+}
+
+type csvImportReader struct {
+	in   *csv.Reader
+	cols map[string]int
+}
+
+type jsonlImportReader struct {
+	in *bufio.Scanner
+}
+
+func newCSVImportReader(in io.Reader) (*csvImportReader, error) {
+	var (
+		r      csvImportReader
+		header []string
+		err    error
+	)
+
+	r.in = csv.NewReader(in)
+	r.in.FieldsPerRecord = -1
+	r.in.TrimLeadingSpace = true
+
+	if header, err = r.in.Read(); err != nil {
+		return nil, fmt.Errorf("bad csv header: %v", err)
+	}
+
+	r.cols = make(map[string]int, len(header))
+	for i, col := range header {
+		col = strings.ToLower(strings.TrimSpace(col))
+		if !contains(importColumns, col) {
+			return nil, fmt.Errorf("unknown csv column: %q", col)
+		}
+		r.cols[col] = i
+	}
+
+	return &r, nil
+}
+
+func (r *csvImportReader) field(rec []string, col string) string {
+	var (
+		i  int
+		ok bool
+	)
+
+	if i, ok = r.cols[col]; !ok || i >= len(rec) {
+		return ""
+	}
+
+	return strings.TrimSpace(rec[i])
+}
+
+func (r *csvImportReader) Next() (importRow, error) {
+	var (
+		row importRow
+		rec []string
+		err error
+	)
+
+	if rec, err = r.in.Read(); err != nil {
+		if errors.Is(err, io.EOF) {
+			return row, io.EOF
+		}
+
+		var perr *csv.ParseError
+		if errors.As(err, &perr) {
+			return row, &importRowError{err}
+		}
+
+		return row, err
+	}
+
+	row.ItemCount, err = strconv.ParseUint(r.field(rec, "item_count"), 10, 64)
+	if err != nil {
+		return row, &importRowError{fmt.Errorf("bad item_count: %v", err)}
+	}
+
+	row.ItemPrice, err = parsePrice(r.field(rec, "item_price"))
+	if err != nil {
+		return row, &importRowError{fmt.Errorf("bad item_price: %v", err)}
+	}
+
+	row.ItemCurrency = r.field(rec, "item_currency")
+	row.ItemBrand = r.field(rec, "item_brand")
+	row.ItemName = r.field(rec, "item_name")
+	row.ItemDesc = r.field(rec, "item_desc")
+	row.ImageURL = r.field(rec, "image_url")
+	row.ImagePath = r.field(rec, "image_path")
+
+	return row, nil
+}
+
+func newJSONLImportReader(in io.Reader) *jsonlImportReader {
+	var r jsonlImportReader
+
+	r.in = bufio.NewScanner(in)
+	r.in.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), maxImportLineSize)
+
+	return &r
+}
+
+func (r *jsonlImportReader) Next() (importRow, error) {
+	var (
+		row  importRow
+		line []byte
+		err  error
+	)
+
+	if !r.in.Scan() {
+		if err = r.in.Err(); err != nil {
+			return row, err
+		}
+		return row, io.EOF
+	}
+
+	line = r.in.Bytes()
+	if len(strings.TrimSpace(string(line))) <= 0 {
+		return row, &importRowError{errors.New("empty line")}
+	}
+
+	if err = json.Unmarshal(line, &row); err != nil {
+		return row, &importRowError{err}
+	}
+
+	return row, nil
+}
+
+// Checks the scheme of an image URL; the address is checked once it is
+// resolved (see checkImportDial).
+func checkImportURL(imgURL *url.URL) error {
+	if imgURL.Scheme != "http" && imgURL.Scheme != "https" {
+		return errors.New("image URL must be http or https")
+	}
+
+	return nil
+}
+
+func isPublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast())
+}
+
+// Refuses connections to addresses that are not public. This runs on the
+// address being dialed (i.e., after the name has been resolved), so a name
+// that resolves to a private address is refused as well.
+func checkImportDial(network, address string, _ syscall.RawConn) error {
+	var (
+		host string
+		ip   net.IP
+		err  error
+	)
+
+	if host, _, err = net.SplitHostPort(address); err != nil {
+		return err
+	}
+
+	if ip = net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+		return errImportAddress
+	}
+
+	return nil
+}
+
+func checkImportRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > maxImportRedirects {
+		return errors.New("too many redirects")
+	}
+
+	return checkImportURL(req.URL)
+}
+
+// Fetches the image for a row, from (in that order) the inline base64
+// string, the import directory, or a URL.
+func fetchImportImage(row *importRow) ([]byte, error) {
+	var (
+		imgURL  *url.URL
+		resp    *http.Response
+		imgBuff []byte
+		imgPath string
+		err     error
+	)
+
+	switch {
+	case len(row.ImageBase64) > 0:
+		imgBuff, err = base64.StdEncoding.DecodeString(row.ImageBase64)
+		if err != nil {
+			return nil, err
+		}
+
+	case len(row.ImagePath) > 0:
+		if len(importRootDir) <= 0 {
+			return nil, errors.New("image paths are disabled")
+		}
+
+		// Clean the path as if it were absolute, so that it cannot
+		// point outside of the import directory.
+		imgPath = filepath.Join(
+			importRootDir, filepath.Clean("/"+row.ImagePath),
+		)
+		if imgBuff, err = readLimited(imgPath); err != nil {
+			return nil, err
+		}
+
+	case len(row.ImageURL) > 0:
+		if imgURL, err = url.Parse(row.ImageURL); err != nil {
+			return nil, err
+		}
+
+		if err = checkImportURL(imgURL); err != nil {
+			return nil, err
+		}
+
+		if resp, err = importHTTPClient.Get(imgURL.String()); err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("image fetch failed: %s", resp.Status)
+		}
+
+		imgBuff, err = io.ReadAll(
+			io.LimitReader(resp.Body, int64(maxImportImageSize)+1),
+		)
+		if err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, nil
+	}
+
+	if len(imgBuff) > maxImportImageSize {
+		return nil, errors.New("image too large")
+	}
+
+	if !mimetype.EqualsAny(
+		mimetype.Detect(imgBuff).String(), allowedImgMIMETypes...,
+	) {
+		return nil, errors.New("bad image MIME type")
+	}
+
+	return imgBuff, nil
+}
+
+func readLimited(filePath string) ([]byte, error) {
+	var (
+		file *os.File
+		err  error
+	)
+
+	if file, err = os.Open(filePath); err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return io.ReadAll(io.LimitReader(file, int64(maxImportImageSize)+1))
+}
+
+// Validates a row, and stages its image (if any) in the image store.
+func prepareImportItem(store ImageStore, row *importRow,
+	at time.Time) (importItem, error) {
+	var (
+		item    importItem
+		imgBuff []byte
+		err     error
+	)
+
+	if err = binding.Validator.ValidateStruct(row); err != nil {
+		return item, err
+	}
+
+	if err = checkItemPrice(&row.itemData); err != nil {
+		return item, err
+	}
+
+	if imgBuff, err = fetchImportImage(row); err != nil {
+		return item, err
+	}
+
+	item.ItemID = genItemHash()
+	item.itemData = row.itemData
+	item.CreatedAt = at
+	item.UpdatedAt = at
+
+	if imgBuff != nil {
+		item.imgStaged, item.imgMeta, err = stageItemImage(store, item.ItemID, imgBuff)
+		if err != nil {
+			return item, err
+		}
+	}
+
+	return item, nil
+}
+
+func discardImportItem(store ImageStore, item *importItem) {
+	if len(item.imgStaged) > 0 {
+		store.DeleteAll(item.ItemID)
+	}
+}
+
+// Returns why the database refused a row, without the details of the schema
+// (or of the database) that the error might carry.
+func importRowReason(err error) string {
+	var pqErr *pq.Error
+
+	for _, known := range []error{
+		errUnknownCurrency, errPricePrecision, errItemNotFound,
+	} {
+		if errors.Is(err, known) {
+			return known.Error()
+		}
+	}
+
+	if !errors.As(err, &pqErr) {
+		return "database error"
+	}
+
+	switch pqErr.Code.Name() {
+	case "unique_violation":
+		return "duplicate item"
+	case "not_null_violation":
+		return "missing value"
+	case "check_violation":
+		return "value not allowed"
+	case "foreign_key_violation":
+		return "references a missing row"
+	case "string_data_right_truncation":
+		return "value too long"
+	case "numeric_value_out_of_range":
+		return "number out of range"
+	case "invalid_text_representation", "character_not_in_repertoire",
+		"untranslatable_character":
+		return "invalid value"
+	}
+
+	return "database error"
+}
+
+// Inserts a batch of items at once (see ImportItems); a failing row does
+// not take the batch down with it.
+func flushImportBatch(inv InventoryStore, mux *itemLocker, store ImageStore,
+	batch []importItem, actor string, report *importReport) {
+
+	var (
+		errs   []error
+		failed = make([]bool, len(batch))
+		err    error
+	)
+
+	if len(batch) <= 0 {
+		return
+	}
+
+	fail := func(i int, err error) {
+		failed[i] = true
+		report.Failed++
+		report.Rows = append(report.Rows, importResult{
+			Row: batch[i].row, Error: err.Error(),
+		})
+		discardImportItem(store, &batch[i])
+	}
+
+	if errs, err = inv.ImportItems(batch, actor); err != nil {
+		log.Printf("db: failed to import batch: %v", err)
+		for i := range batch {
+			fail(i, errors.New("database error"))
+		}
+		return
+	}
+
+	for i := range batch {
+		if errs[i] != nil {
+			log.Printf(
+				"db: failed to import row %d: %v", batch[i].row, errs[i],
+			)
+			fail(i, errors.New(importRowReason(errs[i])))
+		}
+	}
+
+	for i := range batch {
+		if failed[i] {
+			continue
+		}
+
+		if len(batch[i].imgStaged) > 0 {
+			mux.Lock(batch[i].ItemID)
+			err = publishItemImage(
+				inv, store, batch[i].image, batch[i].imgStaged,
+			)
+			mux.Unlock(batch[i].ItemID)
+
+			if err != nil {
+				log.Printf("fs: failed to publish image: %v", err)
+			}
+		}
+
+		report.Imported++
+		report.Rows = append(report.Rows, importResult{
+			Row: batch[i].row, ItemID: batch[i].ItemID,
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestFetchImportImageRefusesPrivateURLs(t *testing.T) {
+	var (
+		fetched bool
+		srv     = httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				fetched = true
+			},
+		))
+		err error
+	)
+	defer srv.Close()
+
+	for _, imgURL := range []string{
+		srv.URL,
+		"http://localhost/",
+		"http://10.0.0.1/",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://[::1]/",
+		"http://0.0.0.0/",
+	} {
+		_, err = fetchImportImage(&importRow{ImageURL: imgURL})
+		if !errors.Is(err, errImportAddress) {
+			t.Errorf("%s: got %v, want %v", imgURL, err, errImportAddress)
+		}
+	}
+
+	for _, imgURL := range []string{"file:///etc/passwd", "ftp://a/b"} {
+		if _, err = fetchImportImage(&importRow{ImageURL: imgURL}); err == nil {
+			t.Errorf("%s: was fetched", imgURL)
+		}
+	}
+
+	if fetched {
+		t.Fatal("server was reached")
+	}
+}
+
+func TestCheckImportRedirect(t *testing.T) {
+	var (
+		via []*http.Request
+		req *http.Request
+		err error
+	)
+
+	req = httptest.NewRequest(http.MethodGet, "https://a/", nil)
+
+	if err = checkImportRedirect(req, via); err != nil {
+		t.Fatalf("redirect: %v", err)
+	}
+
+	for i := 0; i <= maxImportRedirects; i++ {
+		via = append(via, req)
+	}
+	if err = checkImportRedirect(req, via); err == nil {
+		t.Fatal("redirect: no limit")
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "gopher://a/", nil)
+	if err = checkImportRedirect(req, nil); err == nil {
+		t.Fatal("redirect: scheme not checked")
+	}
+}
+
+func TestImportRowReason(t *testing.T) {
+	for _, c := range []struct {
+		err    error
+		reason string
+	}{
+		{&pq.Error{Code: "23505", Detail: "(item_id)=(x)"}, "duplicate item"},
+		{fmt.Errorf("insert: %w", &pq.Error{Code: "22001"}), "value too long"},
+		{&pq.Error{Code: "23514", Constraint: "secret"}, "value not allowed"},
+		{&pq.Error{Code: "08006", Message: "host db-1"}, "database error"},
+		{errUnknownCurrency, errUnknownCurrency.Error()},
+		{errors.New("dial tcp 10.0.0.1:5432"), "database error"},
+	} {
+		if reason := importRowReason(c.err); reason != c.reason {
+			t.Errorf("%v: got %q, want %q", c.err, reason, c.reason)
+		}
+	}
+}
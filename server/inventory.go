@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	errItemNotFound      = errors.New("item not found")
+	errVersionMismatch   = errors.New("item version does not match")
+	errItemNotInTrash    = errors.New("item not in trash")
+	errNoSuchImage       = errors.New("no such image")
+	errBadImageOrder     = errors.New("bad image order")
+	errInsufficientStock = errors.New("insufficient stock")
+	errStockOverflow     = errors.New("stock count too large")
+	errUnknownCurrency   = errors.New("unknown currency")
+	errPricePrecision    = errors.New("price is finer than its currency")
+)
+
+// Who makes a change to an item (for the stock ledger), and when. If
+// "IfMatch" is set, the change is only made if the item is at one of
+// "Versions" (see "If-Match"); errVersionMismatch is returned otherwise.
+type itemWrite struct {
+	At       time.Time
+	Actor    string
+	IfMatch  bool
+	Versions []int64
+}
+
+// A change to the fields of an item; nil fields are left as they are. If
+// "Staged" is set, the upload (see stageItemImage) replaces the primary
+// image of the item, and is to be published once the change is made.
+type itemChange struct {
+	ItemCount    *uint64
+	ItemPrice    *price
+	ItemCurrency *string
+	ItemBrand    *string
+	ItemName     *string
+	ItemDesc     *string
+	Staged       string
+	Meta         imageMeta
+}
+
+// Rows of items, as they are read from the store (see ExportItems).
+type itemRows interface {
+	Next() bool
+	Scan(item *inventoryRow) error
+	Err() error
+	Close() error
+}
+
+// InventoryStore keeps the items of the inventory, the rows that describe
+// their images (the images themselves are in the ImageStore), and the stock
+// ledger. Every write is atomic: it is either made in full, or not at all.
+// Trashed items are not found by anything but the trash methods, unless
+// noted otherwise.
+type InventoryStore interface {
+	// AddItem adds an item, along with an image for a staged upload (if
+	// any), and records the count of the item in the stock ledger.
+	AddItem(item inventoryRow, staged string, meta imageMeta,
+		actor string) (imageRow, error)
+
+	// ImportItems adds a batch of items (as AddItem), and fills in their
+	// images. Items that fail are skipped, and their errors are returned
+	// by index; if the whole batch fails, none of the items are added.
+	ImportItems(batch []importItem, actor string) ([]error, error)
+
+	// GetItem returns an item, along with its primary image (if any).
+	GetItem(itemID string) (inventoryRow, error)
+
+	// ListItems returns up to "limit" items (after the cursor, if any) in
+	// the order of the filter, along with the number of items that match
+	// the filter.
+	ListItems(filter *listFilter, limit uint,
+		cur *listCursor) ([]inventoryRow, int64, error)
+
+	// ExportItems returns every item that matches the filter, in its order.
+	ExportItems(filter *listFilter) (itemRows, error)
+
+	// SearchItems returns a page of the items that have all of the terms
+	// (or words starting with them, for a prefix search), best matches
+	// first, along with the number of items that match.
+	SearchItems(terms []string, prefix bool, limit uint,
+		offset uint64) ([]searchRow, int64, error)
+
+	// UpdateItem changes an item (bumping its version even if nothing but
+	// its image changes), and records a change of its count in the stock
+	// ledger. The primary image of the item is returned if it is replaced.
+	// The price of the item has to suit its currency (see checkPrice),
+	// whichever of the two changes.
+	UpdateItem(itemID string, change itemChange, w itemWrite) (imageRow, error)
+
+	// AdjustStock adds "delta" to the count of an item, and records it in
+	// the stock ledger; errInsufficientStock is returned if the count would
+	// drop below zero, and errStockOverflow if it would go over maxItemCount.
+	AdjustStock(itemID string, delta int64, reason string,
+		w itemWrite) (uint64, error)
+
+	// ListMovements returns up to "limit" movements of an item (trashed or
+	// not) before the given movement ID, newest first, along with the
+	// number of movements of the item.
+	ListMovements(itemID string, before uint64,
+		limit uint) ([]stockMovement, int64, error)
+
+	TrashItem(itemID string, w itemWrite) error
+
+	// RestoreItem moves an item out of the trash; errItemNotInTrash is
+	// returned if it is not in there.
+	RestoreItem(itemID string, w itemWrite) error
+
+	// ListTrash returns up to "limit" trashed items (after the cursor, if
+	// any), most recently trashed first, along with the number of items in
+	// the trash.
+	ListTrash(cur *listCursor, limit uint) ([]inventoryRow, int64, error)
+
+	// DeleteItem removes an item (trashed or not) for good, along with the
+	// rows of its images; its movements are kept.
+	DeleteItem(itemID string, w itemWrite) error
+
+	// PurgeTrash removes the items that were trashed before the given time
+	// (as DeleteItem), and returns their IDs.
+	PurgeTrash(before time.Time) ([]string, error)
+
+	// ItemIDs returns the IDs of every item, trashed or not.
+	ItemIDs() ([]string, error)
+
+	// AddImage adds an image to the end of the images of an item, for a
+	// staged upload; it is the primary image if the item has no other.
+	AddImage(itemID, staged string, meta imageMeta,
+		w itemWrite) (imageRow, error)
+
+	// GetImage, GetImageAt (by the index of the image in the order of the
+	// images of the item) and GetPrimaryImage return errNoSuchImage if the
+	// image does not exist, or if its item is in the trash.
+	GetImage(itemID, imageID string) (imageRow, error)
+	GetImageAt(itemID string, index uint) (imageRow, error)
+	GetPrimaryImage(itemID string) (imageRow, error)
+
+	// ListImages returns the images of an item, in order.
+	ListImages(itemID string) ([]imageRow, error)
+
+	// OrderImages puts the images of an item in the given order, which has
+	// to list every image of the item exactly once (errBadImageOrder is
+	// returned otherwise), and returns them in that order.
+	OrderImages(itemID string, imageIDs []string,
+		w itemWrite) ([]imageRow, error)
+
+	SetPrimaryImage(itemID, imageID string, w itemWrite) (imageRow, error)
+
+	// DeleteImage removes the row of an image, making the first of the
+	// remaining images of the item primary if it was, and returns it.
+	DeleteImage(itemID, imageID string, w itemWrite) (imageRow, error)
+
+	// RemoveImage is DeleteImage for items that may be trashed, and that
+	// are not to be changed otherwise (e.g., to repair the store).
+	RemoveImage(itemID, imageID string) error
+
+	// ClearStagedImage marks a staged upload of an image as published (or
+	// as given up on), unless the image has been staged again since.
+	ClearStagedImage(imageID, staged string) error
+
+	// ListStagedImages returns the images (of every item) that are staged,
+	// and ListPublishedImages the ones that are not.
+	ListStagedImages() ([]imageRow, error)
+	ListPublishedImages() ([]imageRow, error)
+
+	// TryExclusive runs "fn" while holding the lock with the given key,
+	// which is shared by every server on the store; if another server has
+	// it, "fn" is not run, and false is returned.
+	TryExclusive(key int64, fn func() error) (bool, error)
+
+	Close() error
+}
+
+func newInventoryStore(kind, dsn string) (InventoryStore, error) {
+	switch kind {
+	case "postgres":
+		return newPgInventoryStore(dsn)
+	case "memory":
+		return newMemInventoryStore(), nil
+	default:
+		return nil, fmt.Errorf("bad inventory store type: %s", kind)
+	}
+}
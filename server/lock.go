@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sync"
+)
+
+// Read-write locks for the images of items, by item ID. Writers (anything
+// that replaces or removes the image of an item) hold the write lock, and
+// readers (serving the image, or generating thumbnails from it) hold the
+// read lock, so that readers never see an image being replaced. Locks for
+// different items are independent of each other.
+type itemLocker struct {
+	mu    sync.Mutex
+	locks map[string]*itemLock
+}
+
+type itemLock struct {
+	sync.RWMutex
+	refs int
+}
+
+func newItemLocker() *itemLocker {
+	return &itemLocker{locks: make(map[string]*itemLock)}
+}
+
+// Returns the lock for an item, creating it if needed; every call must be
+// paired with a call to release.
+func (l *itemLocker) acquire(itemID string) *itemLock {
+	var (
+		lock *itemLock
+		ok   bool
+	)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if lock, ok = l.locks[itemID]; !ok {
+		lock = &itemLock{}
+		l.locks[itemID] = lock
+	}
+	lock.refs++
+
+	return lock
+}
+
+// Drops the lock for an item once nobody holds or waits for it, so that
+// the map does not grow with every item ever locked.
+func (l *itemLocker) release(itemID string) *itemLock {
+	var lock *itemLock
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lock = l.locks[itemID]
+	if lock.refs--; lock.refs <= 0 {
+		delete(l.locks, itemID)
+	}
+
+	return lock
+}
+
+func (l *itemLocker) Lock(itemID string) {
+	l.acquire(itemID).Lock()
+}
+
+func (l *itemLocker) Unlock(itemID string) {
+	l.release(itemID).Unlock()
+}
+
+func (l *itemLocker) RLock(itemID string) {
+	l.acquire(itemID).RLock()
+}
+
+func (l *itemLocker) RUnlock(itemID string) {
+	l.release(itemID).RUnlock()
+}
@@ -4,10 +4,9 @@ import (
 	"flag"
 	"fmt"
 	"log"
-	"sync"
+	"runtime"
 
 	"github.com/gin-gonic/gin"
-	"github.com/jmoiron/sqlx"
 
 	_ "github.com/lib/pq"
 )
@@ -22,50 +21,206 @@ func main() {
 		dbUser = flag.String("dbuser", "", "database username")
 		dbPass = flag.String("dbpass", "", "database password")
 		dbgLog = flag.Bool("debug", false, "debug logging")
+		invKnd = flag.String(
+			"inventory", defaultInvStore, "inventory store type",
+		)
+		dbMigr = flag.Bool(
+			"migrate", false, "apply pending schema migrations on start-up",
+		)
+		impDir = flag.String("importdir", "", "directory for import images")
+		imKind = flag.String("imgstore", defaultImgStore, "image store type")
+		imRoot = flag.String("imgroot", defaultImgRoot, "image directory")
+		s3Endp = flag.String("s3endpoint", "", "S3 endpoint (host:port)")
+		s3Regn = flag.String("s3region", "", "S3 region")
+		s3Bckt = flag.String("s3bucket", "", "S3 bucket")
+		s3Prfx = flag.String("s3prefix", "", "S3 key prefix")
+		s3Akey = flag.String("s3access", "", "S3 access key")
+		s3Skey = flag.String("s3secret", "", "S3 secret key")
+		s3SSL  = flag.Bool("s3ssl", true, "use TLS for S3")
+		imPrst = flag.String(
+			"presets", defaultImgPresets, "thumbnail presets",
+		)
+		imPOnl = flag.Bool(
+			"presetsonly", false, "only allow thumbnail presets",
+		)
+		imQuot = flag.Int64(
+			"thumbquota", defaultThumbQuota,
+			"disk quota for thumbnails in bytes (0 for none)",
+		)
+		imWork = flag.Int(
+			"thumbworkers", runtime.NumCPU(),
+			"concurrent thumbnail generations",
+		)
+		imKeep = flag.Bool(
+			"keepexif", false, "keep the metadata of uploaded images",
+		)
+		imPgen = flag.Int(
+			"pregenworkers", defaultPregenWorkers,
+			"workers for thumbnail pre-generation",
+		)
+		reconc = flag.Bool(
+			"reconcile", true, "repair images left behind by a crash",
+		)
+		rcGrce = flag.Duration(
+			"reconcilegrace", defaultReconcileGrace,
+			"age of the images that the repair leaves alone",
+		)
+		trRetn = flag.Duration(
+			"retention", defaultTrashRetention, "trash retention period",
+		)
+		trIntv = flag.Duration(
+			"purgeinterval", defaultPurgeInterval, "trash purge interval",
+		)
 
 		err error
 
 		dbConnStr string
-		db        *sqlx.DB
+		inv       InventoryStore
 
-		mux sync.Mutex
+		mux   *itemLocker
+		store ImageStore
+		cache *thumbCache
 
 		router *gin.Engine
-		api    *gin.RouterGroup
-		img    *gin.RouterGroup
 	)
 
 	// Parse and validate flags.
 	flag.Parse()
 
-	err = invalidArgs(rnPort, dbPort, dbHost, dbName, dbUser, dbPass)
+	err = invalidArgs(
+		rnPort, dbPort, invKnd, dbHost, dbName, dbUser, dbPass,
+	)
 	if err != nil {
 		log.Fatalf("arg: invalid command-line arguments: %v", err)
 	}
 
-	// Setup a connection to the database.
+	if flag.NArg() > 0 && flag.Arg(0) != "migrate" {
+		log.Fatalf(
+			"arg: invalid command-line arguments: unknown command: %s",
+			flag.Arg(0),
+		)
+	}
+
+	if *trRetn < 0 || *trIntv <= 0 || *rcGrce < 0 {
+		log.Fatalf(
+			"arg: invalid command-line arguments: %v",
+			"bad duration for '-retention', '-purgeinterval' or "+
+				"'-reconcilegrace'",
+		)
+	}
+
+	importRootDir = *impDir
+
+	if imgPresets, err = parseImgPresets(*imPrst); err != nil {
+		log.Fatalf("arg: invalid command-line arguments: %v", err)
+	}
+	imgPresetsOnly = *imPOnl
+	imgKeepMeta = *imKeep
+
+	if *imWork <= 0 {
+		log.Fatalf(
+			"arg: invalid command-line arguments: %v",
+			"'-thumbworkers' must be positive",
+		)
+	}
+	thumbSlots = make(chan struct{}, *imWork)
+
+	// Setup the inventory store (and the connection to the database).
 	dbConnStr = getDBConnStr(dbPort, dbHost, dbName, dbUser, dbPass)
 	if len(dbConnStr) <= 0 {
 		log.Fatalf("db: failed to construct connection string")
 	}
 
-	if db, err = sqlx.Open(dbType, dbConnStr); err != nil {
-		log.Fatalf("db: failed to open connection: %v", err)
+	// Run the "migrate" command (instead of the server).
+	if flag.Arg(0) == "migrate" {
+		if *invKnd != "postgres" {
+			log.Fatalf("migrate: only the \"postgres\" store has a schema")
+		}
+
+		if err = runMigrateCommand(dbConnStr, flag.Args()[1:]); err != nil {
+			log.Fatalf("migrate: %v", err)
+		}
+
+		return
+	}
+
+	// The statements of the store are prepared against the schema, so it
+	// must be up to date before the store is setup.
+	if *dbMigr && *invKnd == "postgres" {
+		if err = migrateUp(dbConnStr); err != nil {
+			log.Fatalf("migrate: failed to apply migrations: %v", err)
+		}
+	}
+
+	if inv, err = newInventoryStore(*invKnd, dbConnStr); err != nil {
+		log.Fatalf("db: failed to setup inventory store: %v", err)
+	}
+	defer inv.Close()
+
+	// Setup the image store.
+	mux = newItemLocker()
+	store, err = newImageStore(*imKind, *imRoot, s3Config{
+		Endpoint:  *s3Endp,
+		Region:    *s3Regn,
+		Bucket:    *s3Bckt,
+		Prefix:    *s3Prfx,
+		AccessKey: *s3Akey,
+		SecretKey: *s3Skey,
+		UseSSL:    *s3SSL,
+	})
+	if err != nil {
+		log.Fatalf("img: failed to setup image store: %v", err)
 	}
-	defer db.Close()
 
-	if err = db.Ping(); err != nil {
-		log.Fatalf("db: database ping failed %v", err)
+	// Keep the thumbnails within the quota.
+	cache = newThumbCache(store, *imQuot)
+	store = cache
+
+	// Repair what a crash may have left behind, before serving anything. An
+	// in-memory inventory starts out empty, so every image in the store would
+	// look orphaned to it.
+	if *reconc && *invKnd != "memory" {
+		if err = reconcileImages(inv, store, *rcGrce); err != nil {
+			log.Printf("reconcile: failed to reconcile images: %v", err)
+		}
 	}
 
+	go loadThumbCache(inv, cache)
+
+	// Generate preset thumbnails in the background.
+	startThumbPregen(store, mux, *imPgen)
+
+	// Purge the trash in the background.
+	go runTrashPurger(inv, mux, store, *trRetn, *trIntv)
+
 	// Setup the router.
 	if !*dbgLog {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
+	if err = registerPriceBinding(); err != nil {
+		log.Fatalf("route: failed to setup price validation: %v", err)
+	}
+
+	router = newRouter(inv, mux, store)
+
+	router.Run(fmt.Sprintf("%s:%d", defaultRnHost, *rnPort))
+}
+
+// Sets up the routes of the API (and of the images), on the given stores.
+func newRouter(inv InventoryStore, mux *itemLocker,
+	store ImageStore) *gin.Engine {
+
+	var (
+		router *gin.Engine
+		api    *gin.RouterGroup
+		img    *gin.RouterGroup
+	)
+
 	router = gin.Default()
-	router.Use(useDbMiddleware(db))
-	router.Use(useMuxMiddleware(&mux))
+	router.Use(useInventoryMiddleware(inv))
+	router.Use(useMuxMiddleware(mux))
+	router.Use(useImgStoreMiddleware(store))
 	router.Use(useCORSMiddleware())
 	router.Use(useNoCacheMiddleware())
 	router.NoRoute(noRouteHandler)
@@ -75,12 +230,36 @@ func main() {
 		api.GET("/ping", pingHandler)
 		api.POST("/add", addHandler)
 		api.OPTIONS("/add", pingHandler)
+		api.POST("/import", importHandler)
+		api.OPTIONS("/import", pingHandler)
 		api.GET("/get/:item_id", getHandler)
 		api.GET("/list", listHandler)
+		api.GET("/search", searchHandler)
+		api.GET("/export", exportHandler)
 		api.PUT("/update/:item_id", updateHandler)
+		api.PATCH("/items/:item_id", patchHandler)
+		api.OPTIONS("/items/:item_id", pingHandler)
+		api.POST("/items/:item_id/stock", stockHandler)
+		api.OPTIONS("/items/:item_id/stock", pingHandler)
+		api.GET("/items/:item_id/history", historyHandler)
+		api.POST("/items/:item_id/images", addImageHandler)
+		api.GET("/items/:item_id/images", listImagesHandler)
+		api.PUT("/items/:item_id/images", orderImagesHandler)
+		api.OPTIONS("/items/:item_id/images", pingHandler)
+		api.POST(
+			"/items/:item_id/images/:image_id/primary",
+			primaryImageHandler,
+		)
+		api.OPTIONS("/items/:item_id/images/:image_id/primary", pingHandler)
+		api.DELETE("/items/:item_id/images/:image_id", deleteImageHandler)
+		api.OPTIONS("/items/:item_id/images/:image_id", pingHandler)
 		api.OPTIONS("/update/:item_id", pingHandler)
 		api.DELETE("/delete/:item_id", deleteHandler)
 		api.OPTIONS("/delete/:item_id", pingHandler)
+		api.GET("/trash", trashHandler)
+		api.POST("/items/:item_id/restore", restoreHandler)
+		api.GET("/cache", cacheHandler)
+		api.OPTIONS("/items/:item_id/restore", pingHandler)
 	}
 
 	img = router.Group("/img")
@@ -88,5 +267,5 @@ func main() {
 		img.GET("/:item_id", imgHandler)
 	}
 
-	router.Run(fmt.Sprintf("%s:%d", defaultRnHost, *rnPort))
+	return router
 }
@@ -0,0 +1,1012 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// InventoryStore in memory, for development and demos; nothing is kept
+// across restarts. Every method holds the lock for the whole of the call, so
+// writes are atomic (they are checked in full before anything is changed).
+type memInventoryStore struct {
+	mu        sync.Mutex
+	items     map[string]*inventoryRow
+	images    map[string][]*imageRow // By item, in order.
+	movements []stockMovement
+}
+
+type memItemRows struct {
+	rows []inventoryRow
+	next int
+}
+
+func (r *memItemRows) Next() bool {
+	r.next++
+	return r.next <= len(r.rows)
+}
+
+func (r *memItemRows) Scan(item *inventoryRow) error {
+	*item = r.rows[r.next-1]
+	return nil
+}
+
+func (r *memItemRows) Err() error {
+	return nil
+}
+
+func (r *memItemRows) Close() error {
+	return nil
+}
+
+func newMemInventoryStore() *memInventoryStore {
+	return &memInventoryStore{
+		items:  make(map[string]*inventoryRow),
+		images: make(map[string][]*imageRow),
+	}
+}
+
+func (s *memInventoryStore) Close() error {
+	return nil
+}
+
+// Returns an item that is not in the trash.
+func (s *memInventoryStore) liveItem(itemID string) (*inventoryRow, error) {
+	var item, ok = s.items[itemID]
+
+	if !ok || item.DeletedAt != nil {
+		return nil, errItemNotFound
+	}
+
+	return item, nil
+}
+
+// Returns an item that is not in the trash, if the write matches its
+// version.
+func (s *memInventoryStore) writableItem(itemID string,
+	w itemWrite) (*inventoryRow, error) {
+
+	var (
+		item *inventoryRow
+		err  error
+	)
+
+	if item, err = s.liveItem(itemID); err != nil {
+		return nil, err
+	}
+
+	if !matchVersion(item, w) {
+		return nil, errVersionMismatch
+	}
+
+	return item, nil
+}
+
+func matchVersion(item *inventoryRow, w itemWrite) bool {
+	if !w.IfMatch {
+		return true
+	}
+
+	for _, version := range w.Versions {
+		if version == item.Version {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *memInventoryStore) addMovement(itemID string, delta int64, reason,
+	actor string, at time.Time) {
+
+	s.movements = append(s.movements, stockMovement{
+		MovementID: int64(len(s.movements)) + 1,
+		ItemID:     itemID,
+		Delta:      delta,
+		Reason:     reason,
+		Actor:      actor,
+		CreatedAt:  at,
+	})
+}
+
+func (s *memInventoryStore) addItem(item inventoryRow, staged string,
+	meta imageMeta, actor string) (imageRow, error) {
+
+	var image imageRow
+
+	if _, ok := s.items[item.ItemID]; ok {
+		return image, fmt.Errorf("duplicate item id: %s", item.ItemID)
+	}
+
+	item.Version = 1
+	item.DeletedAt = nil
+	item.Image = nil
+	s.items[item.ItemID] = &item
+
+	if len(staged) > 0 {
+		image = s.addImage(item.ItemID, staged, meta, item.CreatedAt)
+	}
+
+	if item.ItemCount > 0 {
+		s.addMovement(
+			item.ItemID, int64(item.ItemCount), initialStockReason, actor,
+			item.CreatedAt,
+		)
+	}
+
+	return image, nil
+}
+
+func (s *memInventoryStore) AddItem(item inventoryRow, staged string,
+	meta imageMeta, actor string) (imageRow, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.addItem(item, staged, meta, actor)
+}
+
+func (s *memInventoryStore) ImportItems(batch []importItem,
+	actor string) ([]error, error) {
+
+	var errs = make([]error, len(batch))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range batch {
+		batch[i].image, errs[i] = s.addItem(
+			batch[i].inventoryRow, batch[i].imgStaged, batch[i].imgMeta,
+			actor,
+		)
+	}
+
+	return errs, nil
+}
+
+func (s *memInventoryStore) GetItem(itemID string) (inventoryRow, error) {
+	var (
+		item  *inventoryRow
+		image *imageRow
+		row   inventoryRow
+		err   error
+	)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if item, err = s.liveItem(itemID); err != nil {
+		return row, err
+	}
+
+	row = *item
+	if image = s.primaryImage(itemID); image != nil {
+		row.Image = new(imageRow)
+		*row.Image = *image
+	}
+
+	return row, nil
+}
+
+func matchFilter(filter *listFilter, item *inventoryRow) bool {
+	switch {
+	case item.DeletedAt != nil:
+		return false
+	case len(filter.Brand) > 0 && item.ItemBrand != filter.Brand:
+		return false
+	case filter.MinPrice != nil && item.ItemPrice.units < filter.MinPrice.units:
+		return false
+	case filter.MaxPrice != nil && item.ItemPrice.units > filter.MaxPrice.units:
+		return false
+	case filter.MinCount != nil && item.ItemCount < *filter.MinCount:
+		return false
+	case filter.MaxCount != nil && item.ItemCount > *filter.MaxCount:
+		return false
+	}
+
+	return true
+}
+
+// Compares items by a time, and then by ID (as the cursors of lists do).
+func compareItems(atA time.Time, idA string, atB time.Time, idB string) int {
+	switch {
+	case atA.Before(atB):
+		return -1
+	case atA.After(atB):
+		return 1
+	}
+
+	return strings.Compare(idA, idB)
+}
+
+// Returns up to "limit" items (all of them, if it is negative) that are
+// after the cursor in the given order, along with the number of items.
+func pageItems(items []inventoryRow, at func(*inventoryRow) time.Time,
+	desc bool, cur *listCursor, limit int) ([]inventoryRow, int64) {
+
+	var (
+		rows = []inventoryRow{}
+		sign = 1
+	)
+
+	if desc {
+		sign = -1
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return sign*compareItems(
+			at(&items[i]), items[i].ItemID, at(&items[j]), items[j].ItemID,
+		) < 0
+	})
+
+	for i := range items {
+		if limit >= 0 && len(rows) >= limit {
+			break
+		}
+		if cur != nil && sign*compareItems(
+			at(&items[i]), items[i].ItemID, cur.At, cur.ID,
+		) <= 0 {
+			continue
+		}
+		rows = append(rows, items[i])
+	}
+
+	return rows, int64(len(items))
+}
+
+func (s *memInventoryStore) listItems(filter *listFilter, cur *listCursor,
+	limit int) ([]inventoryRow, int64) {
+
+	var (
+		items []inventoryRow
+		at    = func(item *inventoryRow) time.Time { return item.UpdatedAt }
+	)
+
+	if filter.OrderBy == "created_at" {
+		at = func(item *inventoryRow) time.Time { return item.CreatedAt }
+	}
+
+	for _, item := range s.items {
+		if matchFilter(filter, item) {
+			items = append(items, *item)
+		}
+	}
+
+	return pageItems(items, at, filter.Order == "desc", cur, limit)
+}
+
+func (s *memInventoryStore) ListItems(filter *listFilter, limit uint,
+	cur *listCursor) ([]inventoryRow, int64, error) {
+
+	var (
+		rows  []inventoryRow
+		total int64
+	)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rows, total = s.listItems(filter, cur, int(limit))
+
+	return rows, total, nil
+}
+
+func (s *memInventoryStore) ExportItems(filter *listFilter) (itemRows, error) {
+	var rows []inventoryRow
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rows, _ = s.listItems(filter, nil, -1)
+
+	return &memItemRows{rows: rows}, nil
+}
+
+// Splits text into words (as searchTerms does), and the text between them.
+func splitWords(text string) []string {
+	var (
+		parts  []string
+		start  int
+		inWord bool
+	)
+
+	for i, r := range text {
+		isWord := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if i > 0 && isWord != inWord {
+			parts = append(parts, text[start:i])
+			start = i
+		}
+		inWord = isWord
+	}
+
+	return append(parts, text[start:])
+}
+
+func matchTerm(word, term string, prefix bool) bool {
+	word = strings.ToLower(word)
+	if prefix {
+		return strings.HasPrefix(word, term)
+	}
+
+	return word == term
+}
+
+// Returns the terms that the text has (by index), and the (escaped) text
+// with the words that match wrapped in "<mark>" (as the highlights of
+// Postgres).
+func searchText(text string, terms []string,
+	prefix bool) (map[int]bool, string) {
+
+	var (
+		found = make(map[int]bool)
+		hl    strings.Builder
+		match bool
+	)
+
+	for _, part := range splitWords(text) {
+		match = false
+		for i, term := range terms {
+			if matchTerm(part, term, prefix) {
+				found[i] = true
+				match = true
+			}
+		}
+
+		if match {
+			hl.WriteString(searchHlStart + part + searchHlStop)
+		} else {
+			hl.WriteString(part)
+		}
+	}
+
+	return found, markHighlights(hl.String())
+}
+
+// Items are ranked by the fields their terms are found in (the name weighs
+// the most, then the brand, and then the description); unlike Postgres,
+// words are not stemmed.
+func (s *memInventoryStore) SearchItems(terms []string, prefix bool,
+	limit uint, offset uint64) ([]searchRow, int64, error) {
+
+	var (
+		rows  []searchRow
+		page  = []searchRow{}
+		found [3]map[int]bool
+	)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, item := range s.items {
+		if item.DeletedAt != nil {
+			continue
+		}
+
+		row := searchRow{inventoryRow: *item}
+		found[0], row.NameHl = searchText(item.ItemName, terms, prefix)
+		found[1], row.BrandHl = searchText(item.ItemBrand, terms, prefix)
+		found[2], row.DescHl = searchText(item.ItemDesc, terms, prefix)
+
+		matched := true
+		for i := range terms {
+			if !found[0][i] && !found[1][i] && !found[2][i] {
+				matched = false
+				break
+			}
+			for field, weight := range []float32{1.0, 0.4, 0.2} {
+				if found[field][i] {
+					row.Rank += weight
+				}
+			}
+		}
+
+		if matched {
+			rows = append(rows, row)
+		}
+	}
+
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Rank != rows[j].Rank {
+			return rows[i].Rank > rows[j].Rank
+		}
+		return rows[i].ItemID < rows[j].ItemID
+	})
+
+	for i := offset; i < uint64(len(rows)) && len(page) < int(limit); i++ {
+		page = append(page, rows[i])
+	}
+
+	return page, int64(len(rows)), nil
+}
+
+func (s *memInventoryStore) UpdateItem(itemID string, change itemChange,
+	w itemWrite) (imageRow, error) {
+
+	var (
+		item     *inventoryRow
+		image    *imageRow
+		row      imageRow
+		amount   price
+		currency string
+		err      error
+	)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if item, err = s.writableItem(itemID, w); err != nil {
+		return row, err
+	}
+
+	if change.ItemPrice != nil || change.ItemCurrency != nil {
+		amount, currency = item.ItemPrice, item.ItemCurrency
+		if change.ItemPrice != nil {
+			amount = *change.ItemPrice
+		}
+		if change.ItemCurrency != nil {
+			currency = *change.ItemCurrency
+		}
+
+		if err = checkPrice(amount, currency); err != nil {
+			return row, err
+		}
+	}
+
+	if change.ItemCount != nil && *change.ItemCount != item.ItemCount {
+		s.addMovement(
+			itemID, int64(*change.ItemCount)-int64(item.ItemCount),
+			defaultStockReason, w.Actor, w.At,
+		)
+		item.ItemCount = *change.ItemCount
+	}
+	if change.ItemPrice != nil {
+		item.ItemPrice = *change.ItemPrice
+	}
+	if change.ItemCurrency != nil {
+		item.ItemCurrency = *change.ItemCurrency
+	}
+	if change.ItemBrand != nil {
+		item.ItemBrand = *change.ItemBrand
+	}
+	if change.ItemName != nil {
+		item.ItemName = *change.ItemName
+	}
+	if change.ItemDesc != nil {
+		item.ItemDesc = *change.ItemDesc
+	}
+	item.UpdatedAt = w.At
+	item.Version++
+
+	if len(change.Staged) > 0 {
+		if image = s.primaryImage(itemID); image == nil {
+			return s.addImage(itemID, change.Staged, change.Meta, w.At), nil
+		}
+
+		setImageMeta(image, change.Meta)
+		image.Staged = &change.Staged
+		row = *image
+	}
+
+	return row, nil
+}
+
+func (s *memInventoryStore) AdjustStock(itemID string, delta int64,
+	reason string, w itemWrite) (uint64, error) {
+
+	var (
+		item *inventoryRow
+		err  error
+	)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if item, err = s.writableItem(itemID, w); err != nil {
+		return 0, err
+	}
+
+	if int64(item.ItemCount)+delta < 0 {
+		return 0, errInsufficientStock
+	}
+
+	if int64(item.ItemCount)+delta > maxItemCount {
+		return 0, errStockOverflow
+	}
+
+	item.ItemCount = uint64(int64(item.ItemCount) + delta)
+	item.UpdatedAt = w.At
+	item.Version++
+	s.addMovement(itemID, delta, reason, w.Actor, w.At)
+
+	return item.ItemCount, nil
+}
+
+func (s *memInventoryStore) ListMovements(itemID string, before uint64,
+	limit uint) ([]stockMovement, int64, error) {
+
+	var (
+		rows  = []stockMovement{}
+		total int64
+	)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := len(s.movements) - 1; i >= 0; i-- {
+		if s.movements[i].ItemID != itemID {
+			continue
+		}
+		total++
+
+		if uint64(s.movements[i].MovementID) < before &&
+			len(rows) < int(limit) {
+
+			rows = append(rows, s.movements[i])
+		}
+	}
+
+	return rows, total, nil
+}
+
+func (s *memInventoryStore) TrashItem(itemID string, w itemWrite) error {
+	var (
+		item *inventoryRow
+		err  error
+	)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if item, err = s.writableItem(itemID, w); err != nil {
+		return err
+	}
+
+	item.DeletedAt = &w.At
+	item.UpdatedAt = w.At
+	item.Version++
+
+	return nil
+}
+
+func (s *memInventoryStore) RestoreItem(itemID string, w itemWrite) error {
+	var (
+		item *inventoryRow
+		ok   bool
+	)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if item, ok = s.items[itemID]; !ok || item.DeletedAt == nil {
+		return errItemNotInTrash
+	}
+
+	if !matchVersion(item, w) {
+		return errVersionMismatch
+	}
+
+	item.DeletedAt = nil
+	item.UpdatedAt = w.At
+	item.Version++
+
+	return nil
+}
+
+func (s *memInventoryStore) ListTrash(cur *listCursor,
+	limit uint) ([]inventoryRow, int64, error) {
+
+	var (
+		items []inventoryRow
+		rows  []inventoryRow
+		total int64
+		at    = func(item *inventoryRow) time.Time { return *item.DeletedAt }
+	)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, item := range s.items {
+		if item.DeletedAt != nil {
+			items = append(items, *item)
+		}
+	}
+
+	rows, total = pageItems(items, at, true, cur, int(limit))
+
+	return rows, total, nil
+}
+
+func (s *memInventoryStore) DeleteItem(itemID string, w itemWrite) error {
+	var (
+		item *inventoryRow
+		ok   bool
+	)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if item, ok = s.items[itemID]; !ok {
+		return errItemNotFound
+	}
+
+	if !matchVersion(item, w) {
+		return errVersionMismatch
+	}
+
+	delete(s.items, itemID)
+	delete(s.images, itemID)
+
+	return nil
+}
+
+func (s *memInventoryStore) PurgeTrash(before time.Time) ([]string, error) {
+	var itemIDs []string
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for itemID, item := range s.items {
+		if item.DeletedAt != nil && item.DeletedAt.Before(before) {
+			itemIDs = append(itemIDs, itemID)
+			delete(s.items, itemID)
+			delete(s.images, itemID)
+		}
+	}
+
+	return itemIDs, nil
+}
+
+func (s *memInventoryStore) ItemIDs() ([]string, error) {
+	var itemIDs []string
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for itemID := range s.items {
+		itemIDs = append(itemIDs, itemID)
+	}
+
+	return itemIDs, nil
+}
+
+func setImageMeta(image *imageRow, meta imageMeta) {
+	image.Width = &meta.Width
+	image.Height = &meta.Height
+	image.Size = &meta.Size
+	image.MIMEType = &meta.MIMEType
+}
+
+func (s *memInventoryStore) primaryImage(itemID string) *imageRow {
+	for _, image := range s.images[itemID] {
+		if image.Primary {
+			return image
+		}
+	}
+
+	return nil
+}
+
+func (s *memInventoryStore) findImage(itemID, imageID string) (int, error) {
+	for i, image := range s.images[itemID] {
+		if image.ImageID == imageID {
+			return i, nil
+		}
+	}
+
+	return -1, errNoSuchImage
+}
+
+func (s *memInventoryStore) addImage(itemID, staged string, meta imageMeta,
+	at time.Time) imageRow {
+
+	var (
+		images = s.images[itemID]
+		id     = genItemHash()
+		image  = &imageRow{
+			ImageID:   id,
+			ItemID:    itemID,
+			ImageName: imgImagePrefix + id,
+			Primary:   s.primaryImage(itemID) == nil,
+			CreatedAt: at,
+			Staged:    &staged,
+		}
+	)
+
+	if len(images) > 0 {
+		image.Position = images[len(images)-1].Position + 1
+	}
+	setImageMeta(image, meta)
+	s.images[itemID] = append(images, image)
+
+	return *image
+}
+
+func (s *memInventoryStore) AddImage(itemID, staged string, meta imageMeta,
+	w itemWrite) (imageRow, error) {
+
+	var (
+		item *inventoryRow
+		err  error
+	)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if item, err = s.writableItem(itemID, w); err != nil {
+		return imageRow{}, err
+	}
+
+	item.UpdatedAt = w.At
+	item.Version++
+
+	return s.addImage(itemID, staged, meta, w.At), nil
+}
+
+func (s *memInventoryStore) GetImage(itemID, imageID string) (imageRow, error) {
+	var (
+		i   int
+		err error
+	)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err = s.liveItem(itemID); err != nil {
+		return imageRow{}, errNoSuchImage
+	}
+
+	if i, err = s.findImage(itemID, imageID); err != nil {
+		return imageRow{}, err
+	}
+
+	return *s.images[itemID][i], nil
+}
+
+func (s *memInventoryStore) GetImageAt(itemID string,
+	index uint) (imageRow, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.liveItem(itemID); err != nil {
+		return imageRow{}, errNoSuchImage
+	}
+
+	if index >= uint(len(s.images[itemID])) {
+		return imageRow{}, errNoSuchImage
+	}
+
+	return *s.images[itemID][index], nil
+}
+
+func (s *memInventoryStore) GetPrimaryImage(itemID string) (imageRow, error) {
+	var image *imageRow
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.liveItem(itemID); err != nil {
+		return imageRow{}, errNoSuchImage
+	}
+
+	if image = s.primaryImage(itemID); image == nil {
+		return imageRow{}, errNoSuchImage
+	}
+
+	return *image, nil
+}
+
+func (s *memInventoryStore) listImages(itemID string) []imageRow {
+	var images = make([]imageRow, 0, len(s.images[itemID]))
+
+	for _, image := range s.images[itemID] {
+		images = append(images, *image)
+	}
+
+	return images
+}
+
+func (s *memInventoryStore) ListImages(itemID string) ([]imageRow, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.liveItem(itemID); err != nil {
+		return nil, err
+	}
+
+	return s.listImages(itemID), nil
+}
+
+func (s *memInventoryStore) OrderImages(itemID string, imageIDs []string,
+	w itemWrite) ([]imageRow, error) {
+
+	var (
+		item   *inventoryRow
+		images []*imageRow
+		seen   = make(map[string]bool)
+		i      int
+		err    error
+	)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if item, err = s.writableItem(itemID, w); err != nil {
+		return nil, err
+	}
+
+	if len(imageIDs) != len(s.images[itemID]) {
+		return nil, errBadImageOrder
+	}
+
+	for _, id := range imageIDs {
+		if i, err = s.findImage(itemID, id); err != nil || seen[id] {
+			return nil, errBadImageOrder
+		}
+		seen[id] = true
+		images = append(images, s.images[itemID][i])
+	}
+
+	for i := range images {
+		images[i].Position = i
+	}
+	s.images[itemID] = images
+	item.UpdatedAt = w.At
+	item.Version++
+
+	return s.listImages(itemID), nil
+}
+
+func (s *memInventoryStore) SetPrimaryImage(itemID, imageID string,
+	w itemWrite) (imageRow, error) {
+
+	var (
+		item *inventoryRow
+		i    int
+		err  error
+	)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if item, err = s.writableItem(itemID, w); err != nil {
+		return imageRow{}, err
+	}
+
+	if i, err = s.findImage(itemID, imageID); err != nil {
+		return imageRow{}, err
+	}
+
+	for _, image := range s.images[itemID] {
+		image.Primary = false
+	}
+	s.images[itemID][i].Primary = true
+	item.UpdatedAt = w.At
+	item.Version++
+
+	return *s.images[itemID][i], nil
+}
+
+// Removes an image, making the first of the remaining images of the item
+// primary if it was.
+func (s *memInventoryStore) removeImage(itemID string, i int) imageRow {
+	var (
+		images = s.images[itemID]
+		image  = *images[i]
+	)
+
+	images = append(images[:i:i], images[i+1:]...)
+	if image.Primary && len(images) > 0 {
+		images[0].Primary = true
+	}
+	s.images[itemID] = images
+
+	return image
+}
+
+func (s *memInventoryStore) DeleteImage(itemID, imageID string,
+	w itemWrite) (imageRow, error) {
+
+	var (
+		item *inventoryRow
+		i    int
+		err  error
+	)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if item, err = s.writableItem(itemID, w); err != nil {
+		return imageRow{}, err
+	}
+
+	if i, err = s.findImage(itemID, imageID); err != nil {
+		return imageRow{}, err
+	}
+
+	item.UpdatedAt = w.At
+	item.Version++
+
+	return s.removeImage(itemID, i), nil
+}
+
+func (s *memInventoryStore) RemoveImage(itemID, imageID string) error {
+	var (
+		i   int
+		err error
+	)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if i, err = s.findImage(itemID, imageID); err != nil {
+		return err
+	}
+	s.removeImage(itemID, i)
+
+	return nil
+}
+
+func (s *memInventoryStore) ClearStagedImage(imageID, staged string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, images := range s.images {
+		for _, image := range images {
+			if image.ImageID == imageID && image.Staged != nil &&
+				*image.Staged == staged {
+
+				image.Staged = nil
+			}
+		}
+	}
+
+	return nil
+}
+
+// Returns the images that are staged (or not), by item, in order.
+func (s *memInventoryStore) imagesByStaged(staged bool) []imageRow {
+	var (
+		itemIDs []string
+		images  []imageRow
+	)
+
+	for itemID := range s.images {
+		itemIDs = append(itemIDs, itemID)
+	}
+	sort.Strings(itemIDs)
+
+	for _, itemID := range itemIDs {
+		for _, image := range s.images[itemID] {
+			if (image.Staged != nil) == staged {
+				images = append(images, *image)
+			}
+		}
+	}
+
+	return images
+}
+
+func (s *memInventoryStore) ListStagedImages() ([]imageRow, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.imagesByStaged(true), nil
+}
+
+func (s *memInventoryStore) ListPublishedImages() ([]imageRow, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.imagesByStaged(false), nil
+}
+
+// There are no other servers on an in-memory store.
+func (s *memInventoryStore) TryExclusive(key int64,
+	fn func() error) (bool, error) {
+
+	return true, fn()
+}
@@ -0,0 +1,588 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"io"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/rwcarlsen/goexif/exif"
+	"github.com/rwcarlsen/goexif/tiff"
+)
+
+var (
+	errBadImageData = errors.New("malformed image data")
+	errImagePixels  = errors.New("image has too many pixels")
+
+	pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+	// Metadata that may identify the owner of an image, or where it was
+	// taken: EXIF (which has the GPS tags), XMP, IPTC and comments.
+	jpegMetaMarkers = map[byte]bool{0xe1: true, 0xed: true, 0xfe: true}
+	pngMetaChunks   = map[string]bool{
+		"eXIf": true, "tEXt": true, "zTXt": true, "iTXt": true, "tIME": true,
+	}
+	webpMetaChunks = map[string]bool{"EXIF": true, "XMP ": true}
+)
+
+// Prepares an uploaded image for storage: the EXIF orientation (if any) is
+// applied to the pixels, and the metadata is stripped (unless "-keepexif"
+// is set). Images that have to be rotated are encoded again, which drops
+// all of their metadata. The metadata to record in the database for the
+// image is returned along with the image.
+func sanitizeImage(data []byte) ([]byte, imageMeta, error) {
+	var (
+		meta        imageMeta
+		format      string
+		stripped    []byte
+		exifData    []byte
+		orientation int
+		img         image.Image
+		out         bytes.Buffer
+		cfg         image.Config
+		err         error
+	)
+
+	meta.MIMEType = mimetype.Detect(data).String()
+	if format, err = imageFormat(meta.MIMEType); err != nil {
+		return nil, meta, err
+	}
+
+	if err = checkImagePixels(format, bytes.NewReader(data)); err != nil {
+		return nil, meta, err
+	}
+
+	if stripped, exifData, err = stripImageMeta(format, data); err != nil {
+		return nil, meta, err
+	}
+
+	if orientation = exifOrientation(exifData); orientation > 1 {
+		if img, err = decodeImage(format, bytes.NewReader(data)); err != nil {
+			return nil, meta, err
+		}
+
+		err = encodeImage(
+			format, imageQuality(format, imgOrientQuality),
+			orientImage(img, orientation), &out,
+		)
+		if err != nil {
+			return nil, meta, err
+		}
+		data = out.Bytes()
+	} else if !imgKeepMeta {
+		data = stripped
+	}
+
+	if cfg, _, err = image.DecodeConfig(bytes.NewReader(data)); err != nil {
+		return nil, meta, err
+	}
+
+	meta.Width = cfg.Width
+	meta.Height = cfg.Height
+	meta.Size = int64(len(data))
+
+	return data, meta, nil
+}
+
+// Checks, from the headers of an image, that it is small enough to be
+// decoded: at most "maxImagePixels" pixels, and for GIFs (all of the frames
+// of which are decoded), at most "maxGifPixels" pixels over all frames.
+func checkImagePixels(format string, in io.Reader) error {
+	var (
+		cfg    image.Config
+		frames int64 = 1
+		pixels int64
+		err    error
+	)
+
+	if format == "gif" {
+		cfg, frames, err = scanGif(in)
+	} else {
+		cfg, _, err = image.DecodeConfig(in)
+	}
+	if err != nil {
+		return err
+	}
+
+	pixels = int64(cfg.Width) * int64(cfg.Height)
+	if pixels > maxImagePixels ||
+		(pixels > 0 && frames > maxGifPixels/pixels) {
+		return errImagePixels
+	}
+
+	return nil
+}
+
+// Returns the EXIF orientation (1 to 8, see the TIFF spec) from the EXIF
+// data of an image (see imageMetaFilter), or 1 if there is none.
+func exifOrientation(raw []byte) int {
+	var (
+		x   *exif.Exif
+		tag *tiff.Tag
+		val int
+		err error
+	)
+
+	if len(raw) <= 0 {
+		return 1
+	}
+
+	if x, err = exif.Decode(bytes.NewReader(raw)); err != nil {
+		return 1
+	}
+
+	if tag, err = x.Get(exif.Orientation); err != nil {
+		return 1
+	}
+
+	if val, err = tag.Int(0); err != nil || val < 1 || val > 8 {
+		return 1
+	}
+
+	return val
+}
+
+// Transforms an image as per its EXIF orientation, so that it is upright.
+func orientImage(img image.Image, orientation int) image.Image {
+	var (
+		bounds = img.Bounds()
+		w      = bounds.Dx()
+		h      = bounds.Dy()
+		src    = image.NewRGBA(image.Rect(0, 0, w, h))
+		dst    *image.RGBA
+		sx, sy int
+	)
+
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+
+	// Orientations 5 to 8 swap the width and the height.
+	if orientation >= 5 {
+		dst = image.NewRGBA(image.Rect(0, 0, h, w))
+	} else {
+		dst = image.NewRGBA(image.Rect(0, 0, w, h))
+	}
+
+	for y := 0; y < dst.Rect.Dy(); y++ {
+		for x := 0; x < dst.Rect.Dx(); x++ {
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			default:
+				sx, sy = x, y
+			}
+
+			copy(
+				dst.Pix[dst.PixOffset(x, y):][:4],
+				src.Pix[src.PixOffset(sx, sy):][:4],
+			)
+		}
+	}
+
+	return dst
+}
+
+// Drops the metadata segments (or chunks) of an image as it is read,
+// leaving the rest of it (e.g., the color profile) as is, so that it can be
+// streamed to the store. Only the headers of the segments are held (the
+// image data passes through as it is), except for the EXIF data, which is
+// kept aside (if it is small enough) for the orientation of the image. GIFs
+// pass through unchanged.
+//
+// The RIFF header of a WebP counts the whole file, which is not known until
+// the end of it; it is passed as it is (or as "webpSize", if that is set),
+// so it has to be fixed if any chunks were dropped.
+type imageMetaFilter struct {
+	in       *bufio.Reader
+	format   string
+	strip    bool
+	started  bool
+	head     []byte
+	pass     int64
+	rest     bool
+	bad      bool
+	exif     []byte
+	dropped  int64
+	riffSize uint32
+	webpSize uint32
+}
+
+// Returns a filter that only keeps the EXIF data aside (and drops nothing)
+// unless "strip" is set.
+func newImageMetaFilter(format string, in io.Reader,
+	strip bool) *imageMetaFilter {
+
+	return &imageMetaFilter{
+		in: bufio.NewReader(in), format: format, strip: strip,
+	}
+}
+
+func (f *imageMetaFilter) Read(p []byte) (int, error) {
+	var (
+		n   int
+		err error
+	)
+
+	for len(f.head) <= 0 && f.pass <= 0 && !f.rest {
+		if err = f.next(); err != nil {
+			if !errors.Is(err, io.EOF) {
+				f.bad = true
+			}
+			return 0, err
+		}
+	}
+
+	if len(f.head) > 0 {
+		n = copy(p, f.head)
+		f.head = f.head[n:]
+		return n, nil
+	}
+
+	if f.rest {
+		return f.in.Read(p)
+	}
+
+	if int64(len(p)) > f.pass {
+		p = p[:f.pass]
+	}
+
+	n, err = f.in.Read(p)
+	if f.pass -= int64(n); errors.Is(err, io.EOF) {
+		if f.pass > 0 {
+			f.bad = true
+			return n, errBadImageData
+		}
+		err = nil
+	}
+
+	return n, err
+}
+
+// Reads the next segment (or chunk) header, and queues what is to be kept.
+func (f *imageMetaFilter) next() error {
+	if !f.started {
+		f.started = true
+		return f.signature()
+	}
+
+	switch f.format {
+	case "jpeg":
+		return f.nextJpeg()
+	case "png":
+		return f.nextPng()
+	case "webp":
+		return f.nextWebp()
+	default:
+		f.rest = true
+		return nil
+	}
+}
+
+func (f *imageMetaFilter) signature() error {
+	var size int
+
+	switch f.format {
+	case "jpeg":
+		size = 2
+	case "png":
+		size = len(pngSignature)
+	case "webp":
+		size = 12
+	default:
+		f.rest = true
+		return nil
+	}
+
+	f.head = make([]byte, size)
+	if _, err := io.ReadFull(f.in, f.head); err != nil {
+		return errBadImageData
+	}
+
+	switch f.format {
+	case "jpeg":
+		if f.head[0] != 0xff || f.head[1] != 0xd8 {
+			return errBadImageData
+		}
+	case "png":
+		if !bytes.Equal(f.head, pngSignature) {
+			return errBadImageData
+		}
+	case "webp":
+		if string(f.head[:4]) != "RIFF" || string(f.head[8:]) != "WEBP" {
+			return errBadImageData
+		}
+		f.riffSize = binary.LittleEndian.Uint32(f.head[4:])
+		if f.webpSize > 0 {
+			binary.LittleEndian.PutUint32(f.head[4:], f.webpSize)
+		}
+	}
+
+	return nil
+}
+
+// Queues a segment (or chunk) with a body of "size" bytes to pass through,
+// or skips it (unless "keep" is set). EXIF data that is small enough is
+// read, and kept aside, either way.
+func (f *imageMetaFilter) segment(head []byte, size int64, isExif,
+	keep bool) error {
+
+	var (
+		body []byte
+		err  error
+	)
+
+	if isExif && f.exif == nil && size <= maxImageExifSize {
+		body = make([]byte, size)
+		if _, err = io.ReadFull(f.in, body); err != nil {
+			return errBadImageData
+		}
+		f.exif = body
+
+		if keep {
+			f.head = append(head, body...)
+			return nil
+		}
+	} else if keep {
+		f.head, f.pass = head, size
+		return nil
+	} else if _, err = f.in.Discard(int(size)); err != nil {
+		return errBadImageData
+	}
+
+	f.dropped += int64(len(head)) + size
+
+	return nil
+}
+
+func (f *imageMetaFilter) nextJpeg() error {
+	var (
+		head = make([]byte, 4)
+		size int64
+		err  error
+	)
+
+	if _, err = io.ReadFull(f.in, head[:2]); err != nil {
+		return errBadImageData
+	}
+
+	// Fill bytes before a marker.
+	for head[0] == 0xff && head[1] == 0xff {
+		if head[1], err = f.in.ReadByte(); err != nil {
+			return errBadImageData
+		}
+	}
+
+	if head[0] != 0xff {
+		return errBadImageData
+	}
+
+	// The rest of the image (after the start of the scan) is entropy
+	// coded data.
+	if head[1] == 0xda {
+		f.head, f.rest = head[:2], true
+		return nil
+	}
+
+	if _, err = io.ReadFull(f.in, head[2:]); err != nil {
+		return errBadImageData
+	}
+
+	if size = int64(binary.BigEndian.Uint16(head[2:])) - 2; size < 0 {
+		return errBadImageData
+	}
+
+	// The EXIF data is in an APP1 segment, after an "Exif" header.
+	if head[1] == 0xe1 {
+		if prefix, _ := f.in.Peek(4); string(prefix) == "Exif" {
+			return f.segment(head, size, true, !f.strip)
+		}
+	}
+
+	return f.segment(
+		head, size, false, !f.strip || !jpegMetaMarkers[head[1]],
+	)
+}
+
+func (f *imageMetaFilter) nextPng() error {
+	var (
+		head = make([]byte, 8)
+		kind string
+		size int64
+		n    int
+		err  error
+	)
+
+	if n, err = io.ReadFull(f.in, head); err != nil {
+		if n == 0 && errors.Is(err, io.EOF) {
+			return io.EOF
+		}
+		return errBadImageData
+	}
+
+	// The chunk data is followed by a CRC.
+	size = int64(binary.BigEndian.Uint32(head)) + 4
+	if kind = string(head[4:]); kind == "IEND" {
+		f.head, f.rest = head, true
+		return nil
+	}
+
+	return f.segment(
+		head, size, kind == "eXIf", !f.strip || !pngMetaChunks[kind],
+	)
+}
+
+func (f *imageMetaFilter) nextWebp() error {
+	var (
+		head = make([]byte, 8)
+		kind string
+		size int64
+		n    int
+		err  error
+	)
+
+	if n, err = io.ReadFull(f.in, head); err != nil {
+		if n == 0 && errors.Is(err, io.EOF) {
+			return io.EOF
+		}
+		return errBadImageData
+	}
+
+	// Chunks are padded to an even size.
+	size = int64(binary.LittleEndian.Uint32(head[4:]))
+	size += size % 2
+	kind = string(head[:4])
+
+	// The extended header flags the metadata chunks that follow.
+	if kind == "VP8X" && f.strip && size == 10 {
+		f.head = make([]byte, 8+size)
+		copy(f.head, head)
+		if _, err = io.ReadFull(f.in, f.head[8:]); err != nil {
+			return errBadImageData
+		}
+		f.head[8] &^= 0x0c
+		return nil
+	}
+
+	return f.segment(
+		head, size, kind == "EXIF", !f.strip || !webpMetaChunks[kind],
+	)
+}
+
+// The RIFF size of a WebP once the dropped chunks are taken out of it.
+func (f *imageMetaFilter) strippedWebpSize() uint32 {
+	return f.riffSize - uint32(f.dropped)
+}
+
+// Drops the metadata from an image (see imageMetaFilter), and returns it
+// along with the EXIF data that was in it (if any).
+func stripImageMeta(format string, data []byte) ([]byte, []byte, error) {
+	var (
+		filter = newImageMetaFilter(format, bytes.NewReader(data), true)
+		out    []byte
+		err    error
+	)
+
+	if out, err = io.ReadAll(filter); err != nil {
+		return nil, nil, err
+	}
+
+	if format == "webp" && filter.dropped > 0 {
+		binary.LittleEndian.PutUint32(out[4:], filter.strippedWebpSize())
+	}
+
+	return out, filter.exif, nil
+}
+
+// Returns the size of the logical screen of a GIF, and the number of frames
+// in it, by walking its blocks (without decoding any of the frames).
+func scanGif(in io.Reader) (image.Config, int64, error) {
+	var (
+		r      = bufio.NewReader(in)
+		cfg    image.Config
+		head   [13]byte
+		desc   [9]byte
+		frames int64
+		block  byte
+		err    error
+	)
+
+	// Skips a color table, if the flags say there is one.
+	skipTable := func(flags byte) error {
+		if flags&0x80 == 0 {
+			return nil
+		}
+		_, err := r.Discard(3 << ((flags & 0x07) + 1))
+		return err
+	}
+
+	// Skips data sub-blocks, up to the (empty) block terminator.
+	skipBlocks := func() error {
+		for {
+			size, err := r.ReadByte()
+			if err != nil || size == 0 {
+				return err
+			}
+			if _, err = r.Discard(int(size)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err = io.ReadFull(r, head[:]); err != nil {
+		return cfg, 0, errBadImageData
+	}
+	if !bytes.HasPrefix(head[:], []byte("GIF8")) {
+		return cfg, 0, errBadImageData
+	}
+
+	cfg.Width = int(binary.LittleEndian.Uint16(head[6:]))
+	cfg.Height = int(binary.LittleEndian.Uint16(head[8:]))
+	if err = skipTable(head[10]); err != nil {
+		return cfg, 0, errBadImageData
+	}
+
+	for {
+		if block, err = r.ReadByte(); err != nil {
+			return cfg, 0, errBadImageData
+		}
+
+		switch block {
+		case 0x21: // Extension: a label, then data sub-blocks.
+			if _, err = r.ReadByte(); err == nil {
+				err = skipBlocks()
+			}
+		case 0x2c: // Frame: a descriptor, then LZW coded sub-blocks.
+			if _, err = io.ReadFull(r, desc[:]); err == nil {
+				if err = skipTable(desc[8]); err == nil {
+					if _, err = r.ReadByte(); err == nil {
+						err = skipBlocks()
+					}
+				}
+			}
+			frames++
+		case 0x3b: // Trailer.
+			return cfg, frames, nil
+		default:
+			return cfg, 0, errBadImageData
+		}
+
+		if err != nil {
+			return cfg, 0, errBadImageData
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"testing"
+)
+
+// A GIF of w x h pixels with the given number of (1x1) frames.
+func testGif(w, h uint16, frames int) []byte {
+	var buf bytes.Buffer
+
+	buf.WriteString("GIF89a")
+	binary.Write(&buf, binary.LittleEndian, [2]uint16{w, h})
+	buf.Write([]byte{0x80, 0, 0, 0, 0, 0, 0xff, 0xff, 0xff})
+
+	for i := 0; i < frames; i++ {
+		// A comment, which is skipped like any other extension.
+		buf.Write([]byte{0x21, 0xfe, 0x01, 'x', 0x00})
+		buf.Write([]byte{0x2c, 0, 0, 0, 0, 1, 0, 1, 0, 0})
+		buf.Write([]byte{0x02, 0x02, 0x44, 0x01, 0x00})
+	}
+	buf.WriteByte(0x3b)
+
+	return buf.Bytes()
+}
+
+// The test image (see testImageBase64), claiming to be w x h pixels.
+func testPngOfSize(t *testing.T, w, h uint32) []byte {
+	var (
+		data []byte
+		err  error
+	)
+
+	if data, err = base64.StdEncoding.DecodeString(
+		testImageBase64(t),
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// The IHDR chunk follows the signature, and starts with the size.
+	binary.BigEndian.PutUint32(data[16:], w)
+	binary.BigEndian.PutUint32(data[20:], h)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+
+	return data
+}
+
+func TestCheckImagePixels(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		format string
+		data   []byte
+		err    error
+	}{
+		{"small png", "png", testPngOfSize(t, 4, 4), nil},
+		{"large png", "png", testPngOfSize(t, 10000, 5001), errImagePixels},
+		{"small gif", "gif", testGif(10000, 2000, 10), nil},
+		{"long gif", "gif", testGif(10000, 2000, 11), errImagePixels},
+		{"cut gif", "gif", testGif(4, 4, 2)[:30], errBadImageData},
+	} {
+		err := checkImagePixels(test.format, bytes.NewReader(test.data))
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestDecodeImageChecksPixels(t *testing.T) {
+	var err error
+
+	_, err = decodeImage("png", bytes.NewReader(testPngOfSize(t, 4, 4)))
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	_, err = decodeImage(
+		"png", bytes.NewReader(testPngOfSize(t, 10000, 10000)),
+	)
+	if !errors.Is(err, errImagePixels) {
+		t.Fatalf("got error %v, want %v", err, errImagePixels)
+	}
+
+	_, err = decodeImage("gif", bytes.NewReader(testGif(4, 4, 2)))
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+
+	schema "github.com/clickyotomy/shopify-pe/db"
+)
+
+// A schema migration (see the "db" package), and the one that undoes it.
+type migration struct {
+	version uint64
+	name    string
+	up      string
+	down    string
+}
+
+// Applies the migrations to a database, over a single connection that holds
+// the advisory lock for as long as the migrator is open. The version of the
+// database is kept in "dbMigrationTable"; it is marked dirty while a
+// migration runs, and the migrator refuses to go on from a dirty version
+// until it is fixed by hand (see Force).
+type migrator struct {
+	conn       *sqlx.Conn
+	migrations []migration
+}
+
+// Reads the migrations in a directory, in the order of their versions.
+func loadMigrations(fsys fs.FS) ([]migration, error) {
+	var (
+		entries []fs.DirEntry
+		byVer   = make(map[uint64]*migration)
+		list    []migration
+		err     error
+	)
+
+	if entries, err = fs.ReadDir(fsys, "."); err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		var (
+			name    = entry.Name()
+			body    []byte
+			version uint64
+			parts   []string
+			m       *migration
+			ok      bool
+		)
+
+		if entry.IsDir() || !strings.HasSuffix(name, ".sql") {
+			continue
+		}
+
+		parts = strings.SplitN(strings.TrimSuffix(name, ".sql"), "_", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("bad migration name: %s", name)
+		}
+
+		if version, err = strconv.ParseUint(parts[0], 10, 63); err != nil {
+			return nil, fmt.Errorf("bad migration version: %s", name)
+		}
+		if version == 0 {
+			return nil, fmt.Errorf("bad migration version: %s", name)
+		}
+
+		if body, err = fs.ReadFile(fsys, name); err != nil {
+			return nil, err
+		}
+
+		if m, ok = byVer[version]; !ok {
+			m = &migration{version: version}
+			byVer[version] = m
+		}
+
+		switch {
+		case strings.HasSuffix(parts[1], ".up") && len(m.up) <= 0:
+			m.name = strings.TrimSuffix(parts[1], ".up")
+			m.up = string(body)
+		case strings.HasSuffix(parts[1], ".down") && len(m.down) <= 0:
+			m.down = string(body)
+		default:
+			return nil, fmt.Errorf("bad (or duplicate) migration: %s", name)
+		}
+	}
+
+	for _, m := range byVer {
+		if len(m.up) <= 0 || len(m.down) <= 0 {
+			return nil, fmt.Errorf(
+				"migration %d is missing its up or down file", m.version,
+			)
+		}
+		list = append(list, *m)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].version < list[j].version
+	})
+
+	return list, nil
+}
+
+// Opens a migrator for the embedded migrations; this blocks until no other
+// migrator has the database.
+func newMigrator(db *sqlx.DB) (*migrator, error) {
+	var (
+		m   migrator
+		err error
+	)
+
+	if m.migrations, err = loadMigrations(schema.Migrations); err != nil {
+		return nil, err
+	}
+
+	if m.conn, err = db.Connx(context.Background()); err != nil {
+		return nil, fmt.Errorf("failed to get connection: %w", err)
+	}
+
+	_, err = m.conn.ExecContext(
+		context.Background(), queryAdvisoryLock, migrateLockKey,
+	)
+	if err != nil {
+		m.conn.Close()
+		return nil, fmt.Errorf("failed to take migration lock: %w", err)
+	}
+
+	_, err = m.conn.ExecContext(
+		context.Background(),
+		fmt.Sprintf(queryCreateMigrations, dbMigrationTable),
+	)
+	if err != nil {
+		m.Close()
+		return nil, fmt.Errorf("failed to create version table: %w", err)
+	}
+
+	return &m, nil
+}
+
+func (m *migrator) Close() error {
+	// The lock goes with the connection anyway, should this fail.
+	m.conn.ExecContext(
+		context.Background(), queryAdvisoryUnlock, migrateLockKey,
+	)
+
+	return m.conn.Close()
+}
+
+// Returns the version of the database (0 if no migration has been applied),
+// and whether it is dirty.
+func (m *migrator) Version() (uint64, bool, error) {
+	var (
+		row struct {
+			Version uint64 `db:"version"`
+			Dirty   bool   `db:"dirty"`
+		}
+		err error
+	)
+
+	err = m.conn.GetContext(
+		context.Background(), &row,
+		fmt.Sprintf(queryGetMigration, dbMigrationTable),
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+
+	return row.Version, row.Dirty, err
+}
+
+func setMigrationVersion(dbTx *sqlx.Tx, version uint64, dirty bool) error {
+	var err error
+
+	_, err = dbTx.Exec(fmt.Sprintf(queryClearMigration, dbMigrationTable))
+	if err != nil || (version == 0 && !dirty) {
+		return err
+	}
+
+	_, err = dbTx.Exec(
+		fmt.Sprintf(querySetMigration, dbMigrationTable), version, dirty,
+	)
+
+	return err
+}
+
+// Returns the index of the migration with the given version; the index of
+// the first migration is 0, and version 0 is at -1 (before it).
+func (m *migrator) index(version uint64) (int, error) {
+	if version == 0 {
+		return -1, nil
+	}
+
+	for i := range m.migrations {
+		if m.migrations[i].version == version {
+			return i, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown version %d (of a newer server?)", version)
+}
+
+// Returns the index of the current version, if it is clean.
+func (m *migrator) current() (int, error) {
+	var (
+		version uint64
+		dirty   bool
+		err     error
+	)
+
+	if version, dirty, err = m.Version(); err != nil {
+		return 0, fmt.Errorf("failed to read version: %w", err)
+	}
+
+	if dirty {
+		return 0, fmt.Errorf(
+			"database is dirty at version %d; fix it by hand, and then "+
+				"run \"migrate force <version>\"", version,
+		)
+	}
+
+	return m.index(version)
+}
+
+// Moves the database from one version to another with the SQL of a
+// migration. The SQL is run in a transaction, along with the change of
+// version; the version is marked dirty before, and left that way if the
+// outcome is unknown (e.g., if the connection is lost).
+func (m *migrator) step(from, to uint64, query string) error {
+	var err error
+
+	err = withTx(m.conn, func(dbTx *sqlx.Tx) error {
+		return setMigrationVersion(dbTx, to, true)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to mark version: %w", err)
+	}
+
+	err = withTx(m.conn, func(dbTx *sqlx.Tx) error {
+		var err error
+
+		if _, err = dbTx.Exec(query); err != nil {
+			return err
+		}
+
+		return setMigrationVersion(dbTx, to, false)
+	})
+	if err == nil {
+		return nil
+	}
+
+	// The migration was rolled back, so the database is where it was.
+	if rerr := withTx(m.conn, func(dbTx *sqlx.Tx) error {
+		return setMigrationVersion(dbTx, from, false)
+	}); rerr != nil {
+		return fmt.Errorf("%w (database left dirty: %v)", err, rerr)
+	}
+
+	return err
+}
+
+// Applies up to "n" pending migrations (all of them, if "n" is negative),
+// and returns the number of migrations applied.
+func (m *migrator) Up(n int) (int, error) {
+	var (
+		cur  int
+		from uint64
+		done int
+		err  error
+	)
+
+	if cur, err = m.current(); err != nil {
+		return 0, err
+	}
+
+	for i := cur + 1; i < len(m.migrations) && done != n; i++ {
+		if i > 0 {
+			from = m.migrations[i-1].version
+		}
+
+		err = m.step(from, m.migrations[i].version, m.migrations[i].up)
+		if err != nil {
+			return done, fmt.Errorf(
+				"migration %d (%s) failed: %w",
+				m.migrations[i].version, m.migrations[i].name, err,
+			)
+		}
+
+		log.Printf(
+			"migrate: applied %d (%s)",
+			m.migrations[i].version, m.migrations[i].name,
+		)
+		done++
+	}
+
+	return done, nil
+}
+
+// Undoes up to "n" applied migrations (all of them, if "n" is negative),
+// and returns the number of migrations undone.
+func (m *migrator) Down(n int) (int, error) {
+	var (
+		cur  int
+		to   uint64
+		done int
+		err  error
+	)
+
+	if cur, err = m.current(); err != nil {
+		return 0, err
+	}
+
+	for i := cur; i >= 0 && done != n; i-- {
+		to = 0
+		if i > 0 {
+			to = m.migrations[i-1].version
+		}
+
+		err = m.step(m.migrations[i].version, to, m.migrations[i].down)
+		if err != nil {
+			return done, fmt.Errorf(
+				"migration %d (%s) failed to undo: %w",
+				m.migrations[i].version, m.migrations[i].name, err,
+			)
+		}
+
+		log.Printf(
+			"migrate: undid %d (%s)",
+			m.migrations[i].version, m.migrations[i].name,
+		)
+		done++
+	}
+
+	return done, nil
+}
+
+// Sets the version of the database (marking it clean), without running any
+// migrations; this is for after a dirty version has been fixed by hand.
+func (m *migrator) Force(version uint64) error {
+	var err error
+
+	if _, err = m.index(version); err != nil {
+		return err
+	}
+
+	return withTx(m.conn, func(dbTx *sqlx.Tx) error {
+		return setMigrationVersion(dbTx, version, false)
+	})
+}
+
+// Prints the migrations, and whether they have been applied.
+func (m *migrator) Status() error {
+	var (
+		version uint64
+		dirty   bool
+		state   string
+		err     error
+	)
+
+	if version, dirty, err = m.Version(); err != nil {
+		return fmt.Errorf("failed to read version: %w", err)
+	}
+
+	for _, mig := range m.migrations {
+		switch {
+		case mig.version == version && dirty:
+			state = "dirty"
+		case mig.version <= version:
+			state = "applied"
+		default:
+			state = "pending"
+		}
+		fmt.Printf("%02d\t%-8s%s\n", mig.version, state, mig.name)
+	}
+
+	fmt.Printf("version: %d", version)
+	if dirty {
+		fmt.Printf(" (dirty)")
+	}
+	fmt.Println()
+
+	return nil
+}
+
+func openMigrator(dsn string) (*sqlx.DB, *migrator, error) {
+	var (
+		db  *sqlx.DB
+		m   *migrator
+		err error
+	)
+
+	if db, err = sqlx.Open(dbType, dsn); err != nil {
+		return nil, nil, fmt.Errorf("failed to open connection: %w", err)
+	}
+
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, nil, fmt.Errorf("database ping failed: %w", err)
+	}
+
+	if m, err = newMigrator(db); err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+
+	return db, m, nil
+}
+
+// Applies every pending migration (see "-migrate").
+func migrateUp(dsn string) error {
+	var (
+		db  *sqlx.DB
+		m   *migrator
+		err error
+	)
+
+	if db, m, err = openMigrator(dsn); err != nil {
+		return err
+	}
+	defer db.Close()
+	defer m.Close()
+
+	_, err = m.Up(-1)
+
+	return err
+}
+
+// Runs the "migrate" command: "up [N]" applies all (or N) pending
+// migrations, "down [N]" undoes the last (or the last N) migrations,
+// "status" lists them, and "force VERSION" sets the version.
+func runMigrateCommand(dsn string, args []string) error {
+	var (
+		db      *sqlx.DB
+		m       *migrator
+		n       int
+		version uint64
+		err     error
+	)
+
+	if len(args) <= 0 || len(args) > 2 {
+		return errors.New("usage: migrate up [N] | down [N] | status | " +
+			"force VERSION")
+	}
+
+	switch {
+	case args[0] == "up" || args[0] == "down":
+		n = -1
+		if args[0] == "down" {
+			n = 1
+		}
+
+		if len(args) > 1 {
+			if n, err = strconv.Atoi(args[1]); err != nil || n <= 0 {
+				return fmt.Errorf("bad number of migrations: %s", args[1])
+			}
+		}
+	case args[0] == "status" && len(args) == 1:
+	case args[0] == "force" && len(args) == 2:
+		if version, err = strconv.ParseUint(args[1], 10, 63); err != nil {
+			return fmt.Errorf("bad version: %s", args[1])
+		}
+	default:
+		return fmt.Errorf("bad migrate command: %s", strings.Join(args, " "))
+	}
+
+	if db, m, err = openMigrator(dsn); err != nil {
+		return err
+	}
+	defer db.Close()
+	defer m.Close()
+
+	switch args[0] {
+	case "up":
+		n, err = m.Up(n)
+		log.Printf("migrate: applied %d migration(s)", n)
+	case "down":
+		n, err = m.Down(n)
+		log.Printf("migrate: undid %d migration(s)", n)
+	case "force":
+		err = m.Force(version)
+	case "status":
+		err = m.Status()
+	}
+
+	return err
+}
@@ -0,0 +1,1051 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// InventoryStore on Postgres (see the schema in db/). The statements are
+// prepared once, when the store is created.
+type pgInventoryStore struct {
+	db    *sqlx.DB
+	stmts []*sqlx.Stmt
+
+	addItem             *sqlx.Stmt
+	getItem             *sqlx.Stmt
+	countItems          *sqlx.Stmt
+	searchItems         *sqlx.Stmt
+	countSearch         *sqlx.Stmt
+	updateItem          *sqlx.Stmt
+	adjustStock         *sqlx.Stmt
+	addMovement         *sqlx.Stmt
+	addCountChange      *sqlx.Stmt
+	listMovements       *sqlx.Stmt
+	countMovements      *sqlx.Stmt
+	trashItem           *sqlx.Stmt
+	restoreItem         *sqlx.Stmt
+	listTrash           *sqlx.Stmt
+	countTrash          *sqlx.Stmt
+	deleteItem          *sqlx.Stmt
+	purgeTrash          *sqlx.Stmt
+	itemExists          *sqlx.Stmt
+	itemTrashed         *sqlx.Stmt
+	anyItemExists       *sqlx.Stmt
+	listItemIDs         *sqlx.Stmt
+	addImage            *sqlx.Stmt
+	replaceImage        *sqlx.Stmt
+	clearStaged         *sqlx.Stmt
+	listStagedImages    *sqlx.Stmt
+	listPublishedImages *sqlx.Stmt
+	getPrimaryImage     *sqlx.Stmt
+	getImage            *sqlx.Stmt
+	getImageAt          *sqlx.Stmt
+	listImages          *sqlx.Stmt
+	listImageIDs        *sqlx.Stmt
+	orderImages         *sqlx.Stmt
+	clearPrimary        *sqlx.Stmt
+	setPrimary          *sqlx.Stmt
+	deleteImage         *sqlx.Stmt
+	promoteImage        *sqlx.Stmt
+
+	// By the column to order by, and the order (e.g., "updated_at desc").
+	listItems map[string]*sqlx.Stmt
+}
+
+type pgItemRows struct {
+	*sqlx.Rows
+}
+
+func (r pgItemRows) Scan(item *inventoryRow) error {
+	return r.StructScan(item)
+}
+
+func newPgInventoryStore(dsn string) (*pgInventoryStore, error) {
+	var (
+		s   = &pgInventoryStore{listItems: make(map[string]*sqlx.Stmt)}
+		err error
+	)
+
+	if s.db, err = sqlx.Open(dbType, dsn); err != nil {
+		return nil, fmt.Errorf("failed to open connection: %w", err)
+	}
+
+	if err = s.db.Ping(); err != nil {
+		s.db.Close()
+		return nil, fmt.Errorf("database ping failed: %w", err)
+	}
+
+	if err = s.prepare(); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *pgInventoryStore) prepare() error {
+	var (
+		stmts = []struct {
+			stmt  **sqlx.Stmt
+			query string
+		}{
+			{&s.addItem, fmt.Sprintf(queryAddItem, dbTable)},
+			{&s.getItem, fmt.Sprintf(queryGetItem, dbTable)},
+			{&s.countItems, fmt.Sprintf(queryCountItems, dbTable)},
+			{&s.searchItems, fmt.Sprintf(
+				querySearchItems, dbTable, searchDocument, searchConfig,
+			)},
+			{&s.countSearch, fmt.Sprintf(
+				queryCountSearch, dbTable, searchDocument, searchConfig,
+			)},
+			{&s.updateItem, fmt.Sprintf(queryUpdateItem, dbTable)},
+			{&s.adjustStock, fmt.Sprintf(queryAdjustStock, dbTable)},
+			{&s.addMovement, fmt.Sprintf(queryAddMovement, dbMovementTable)},
+			{&s.addCountChange, fmt.Sprintf(
+				queryAddCountChange, dbMovementTable, dbTable,
+			)},
+			{&s.listMovements, fmt.Sprintf(
+				queryListMovements, dbMovementTable,
+			)},
+			{&s.countMovements, fmt.Sprintf(
+				queryCountMovements, dbMovementTable,
+			)},
+			{&s.trashItem, fmt.Sprintf(queryTrashItem, dbTable)},
+			{&s.restoreItem, fmt.Sprintf(queryRestoreItem, dbTable)},
+			{&s.listTrash, fmt.Sprintf(queryListTrash, dbTable)},
+			{&s.countTrash, fmt.Sprintf(queryCountTrash, dbTable)},
+			{&s.deleteItem, fmt.Sprintf(queryDeleteItem, dbTable)},
+			{&s.purgeTrash, fmt.Sprintf(queryPurgeTrash, dbTable)},
+			{&s.itemExists, fmt.Sprintf(queryItemExists, dbTable)},
+			{&s.itemTrashed, fmt.Sprintf(queryItemTrashed, dbTable)},
+			{&s.anyItemExists, fmt.Sprintf(queryAnyItemExists, dbTable)},
+			{&s.listItemIDs, fmt.Sprintf(queryListItemIDs, dbTable)},
+			{&s.addImage, fmt.Sprintf(
+				queryAddImage, dbImageTable, dbImageTable,
+			)},
+			{&s.replaceImage, fmt.Sprintf(queryReplaceImage, dbImageTable)},
+			{&s.clearStaged, fmt.Sprintf(queryClearStaged, dbImageTable)},
+			{&s.listStagedImages, fmt.Sprintf(
+				queryListStagedImages, dbImageTable,
+			)},
+			{&s.listPublishedImages, fmt.Sprintf(
+				queryListPublishedImages, dbImageTable,
+			)},
+			{&s.getPrimaryImage, fmt.Sprintf(
+				queryGetPrimaryImage, dbImageTable, dbTable,
+			)},
+			{&s.getImage, fmt.Sprintf(
+				queryGetImage, dbImageTable, dbTable,
+			)},
+			{&s.getImageAt, fmt.Sprintf(
+				queryGetImageAt, dbImageTable, dbTable,
+			)},
+			{&s.listImages, fmt.Sprintf(queryListImages, dbImageTable)},
+			{&s.listImageIDs, fmt.Sprintf(queryListImageIDs, dbImageTable)},
+			{&s.orderImages, fmt.Sprintf(queryOrderImages, dbImageTable)},
+			{&s.clearPrimary, fmt.Sprintf(queryClearPrimary, dbImageTable)},
+			{&s.setPrimary, fmt.Sprintf(querySetPrimary, dbImageTable)},
+			{&s.deleteImage, fmt.Sprintf(queryDeleteImage, dbImageTable)},
+			{&s.promoteImage, fmt.Sprintf(queryPromoteImage, dbImageTable)},
+		}
+		stmt *sqlx.Stmt
+		err  error
+	)
+
+	for _, st := range stmts {
+		if *st.stmt, err = s.prepareStmt(st.query); err != nil {
+			return err
+		}
+	}
+
+	// The column and the order cannot be parameters, so there is a list
+	// statement for each of them.
+	for _, orderBy := range []string{"created_at", "updated_at"} {
+		for order, op := range map[string]string{"asc": ">", "desc": "<"} {
+			stmt, err = s.prepareStmt(fmt.Sprintf(
+				queryListItems, dbTable, orderBy, order, op,
+			))
+			if err != nil {
+				return err
+			}
+			s.listItems[orderBy+" "+order] = stmt
+		}
+	}
+
+	return nil
+}
+
+func (s *pgInventoryStore) prepareStmt(query string) (*sqlx.Stmt, error) {
+	var (
+		stmt *sqlx.Stmt
+		err  error
+	)
+
+	if stmt, err = s.db.Preparex(query); err != nil {
+		return nil, fmt.Errorf("prepare failed: %q: %w", query, err)
+	}
+	s.stmts = append(s.stmts, stmt)
+
+	return stmt, nil
+}
+
+func (s *pgInventoryStore) Close() error {
+	for _, stmt := range s.stmts {
+		stmt.Close()
+	}
+
+	return s.db.Close()
+}
+
+// Returns the "If-Match" condition of a write, as a parameter for the
+// queries that take one; NULL matches any version.
+func pgIfMatch(w itemWrite) interface{} {
+	if !w.IfMatch {
+		return nil
+	}
+
+	// An empty array matches no version, unlike a nil one (which is NULL).
+	if w.Versions == nil {
+		return pq.Int64Array{}
+	}
+
+	return pq.Int64Array(w.Versions)
+}
+
+// Returns the parameters of "queryListFilter".
+func pgListFilter(filter *listFilter) []interface{} {
+	var brand interface{}
+
+	if len(filter.Brand) > 0 {
+		brand = filter.Brand
+	}
+
+	return []interface{}{
+		brand, filter.MinPrice, filter.MaxPrice,
+		filter.MinCount, filter.MaxCount,
+	}
+}
+
+// Tells a failed precondition apart from a missing item, for writes that
+// matched no rows; "exists" is the statement that tells whether the item
+// is there to write to (see "queryItemExists").
+func (s *pgInventoryStore) noRowsError(dbTx *sqlx.Tx, exists *sqlx.Stmt,
+	itemID string) error {
+
+	var (
+		found bool
+		err   error
+	)
+
+	if err = dbTx.Stmtx(exists).Get(&found, itemID); err != nil {
+		return fmt.Errorf("query failed: %w", err)
+	}
+
+	if found {
+		return errVersionMismatch
+	}
+
+	return errItemNotFound
+}
+
+// Changes the fields of an item, and bumps its version; with an empty
+// change, this just locks the row of the item for the rest of the
+// transaction (e.g., so that concurrent changes to the images of the item
+// do not interleave).
+func (s *pgInventoryStore) update(dbTx *sqlx.Tx, itemID string,
+	change *itemChange, w itemWrite) error {
+
+	var (
+		row itemData
+		err error
+	)
+
+	err = dbTx.Stmtx(s.updateItem).QueryRowx(
+		change.ItemCount, change.ItemPrice, change.ItemCurrency,
+		change.ItemBrand, change.ItemName, change.ItemDesc, w.At, itemID,
+		pgIfMatch(w),
+	).StructScan(&row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return s.noRowsError(dbTx, s.itemExists, itemID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update row: %w", err)
+	}
+
+	// The transaction is rolled back if the price does not suit.
+	if change.ItemPrice != nil || change.ItemCurrency != nil {
+		return checkPrice(row.ItemPrice, row.ItemCurrency)
+	}
+
+	return nil
+}
+
+func (s *pgInventoryStore) addItemTx(dbTx *sqlx.Tx, item *inventoryRow,
+	staged string, meta imageMeta, actor string) (imageRow, error) {
+
+	var (
+		image imageRow
+		err   error
+	)
+
+	_, err = dbTx.Stmtx(s.addItem).Exec(
+		item.ItemID, item.CreatedAt, item.UpdatedAt, item.ItemCount,
+		item.ItemPrice, item.ItemCurrency, item.ItemBrand, item.ItemName,
+		item.ItemDesc,
+	)
+	if err != nil {
+		return image, fmt.Errorf("failed to insert row: %w", err)
+	}
+
+	if len(staged) > 0 {
+		image, err = s.addImageTx(
+			dbTx, item.ItemID, staged, meta, item.CreatedAt,
+		)
+		if err != nil {
+			return image, err
+		}
+	}
+
+	if item.ItemCount > 0 {
+		_, err = dbTx.Stmtx(s.addMovement).Exec(
+			item.ItemID, int64(item.ItemCount), initialStockReason, actor,
+			item.CreatedAt,
+		)
+		if err != nil {
+			return image, fmt.Errorf("failed to record movement: %w", err)
+		}
+	}
+
+	return image, nil
+}
+
+func (s *pgInventoryStore) AddItem(item inventoryRow, staged string,
+	meta imageMeta, actor string) (imageRow, error) {
+
+	var image imageRow
+
+	err := withTx(s.db, func(dbTx *sqlx.Tx) error {
+		var err error
+
+		image, err = s.addItemTx(dbTx, &item, staged, meta, actor)
+
+		return err
+	})
+
+	return image, err
+}
+
+// Each item is added under a savepoint, so that an item that fails is
+// rolled back on its own, and the rest of the batch is still committed.
+func (s *pgInventoryStore) ImportItems(batch []importItem,
+	actor string) ([]error, error) {
+
+	var errs = make([]error, len(batch))
+
+	err := withTx(s.db, func(dbTx *sqlx.Tx) error {
+		var err error
+
+		for i := range batch {
+			if _, err = dbTx.Exec(queryImportSavepoint); err != nil {
+				return err
+			}
+
+			batch[i].image, err = s.addItemTx(
+				dbTx, &batch[i].inventoryRow, batch[i].imgStaged,
+				batch[i].imgMeta, actor,
+			)
+			if err != nil {
+				errs[i] = err
+				if _, err = dbTx.Exec(queryImportRollback); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if _, err = dbTx.Exec(queryImportRelease); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return errs, err
+}
+
+func (s *pgInventoryStore) GetItem(itemID string) (inventoryRow, error) {
+	var (
+		item inventoryRow
+		err  error
+	)
+
+	if err = s.getItem.Get(&item, itemID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return item, errItemNotFound
+		}
+		return item, err
+	}
+
+	item.Image = &imageRow{}
+	if err = s.getPrimaryImage.Get(item.Image, itemID); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return item, err
+		}
+		item.Image = nil
+	}
+
+	return item, nil
+}
+
+func (s *pgInventoryStore) ListItems(filter *listFilter, limit uint,
+	cur *listCursor) ([]inventoryRow, int64, error) {
+
+	var (
+		rows  = []inventoryRow{}
+		total int64
+		args  = pgListFilter(filter)
+		stmt  *sqlx.Stmt
+		ok    bool
+		err   error
+	)
+
+	if stmt, ok = s.listItems[filter.OrderBy+" "+filter.Order]; !ok {
+		return nil, 0, fmt.Errorf("bad list order: %s %s",
+			filter.OrderBy, filter.Order)
+	}
+
+	if err = s.countItems.Get(&total, args...); err != nil {
+		return nil, 0, err
+	}
+
+	if cur != nil {
+		args = append(args, cur.At, cur.ID, limit)
+	} else {
+		args = append(args, nil, nil, limit)
+	}
+
+	if err = stmt.Select(&rows, args...); err != nil {
+		return nil, 0, err
+	}
+
+	return rows, total, nil
+}
+
+func (s *pgInventoryStore) ExportItems(filter *listFilter) (itemRows, error) {
+	var (
+		rows *sqlx.Rows
+		stmt *sqlx.Stmt
+		ok   bool
+		err  error
+	)
+
+	if stmt, ok = s.listItems[filter.OrderBy+" "+filter.Order]; !ok {
+		return nil, fmt.Errorf("bad list order: %s %s",
+			filter.OrderBy, filter.Order)
+	}
+
+	// Without a cursor, or a limit.
+	rows, err = stmt.Queryx(append(pgListFilter(filter), nil, nil, nil)...)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgItemRows{rows}, nil
+}
+
+func (s *pgInventoryStore) SearchItems(terms []string, prefix bool,
+	limit uint, offset uint64) ([]searchRow, int64, error) {
+
+	var (
+		rows    = []searchRow{}
+		total   int64
+		tsQuery string
+		err     error
+	)
+
+	if prefix {
+		tsQuery = strings.Join(terms, ":* & ") + ":*"
+	} else {
+		tsQuery = strings.Join(terms, " & ")
+	}
+
+	if err = s.countSearch.Get(&total, tsQuery); err != nil {
+		return nil, 0, err
+	}
+
+	err = s.searchItems.Select(&rows, tsQuery, limit, offset, searchHlOpts)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for i := range rows {
+		rows[i].NameHl = markHighlights(rows[i].NameHl)
+		rows[i].BrandHl = markHighlights(rows[i].BrandHl)
+		rows[i].DescHl = markHighlights(rows[i].DescHl)
+	}
+
+	return rows, total, nil
+}
+
+func (s *pgInventoryStore) UpdateItem(itemID string, change itemChange,
+	w itemWrite) (imageRow, error) {
+
+	var image imageRow
+
+	err := withTx(s.db, func(dbTx *sqlx.Tx) error {
+		var err error
+
+		// Record the change in count before it is overwritten.
+		if change.ItemCount != nil {
+			_, err = dbTx.Stmtx(s.addCountChange).Exec(
+				itemID, *change.ItemCount, defaultStockReason, w.Actor,
+				w.At,
+			)
+			if err != nil {
+				return fmt.Errorf("failed to record movement: %w", err)
+			}
+		}
+
+		if err = s.update(dbTx, itemID, &change, w); err != nil {
+			return err
+		}
+
+		if len(change.Staged) > 0 {
+			image, err = s.replacePrimaryImage(
+				dbTx, itemID, change.Staged, change.Meta, w.At,
+			)
+			if err != nil {
+				return fmt.Errorf("failed to fetch primary image: %w", err)
+			}
+		}
+
+		return nil
+	})
+
+	return image, err
+}
+
+func (s *pgInventoryStore) AdjustStock(itemID string, delta int64,
+	reason string, w itemWrite) (uint64, error) {
+
+	var count uint64
+
+	err := withTx(s.db, func(dbTx *sqlx.Tx) error {
+		var (
+			item inventoryRow
+			err  error
+		)
+
+		// The delta is applied relative to the current count in the
+		// database so that concurrent adjustments do not overwrite each
+		// other.
+		err = dbTx.Stmtx(s.adjustStock).Get(
+			&count, delta, w.At, itemID, pgIfMatch(w),
+		)
+		if errors.Is(err, sql.ErrNoRows) {
+			err = dbTx.Stmtx(s.getItem).Get(&item, itemID)
+			if errors.Is(err, sql.ErrNoRows) {
+				return errItemNotFound
+			}
+			if err != nil {
+				return fmt.Errorf("query failed: %w", err)
+			}
+
+			if !matchVersion(&item, w) {
+				return errVersionMismatch
+			}
+
+			if int64(item.ItemCount)+delta > maxItemCount {
+				return errStockOverflow
+			}
+
+			return errInsufficientStock
+		}
+		if err != nil {
+			return fmt.Errorf("failed to update row: %w", err)
+		}
+
+		_, err = dbTx.Stmtx(s.addMovement).Exec(
+			itemID, delta, reason, w.Actor, w.At,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to record movement: %w", err)
+		}
+
+		return nil
+	})
+
+	return count, err
+}
+
+func (s *pgInventoryStore) ListMovements(itemID string, before uint64,
+	limit uint) ([]stockMovement, int64, error) {
+
+	var (
+		rows  = []stockMovement{}
+		total int64
+		err   error
+	)
+
+	if err = s.countMovements.Get(&total, itemID); err != nil {
+		return nil, 0, err
+	}
+
+	if err = s.listMovements.Select(&rows, itemID, before, limit); err != nil {
+		return nil, 0, err
+	}
+
+	return rows, total, nil
+}
+
+// Runs a statement that changes a single item, with "If-Match" (see
+// noRowsError for "exists").
+func (s *pgInventoryStore) writeItem(stmt, exists *sqlx.Stmt, itemID string,
+	args ...interface{}) error {
+
+	return withTx(s.db, func(dbTx *sqlx.Tx) error {
+		var (
+			dbRes sql.Result
+			tmp   int64
+			err   error
+		)
+
+		if dbRes, err = dbTx.Stmtx(stmt).Exec(args...); err != nil {
+			return fmt.Errorf("failed to update row: %w", err)
+		}
+
+		if tmp, err = dbRes.RowsAffected(); err != nil {
+			return fmt.Errorf("failed to fetch query result: %w", err)
+		}
+
+		if tmp <= 0 {
+			return s.noRowsError(dbTx, exists, itemID)
+		}
+
+		return nil
+	})
+}
+
+func (s *pgInventoryStore) TrashItem(itemID string, w itemWrite) error {
+	return s.writeItem(
+		s.trashItem, s.itemExists, itemID, w.At, itemID, pgIfMatch(w),
+	)
+}
+
+func (s *pgInventoryStore) RestoreItem(itemID string, w itemWrite) error {
+	return withTx(s.db, func(dbTx *sqlx.Tx) error {
+		var (
+			dbRes   sql.Result
+			tmp     int64
+			trashed bool
+			err     error
+		)
+
+		dbRes, err = dbTx.Stmtx(s.restoreItem).Exec(w.At, itemID, pgIfMatch(w))
+		if err != nil {
+			return fmt.Errorf("failed to update row: %w", err)
+		}
+
+		if tmp, err = dbRes.RowsAffected(); err != nil {
+			return fmt.Errorf("failed to fetch query result: %w", err)
+		}
+
+		if tmp > 0 {
+			return nil
+		}
+
+		if err = dbTx.Stmtx(s.itemTrashed).Get(&trashed, itemID); err != nil {
+			return fmt.Errorf("query failed: %w", err)
+		}
+
+		if trashed {
+			return errVersionMismatch
+		}
+
+		return errItemNotInTrash
+	})
+}
+
+func (s *pgInventoryStore) ListTrash(cur *listCursor,
+	limit uint) ([]inventoryRow, int64, error) {
+
+	var (
+		rows  = []inventoryRow{}
+		total int64
+		curAt *time.Time
+		curID *string
+		err   error
+	)
+
+	if err = s.countTrash.Get(&total); err != nil {
+		return nil, 0, err
+	}
+
+	if cur != nil {
+		curAt, curID = &cur.At, &cur.ID
+	}
+
+	if err = s.listTrash.Select(&rows, curAt, curID, limit); err != nil {
+		return nil, 0, err
+	}
+
+	return rows, total, nil
+}
+
+func (s *pgInventoryStore) DeleteItem(itemID string, w itemWrite) error {
+	// Trashed items can be deleted too.
+	return s.writeItem(
+		s.deleteItem, s.anyItemExists, itemID, itemID, pgIfMatch(w),
+	)
+}
+
+func (s *pgInventoryStore) PurgeTrash(before time.Time) ([]string, error) {
+	var (
+		itemIDs []string
+		err     error
+	)
+
+	if err = s.purgeTrash.Select(&itemIDs, before); err != nil {
+		return nil, err
+	}
+
+	return itemIDs, nil
+}
+
+func (s *pgInventoryStore) ItemIDs() ([]string, error) {
+	var (
+		itemIDs []string
+		err     error
+	)
+
+	if err = s.listItemIDs.Select(&itemIDs); err != nil {
+		return nil, err
+	}
+
+	return itemIDs, nil
+}
+
+func (s *pgInventoryStore) addImageTx(dbTx *sqlx.Tx, itemID, staged string,
+	meta imageMeta, at time.Time) (imageRow, error) {
+
+	var (
+		image imageRow
+		id    = genItemHash()
+		err   error
+	)
+
+	err = dbTx.Stmtx(s.addImage).Get(
+		&image, id, itemID, imgImagePrefix+id, at,
+		meta.Width, meta.Height, meta.Size, meta.MIMEType, staged,
+	)
+	if err != nil {
+		return image, fmt.Errorf("failed to insert image row: %w", err)
+	}
+
+	return image, nil
+}
+
+// Returns the primary image of an item (updated for the staged upload that
+// is to replace it), adding one if the item has no images yet.
+func (s *pgInventoryStore) replacePrimaryImage(dbTx *sqlx.Tx, itemID,
+	staged string, meta imageMeta, at time.Time) (imageRow, error) {
+
+	var (
+		image imageRow
+		err   error
+	)
+
+	err = dbTx.Stmtx(s.getPrimaryImage).Get(&image, itemID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return s.addImageTx(dbTx, itemID, staged, meta, at)
+	}
+	if err != nil {
+		return image, err
+	}
+
+	err = dbTx.Stmtx(s.replaceImage).Get(
+		&image, itemID, image.ImageID,
+		meta.Width, meta.Height, meta.Size, meta.MIMEType, staged,
+	)
+
+	return image, err
+}
+
+func (s *pgInventoryStore) AddImage(itemID, staged string, meta imageMeta,
+	w itemWrite) (imageRow, error) {
+
+	var image imageRow
+
+	err := withTx(s.db, func(dbTx *sqlx.Tx) error {
+		var err error
+
+		if err = s.update(dbTx, itemID, &itemChange{}, w); err != nil {
+			return err
+		}
+
+		image, err = s.addImageTx(dbTx, itemID, staged, meta, w.At)
+
+		return err
+	})
+
+	return image, err
+}
+
+func (s *pgInventoryStore) getImageRow(stmt *sqlx.Stmt,
+	args ...interface{}) (imageRow, error) {
+
+	var (
+		image imageRow
+		err   error
+	)
+
+	if err = stmt.Get(&image, args...); errors.Is(err, sql.ErrNoRows) {
+		return image, errNoSuchImage
+	}
+
+	return image, err
+}
+
+func (s *pgInventoryStore) GetImage(itemID, imageID string) (imageRow, error) {
+	return s.getImageRow(s.getImage, itemID, imageID)
+}
+
+func (s *pgInventoryStore) GetImageAt(itemID string,
+	index uint) (imageRow, error) {
+
+	return s.getImageRow(s.getImageAt, itemID, index)
+}
+
+func (s *pgInventoryStore) GetPrimaryImage(itemID string) (imageRow, error) {
+	return s.getImageRow(s.getPrimaryImage, itemID)
+}
+
+func (s *pgInventoryStore) ListImages(itemID string) ([]imageRow, error) {
+	var (
+		images = []imageRow{}
+		exists bool
+		err    error
+	)
+
+	if err = s.itemExists.Get(&exists, itemID); err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		return nil, errItemNotFound
+	}
+
+	if err = s.listImages.Select(&images, itemID); err != nil {
+		return nil, err
+	}
+
+	return images, nil
+}
+
+func (s *pgInventoryStore) OrderImages(itemID string, imageIDs []string,
+	w itemWrite) ([]imageRow, error) {
+
+	var images = []imageRow{}
+
+	err := withTx(s.db, func(dbTx *sqlx.Tx) error {
+		var (
+			ids  []string
+			seen = make(map[string]bool)
+			err  error
+		)
+
+		if err = s.update(dbTx, itemID, &itemChange{}, w); err != nil {
+			return err
+		}
+
+		if err = dbTx.Stmtx(s.listImageIDs).Select(&ids, itemID); err != nil {
+			return fmt.Errorf("query failed: %w", err)
+		}
+
+		// The new order has to list every image of the item, exactly once.
+		for _, id := range ids {
+			seen[id] = false
+		}
+		for _, id := range imageIDs {
+			if done, ok := seen[id]; !ok || done {
+				return errBadImageOrder
+			}
+			seen[id] = true
+		}
+		if len(imageIDs) != len(ids) {
+			return errBadImageOrder
+		}
+
+		_, err = dbTx.Stmtx(s.orderImages).Exec(
+			itemID, pq.StringArray(imageIDs),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to update rows: %w", err)
+		}
+
+		err = dbTx.Stmtx(s.listImages).Select(&images, itemID)
+		if err != nil {
+			return fmt.Errorf("query failed: %w", err)
+		}
+
+		return nil
+	})
+
+	return images, err
+}
+
+func (s *pgInventoryStore) SetPrimaryImage(itemID, imageID string,
+	w itemWrite) (imageRow, error) {
+
+	var image imageRow
+
+	err := withTx(s.db, func(dbTx *sqlx.Tx) error {
+		var err error
+
+		if err = s.update(dbTx, itemID, &itemChange{}, w); err != nil {
+			return err
+		}
+
+		// The unique index on the primary image is not deferred, so the old
+		// primary has to be cleared before the new one is set.
+		_, err = dbTx.Stmtx(s.clearPrimary).Exec(itemID)
+		if err == nil {
+			err = dbTx.Stmtx(s.setPrimary).Get(&image, itemID, imageID)
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			return errNoSuchImage
+		}
+		if err != nil {
+			return fmt.Errorf("failed to update rows: %w", err)
+		}
+
+		return nil
+	})
+
+	return image, err
+}
+
+func (s *pgInventoryStore) removeImageTx(dbTx *sqlx.Tx, itemID,
+	imageID string) (imageRow, error) {
+
+	var (
+		image imageRow
+		err   error
+	)
+
+	err = dbTx.Stmtx(s.deleteImage).Get(&image, itemID, imageID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return image, errNoSuchImage
+	}
+	if err != nil {
+		return image, fmt.Errorf("failed to delete row: %w", err)
+	}
+
+	// The first of the remaining images (if any) takes over as primary.
+	if image.Primary {
+		if _, err = dbTx.Stmtx(s.promoteImage).Exec(itemID); err != nil {
+			return image, fmt.Errorf("failed to update rows: %w", err)
+		}
+	}
+
+	return image, nil
+}
+
+func (s *pgInventoryStore) DeleteImage(itemID, imageID string,
+	w itemWrite) (imageRow, error) {
+
+	var image imageRow
+
+	err := withTx(s.db, func(dbTx *sqlx.Tx) error {
+		var err error
+
+		if err = s.update(dbTx, itemID, &itemChange{}, w); err != nil {
+			return err
+		}
+
+		image, err = s.removeImageTx(dbTx, itemID, imageID)
+
+		return err
+	})
+
+	return image, err
+}
+
+func (s *pgInventoryStore) RemoveImage(itemID, imageID string) error {
+	return withTx(s.db, func(dbTx *sqlx.Tx) error {
+		_, err := s.removeImageTx(dbTx, itemID, imageID)
+
+		return err
+	})
+}
+
+func (s *pgInventoryStore) ClearStagedImage(imageID, staged string) error {
+	_, err := s.clearStaged.Exec(imageID, staged)
+
+	return err
+}
+
+func (s *pgInventoryStore) ListStagedImages() ([]imageRow, error) {
+	var (
+		images []imageRow
+		err    error
+	)
+
+	if err = s.listStagedImages.Select(&images); err != nil {
+		return nil, err
+	}
+
+	return images, nil
+}
+
+func (s *pgInventoryStore) ListPublishedImages() ([]imageRow, error) {
+	var (
+		images []imageRow
+		err    error
+	)
+
+	if err = s.listPublishedImages.Select(&images); err != nil {
+		return nil, err
+	}
+
+	return images, nil
+}
+
+// The lock is a session-level advisory lock, held on a connection of its own
+// for as long as "fn" runs.
+func (s *pgInventoryStore) TryExclusive(key int64,
+	fn func() error) (bool, error) {
+
+	var (
+		conn   *sqlx.Conn
+		locked bool
+		err    error
+	)
+
+	if conn, err = s.db.Connx(context.Background()); err != nil {
+		return false, fmt.Errorf("failed to get connection: %w", err)
+	}
+	defer conn.Close()
+
+	err = conn.GetContext(
+		context.Background(), &locked, queryAdvisoryTryLock, key,
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to take lock: %w", err)
+	}
+
+	if !locked {
+		return false, nil
+	}
+
+	defer conn.ExecContext(context.Background(), queryAdvisoryUnlock, key)
+
+	return true, fn()
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+// An exact decimal price, as a number of ten-thousandths (see
+// "priceDigits"); it is written out as a decimal (e.g., 19.99), and never
+// goes through a float.
+type price struct {
+	units int64
+}
+
+// Parses a decimal price (e.g., "19.99"); exponents are not allowed, and
+// neither are digits past "priceDigits" (unless they are zeros).
+func parsePrice(text string) (price, error) {
+	var (
+		p        price
+		neg      bool
+		whole    string
+		frac     string
+		hasPoint bool
+	)
+
+	text = strings.TrimSpace(text)
+	if strings.HasPrefix(text, "-") {
+		neg, text = true, text[1:]
+	}
+
+	whole, frac = text, ""
+	if i := strings.IndexByte(text, '.'); i >= 0 {
+		whole, frac, hasPoint = text[:i], text[i+1:], true
+	}
+
+	if len(whole)+len(frac) <= 0 || (hasPoint && len(frac) <= 0) {
+		return p, fmt.Errorf("bad price: %q", text)
+	}
+
+	frac = strings.TrimRight(frac, "0")
+	if len(frac) > priceDigits {
+		return p, fmt.Errorf(
+			"bad price: more than %d decimal places: %q", priceDigits, text,
+		)
+	}
+
+	frac += strings.Repeat("0", priceDigits-len(frac))
+
+	for _, c := range whole + frac {
+		if c < '0' || c > '9' {
+			return p, fmt.Errorf("bad price: %q", text)
+		}
+
+		if p.units > (maxPriceUnits-int64(c-'0'))/10 {
+			return p, fmt.Errorf("bad price: out of range: %q", text)
+		}
+
+		p.units = p.units*10 + int64(c-'0')
+	}
+
+	if neg {
+		p.units = -p.units
+	}
+
+	return p, nil
+}
+
+func (p price) String() string {
+	var (
+		units = p.units
+		sign  string
+		whole string
+		frac  string
+	)
+
+	if units < 0 {
+		sign, units = "-", -units
+	}
+
+	whole = fmt.Sprintf("%0*d", priceDigits+1, units)
+	whole, frac = whole[:len(whole)-priceDigits], whole[len(whole)-priceDigits:]
+
+	if frac = strings.TrimRight(frac, "0"); len(frac) > 0 {
+		return sign + whole + "." + frac
+	}
+
+	return sign + whole
+}
+
+// Prices are written out as JSON numbers, with exactly their digits.
+func (p price) MarshalJSON() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// Prices are read from JSON numbers or strings (and from form values,
+// which gin hands over as they are).
+func (p *price) UnmarshalJSON(data []byte) error {
+	var (
+		text string
+		err  error
+	)
+
+	if string(data) == "null" {
+		return nil
+	}
+
+	text = string(data)
+	if strings.HasPrefix(text, `"`) {
+		if err = json.Unmarshal(data, &text); err != nil {
+			return err
+		}
+	}
+
+	*p, err = parsePrice(text)
+
+	return err
+}
+
+func (p *price) Scan(src interface{}) error {
+	var err error
+
+	switch src := src.(type) {
+	case []byte:
+		*p, err = parsePrice(string(src))
+	case string:
+		*p, err = parsePrice(src)
+	default:
+		err = fmt.Errorf("bad price: unsupported type: %T", src)
+	}
+
+	return err
+}
+
+func (p price) Value() (driver.Value, error) {
+	return p.String(), nil
+}
+
+// Checks that a price is in whole minor units of its currency (e.g., no
+// fractions of a yen).
+func checkPrice(p price, currency string) error {
+	var (
+		digits int
+		step   int64 = 1
+		ok     bool
+	)
+
+	if digits, ok = currencyDigits[currency]; !ok {
+		return fmt.Errorf("%w: %q", errUnknownCurrency, currency)
+	}
+
+	for i := digits; i < priceDigits; i++ {
+		step *= 10
+	}
+
+	if p.units%step != 0 {
+		return fmt.Errorf(
+			"%w: %s %s (at most %d decimal places)",
+			errPricePrecision, p, currency, digits,
+		)
+	}
+
+	return nil
+}
+
+// Fills in the default currency of an item (or puts its code in upper
+// case), and checks its price.
+func checkItemPrice(item *itemData) error {
+	if len(item.ItemCurrency) <= 0 {
+		item.ItemCurrency = defaultCurrency
+	}
+	item.ItemCurrency = strings.ToUpper(item.ItemCurrency)
+
+	return checkPrice(item.ItemPrice, item.ItemCurrency)
+}
+
+// Lets binding tags (e.g., "required") check prices by their value, which
+// the validator would skip otherwise (as it does for any struct).
+func registerPriceBinding() error {
+	var (
+		v  *validator.Validate
+		ok bool
+	)
+
+	if v, ok = binding.Validator.Engine().(*validator.Validate); !ok {
+		return errors.New("unsupported validator")
+	}
+
+	v.RegisterCustomTypeFunc(func(field reflect.Value) interface{} {
+		if p, ok := field.Interface().(price); ok {
+			return p.units
+		}
+
+		return nil
+	}, price{})
+
+	return nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+)
+
+// Repairs what a crash can leave behind between the database and the image
+// store. Uploads are staged in the store before the transaction that adds
+// (or updates) their rows commits, and published after, so a crash can
+// leave:
+//   - rows for uploads that were committed, but not published: these are
+//     published now, from their staged names.
+//   - staged (or half-written) uploads of transactions that never
+//     committed: these are deleted.
+//   - images of items (or of images) that no longer exist (e.g., when an
+//     item is purged, its row is deleted before its images): these are
+//     deleted.
+//   - rows for images that are not in the store (e.g., if publishing an
+//     upload failed): these are deleted, and another image of the item is
+//     made primary if needed.
+//
+// This is to be run at start-up, before any requests are served. Other
+// servers may share the stores, and be in the middle of uploads, so images
+// written less than "grace" ago (which may not be committed, or published,
+// yet) are left alone, and only one server reconciles at a time.
+func reconcileImages(inv InventoryStore, store ImageStore,
+	grace time.Duration) error {
+
+	var (
+		locked bool
+		err    error
+	)
+
+	locked, err = inv.TryExclusive(reconcileLockKey, func() error {
+		return reconcile(inv, store, grace)
+	})
+	if err == nil && !locked {
+		log.Printf("reconcile: skipped; another server is reconciling")
+	}
+
+	return err
+}
+
+// Tells whether an image was written more than "grace" ago (false if it is
+// gone).
+func isSettledImage(store ImageStore, itemID, name string,
+	grace time.Duration) (bool, error) {
+
+	var (
+		info imageInfo
+		err  error
+	)
+
+	info, err = store.Stat(itemID, name)
+	if errors.Is(err, errImageNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return time.Since(info.ModTime) > grace, nil
+}
+
+// Tells whether every image of an item is settled.
+func isSettledItem(store ImageStore, itemID string,
+	grace time.Duration) (bool, error) {
+
+	var (
+		names   []string
+		settled bool
+		err     error
+	)
+
+	if names, err = store.List(itemID, ""); err != nil {
+		return false, err
+	}
+
+	for _, name := range names {
+		settled, err = isSettledImage(store, itemID, name, grace)
+		if err != nil || !settled {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+func reconcile(inv InventoryStore, store ImageStore,
+	grace time.Duration) error {
+
+	var (
+		staged    []imageRow
+		images    []imageRow
+		itemIDs   []string
+		known     = make(map[string]map[string]bool)
+		names     []string
+		settled   bool
+		published int
+		removed   int
+		orphans   int
+		skipped   int
+		err       error
+	)
+
+	// Finish publishing the uploads that were committed.
+	if staged, err = inv.ListStagedImages(); err != nil {
+		return err
+	}
+
+	for _, image := range staged {
+		var info imageInfo
+
+		info, err = store.Stat(image.ItemID, *image.Staged)
+		if err != nil && !errors.Is(err, errImageNotFound) {
+			return err
+		}
+
+		// Without the staged upload, there is nothing to publish; the row
+		// is dealt with below, along with other rows without images. A
+		// recent upload may be being published by another server.
+		switch {
+		case errors.Is(err, errImageNotFound):
+			err = inv.ClearStagedImage(image.ImageID, *image.Staged)
+		case time.Since(info.ModTime) <= grace:
+			skipped++
+		default:
+			err = publishItemImage(inv, store, image, *image.Staged)
+			published++
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if itemIDs, err = inv.ItemIDs(); err != nil {
+		return err
+	}
+
+	for _, itemID := range itemIDs {
+		known[itemID] = make(map[string]bool)
+	}
+
+	if images, err = inv.ListPublishedImages(); err != nil {
+		return err
+	}
+
+	for _, image := range images {
+		known[image.ItemID][image.ImageName] = true
+	}
+
+	// Delete the images of items that do not exist, the images that have
+	// no rows, and the uploads that were never committed.
+	if itemIDs, err = store.Items(); err != nil {
+		return err
+	}
+
+	for _, itemID := range itemIDs {
+		if known[itemID] == nil {
+			// Leave anything that is not ours alone, and the items that
+			// may be being added by another server.
+			if !isItemID(itemID) {
+				continue
+			}
+			if settled, err = isSettledItem(store, itemID, grace); err != nil {
+				return err
+			}
+			if !settled {
+				skipped++
+				continue
+			}
+			if err = store.DeleteAll(itemID); err != nil {
+				return err
+			}
+			orphans++
+			continue
+		}
+
+		if names, err = store.List(itemID, ""); err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			if known[itemID][name] || !isReconciledName(name) {
+				continue
+			}
+
+			settled, err = isSettledImage(store, itemID, name, grace)
+			if err != nil {
+				return err
+			}
+			if !settled {
+				skipped++
+				continue
+			}
+
+			// Thumbnails go along with the image.
+			if strings.HasPrefix(name, imgImagePrefix) {
+				err = deleteItemImage(store, itemID, name)
+			} else {
+				err = store.Delete(itemID, name)
+			}
+			if err != nil {
+				return err
+			}
+			removed++
+		}
+	}
+
+	// Delete the rows of images that are not in the store.
+	for _, image := range images {
+		_, err = store.Stat(image.ItemID, image.ImageName)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, errImageNotFound) {
+			return err
+		}
+
+		if err = inv.RemoveImage(image.ItemID, image.ImageID); err != nil {
+			return err
+		}
+		removed++
+	}
+
+	log.Printf(
+		"reconcile: published %d upload(s), removed %d orphaned "+
+			"image(s) and row(s), and %d orphaned item(s); skipped %d "+
+			"recent upload(s)",
+		published, removed, orphans, skipped,
+	)
+
+	return nil
+}
+
+func isItemID(str string) bool {
+	return len(str) == hashStrSize &&
+		strings.Trim(str, hashCharSet) == ""
+}
+
+// Tells whether an image is one that the reconciler deletes if it has no
+// row: an image, or a staged (or half-written) upload.
+func isReconciledName(name string) bool {
+	return strings.HasPrefix(name, imgImagePrefix) ||
+		strings.HasPrefix(name, imgStagePrefix) ||
+		strings.HasPrefix(name, imgTempPrefix)
+}
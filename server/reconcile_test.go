@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Puts an image in a local store, written "age" ago.
+func putAgedImage(t *testing.T, store *localImageStore, itemID, name string,
+	age time.Duration) {
+
+	var at = time.Now().Add(-age)
+
+	if err := store.Put(itemID, name, strings.NewReader("x"), 1); err != nil {
+		t.Fatalf("failed to put %s/%s: %v", itemID, name, err)
+	}
+
+	if err := os.Chtimes(store.path(itemID, name), at, at); err != nil {
+		t.Fatalf("failed to age %s/%s: %v", itemID, name, err)
+	}
+}
+
+func hasImage(t *testing.T, store ImageStore, itemID, name string) bool {
+	_, err := store.Stat(itemID, name)
+	if err != nil && !errors.Is(err, errImageNotFound) {
+		t.Fatalf("failed to stat %s/%s: %v", itemID, name, err)
+	}
+
+	return err == nil
+}
+
+func TestReconcileLeavesRecentUploadsAlone(t *testing.T) {
+	var (
+		inv    = newMemInventoryStore()
+		grace  = time.Hour
+		old    = 2 * grace
+		young  = time.Minute
+		item   = newTestItem(t)
+		oldDir = genItemHash()
+		newDir = genItemHash()
+		store  *localImageStore
+		err    error
+	)
+
+	if store, err = newLocalImageStore(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = inv.AddItem(item, "", imageMeta{}, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Uploads of items that are not (or not yet) in the inventory.
+	putAgedImage(t, store, oldDir, imgStagePrefix+"a", old)
+	putAgedImage(t, store, newDir, imgStagePrefix+"a", old)
+	putAgedImage(t, store, newDir, imgStagePrefix+"b", young)
+
+	// Uploads (and images) of an item without rows.
+	putAgedImage(t, store, item.ItemID, imgStagePrefix+"old", old)
+	putAgedImage(t, store, item.ItemID, imgStagePrefix+"new", young)
+	putAgedImage(t, store, item.ItemID, imgTempPrefix+"old", old)
+	putAgedImage(t, store, item.ItemID, imgTempPrefix+"new", young)
+	putAgedImage(t, store, item.ItemID, imgImagePrefix+"old", old)
+	putAgedImage(t, store, item.ItemID, imgImagePrefix+"new", young)
+
+	if err = reconcileImages(inv, store, grace); err != nil {
+		t.Fatalf("failed to reconcile: %v", err)
+	}
+
+	for _, c := range []struct {
+		itemID string
+		name   string
+		kept   bool
+	}{
+		{oldDir, imgStagePrefix + "a", false},
+		{newDir, imgStagePrefix + "a", true},
+		{newDir, imgStagePrefix + "b", true},
+		{item.ItemID, imgStagePrefix + "old", false},
+		{item.ItemID, imgStagePrefix + "new", true},
+		{item.ItemID, imgTempPrefix + "old", false},
+		{item.ItemID, imgTempPrefix + "new", true},
+		{item.ItemID, imgImagePrefix + "old", false},
+		{item.ItemID, imgImagePrefix + "new", true},
+	} {
+		if kept := hasImage(t, store, c.itemID, c.name); kept != c.kept {
+			t.Errorf("%s/%s: kept is %v, want %v", c.itemID, c.name, kept,
+				c.kept)
+		}
+	}
+}
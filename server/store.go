@@ -0,0 +1,500 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+var (
+	errImageNotFound = errors.New("image not found")
+)
+
+type imageInfo struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// ImageStore keeps the images (originals and thumbnails) of the items in
+// the inventory. Every image belongs to an item, and is addressed by the
+// ID of the item and a name (e.g., "original", or "thumb_64x64").
+type ImageStore interface {
+	// Put atomically creates (or replaces) an image; readers either see
+	// the previous image, or all of the new one.
+	Put(itemID, name string, in io.Reader, size int64) error
+
+	// Get opens an image for reading; errImageNotFound is returned if it
+	// does not exist.
+	Get(itemID, name string) (io.ReadSeekCloser, imageInfo, error)
+
+	Stat(itemID, name string) (imageInfo, error)
+
+	// List returns the names of the images of an item that start with
+	// the given prefix.
+	List(itemID, prefix string) ([]string, error)
+
+	// Items returns the IDs of the items that have images in the store.
+	Items() ([]string, error)
+
+	Move(itemID, from, to string) error
+
+	Delete(itemID, name string) error
+
+	DeleteAll(itemID string) error
+}
+
+type localImageStore struct {
+	root string
+}
+
+type s3Config struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	UseSSL    bool
+}
+
+type s3ImageStore struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func newImageStore(kind, root string, cfg s3Config) (ImageStore, error) {
+	switch kind {
+	case "local":
+		return newLocalImageStore(root)
+	case "s3":
+		return newS3ImageStore(cfg)
+	default:
+		return nil, fmt.Errorf("bad image store type: %s", kind)
+	}
+}
+
+func newLocalImageStore(root string) (*localImageStore, error) {
+	if len(root) <= 0 {
+		return nil, errors.New("empty image root directory")
+	}
+
+	if err := os.MkdirAll(root, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	return &localImageStore{root: root}, nil
+}
+
+func (s *localImageStore) path(itemID, name string) string {
+	return path.Join(s.root, itemID, name)
+}
+
+func (s *localImageStore) Put(itemID, name string, in io.Reader,
+	size int64) error {
+
+	var (
+		dir  string
+		file *os.File
+		err  error
+	)
+
+	dir = path.Join(s.root, itemID)
+	if _, err = os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+		if err = os.MkdirAll(dir, os.ModePerm); err != nil {
+			return err
+		}
+
+		if err = syncDir(s.root); err != nil {
+			return err
+		}
+	}
+
+	// Write to a temporary file first, and then rename it over the image
+	// so that the image is never seen half-written. The file is synced
+	// before the rename (and the directory after it), so that a crash
+	// cannot leave the name pointing to a truncated image.
+	if file, err = os.CreateTemp(dir, imgTempPrefix); err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(file, in); err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+
+	if err = file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	if err = os.Rename(file.Name(), s.path(itemID, name)); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// Makes the entries of a directory (e.g., a rename) durable.
+func syncDir(dir string) error {
+	var (
+		file *os.File
+		err  error
+	)
+
+	if file, err = os.Open(dir); err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return file.Sync()
+}
+
+func (s *localImageStore) Get(itemID,
+	name string) (io.ReadSeekCloser, imageInfo, error) {
+
+	var (
+		file *os.File
+		info imageInfo
+		err  error
+	)
+
+	if file, err = os.Open(s.path(itemID, name)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, info, errImageNotFound
+		}
+		return nil, info, err
+	}
+
+	if info, err = s.stat(file); err != nil {
+		file.Close()
+		return nil, info, err
+	}
+
+	return file, info, nil
+}
+
+func (s *localImageStore) stat(file *os.File) (imageInfo, error) {
+	var (
+		fi  os.FileInfo
+		err error
+	)
+
+	if fi, err = file.Stat(); err != nil {
+		return imageInfo{}, err
+	}
+
+	return imageInfo{Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (s *localImageStore) Stat(itemID, name string) (imageInfo, error) {
+	var (
+		fi  os.FileInfo
+		err error
+	)
+
+	if fi, err = os.Stat(s.path(itemID, name)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return imageInfo{}, errImageNotFound
+		}
+		return imageInfo{}, err
+	}
+
+	return imageInfo{Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (s *localImageStore) List(itemID, prefix string) ([]string, error) {
+	var (
+		entries []os.DirEntry
+		names   []string
+		err     error
+	)
+
+	entries, err = os.ReadDir(path.Join(s.root, itemID))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasPrefix(entry.Name(), prefix) {
+			names = append(names, entry.Name())
+		}
+	}
+
+	return names, nil
+}
+
+func (s *localImageStore) Items() ([]string, error) {
+	var (
+		entries []os.DirEntry
+		itemIDs []string
+		err     error
+	)
+
+	if entries, err = os.ReadDir(s.root); err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			itemIDs = append(itemIDs, entry.Name())
+		}
+	}
+
+	return itemIDs, nil
+}
+
+func (s *localImageStore) Move(itemID, from, to string) error {
+	var err error
+
+	err = os.Rename(s.path(itemID, from), s.path(itemID, to))
+	if errors.Is(err, os.ErrNotExist) {
+		return errImageNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	return syncDir(path.Join(s.root, itemID))
+}
+
+func (s *localImageStore) Delete(itemID, name string) error {
+	var err error
+
+	if err = os.Remove(s.path(itemID, name)); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+func (s *localImageStore) DeleteAll(itemID string) error {
+	return os.RemoveAll(path.Join(s.root, itemID))
+}
+
+func newS3ImageStore(cfg s3Config) (*s3ImageStore, error) {
+	var (
+		client *minio.Client
+		exists bool
+		err    error
+	)
+
+	if len(cfg.Endpoint) <= 0 || len(cfg.Bucket) <= 0 {
+		return nil, errors.New("empty S3 endpoint or bucket")
+	}
+
+	client, err = minio.New(cfg.Endpoint, &minio.Options{
+		Creds: credentials.NewStaticV4(
+			cfg.AccessKey, cfg.SecretKey, "",
+		),
+		Secure: cfg.UseSSL,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err = client.BucketExists(context.Background(), cfg.Bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		err = client.MakeBucket(
+			context.Background(), cfg.Bucket,
+			minio.MakeBucketOptions{Region: cfg.Region},
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &s3ImageStore{
+		client: client,
+		bucket: cfg.Bucket,
+		prefix: strings.Trim(cfg.Prefix, "/"),
+	}, nil
+}
+
+func (s *s3ImageStore) key(itemID, name string) string {
+	return path.Join(s.prefix, itemID, name)
+}
+
+func isS3NotFound(err error) bool {
+	var code = minio.ToErrorResponse(err).Code
+
+	return code == "NoSuchKey" || code == "NotFound"
+}
+
+// Objects in S3 are replaced atomically on upload, so there is no need
+// for a temporary object here.
+func (s *s3ImageStore) Put(itemID, name string, in io.Reader,
+	size int64) error {
+
+	var err error
+
+	_, err = s.client.PutObject(
+		context.Background(), s.bucket, s.key(itemID, name), in, size,
+		minio.PutObjectOptions{},
+	)
+
+	return err
+}
+
+func (s *s3ImageStore) Get(itemID,
+	name string) (io.ReadSeekCloser, imageInfo, error) {
+
+	var (
+		obj  *minio.Object
+		stat minio.ObjectInfo
+		err  error
+	)
+
+	obj, err = s.client.GetObject(
+		context.Background(), s.bucket, s.key(itemID, name),
+		minio.GetObjectOptions{},
+	)
+	if err != nil {
+		return nil, imageInfo{}, err
+	}
+
+	if stat, err = obj.Stat(); err != nil {
+		obj.Close()
+		if isS3NotFound(err) {
+			return nil, imageInfo{}, errImageNotFound
+		}
+		return nil, imageInfo{}, err
+	}
+
+	return obj, imageInfo{Size: stat.Size, ModTime: stat.LastModified}, nil
+}
+
+func (s *s3ImageStore) Stat(itemID, name string) (imageInfo, error) {
+	var (
+		stat minio.ObjectInfo
+		err  error
+	)
+
+	stat, err = s.client.StatObject(
+		context.Background(), s.bucket, s.key(itemID, name),
+		minio.StatObjectOptions{},
+	)
+	if err != nil {
+		if isS3NotFound(err) {
+			return imageInfo{}, errImageNotFound
+		}
+		return imageInfo{}, err
+	}
+
+	return imageInfo{Size: stat.Size, ModTime: stat.LastModified}, nil
+}
+
+func (s *s3ImageStore) List(itemID, prefix string) ([]string, error) {
+	var (
+		dir   string
+		names []string
+	)
+
+	dir = s.key(itemID, "") + "/"
+	for obj := range s.client.ListObjects(
+		context.Background(), s.bucket,
+		minio.ListObjectsOptions{Prefix: dir + prefix},
+	) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		names = append(names, strings.TrimPrefix(obj.Key, dir))
+	}
+
+	return names, nil
+}
+
+// Items are "directories" in S3, i.e., the common prefixes of the keys.
+func (s *s3ImageStore) Items() ([]string, error) {
+	var (
+		dir     string
+		itemIDs []string
+	)
+
+	if len(s.prefix) > 0 {
+		dir = s.prefix + "/"
+	}
+
+	for obj := range s.client.ListObjects(
+		context.Background(), s.bucket,
+		minio.ListObjectsOptions{Prefix: dir},
+	) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		if strings.HasSuffix(obj.Key, "/") {
+			itemIDs = append(
+				itemIDs,
+				strings.TrimSuffix(strings.TrimPrefix(obj.Key, dir), "/"),
+			)
+		}
+	}
+
+	return itemIDs, nil
+}
+
+// There is no rename in S3; the image is copied and the source deleted.
+func (s *s3ImageStore) Move(itemID, from, to string) error {
+	var err error
+
+	_, err = s.client.CopyObject(
+		context.Background(),
+		minio.CopyDestOptions{Bucket: s.bucket, Object: s.key(itemID, to)},
+		minio.CopySrcOptions{Bucket: s.bucket, Object: s.key(itemID, from)},
+	)
+	if err != nil {
+		if isS3NotFound(err) {
+			return errImageNotFound
+		}
+		return err
+	}
+
+	return s.Delete(itemID, from)
+}
+
+func (s *s3ImageStore) Delete(itemID, name string) error {
+	return s.client.RemoveObject(
+		context.Background(), s.bucket, s.key(itemID, name),
+		minio.RemoveObjectOptions{},
+	)
+}
+
+func (s *s3ImageStore) DeleteAll(itemID string) error {
+	var (
+		names []string
+		err   error
+	)
+
+	if names, err = s.List(itemID, ""); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err = s.Delete(itemID, name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
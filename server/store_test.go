@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Environment variables for an S3 compatible object store (e.g., the
+// "minio" service in docker-compose.yml) to run the store tests against;
+// they are skipped if the endpoint is not set. The tests use a prefix of
+// their own in the bucket (which is created if needed).
+const (
+	testS3EndpointEnv = "TEST_S3_ENDPOINT"
+	testS3BucketEnv   = "TEST_S3_BUCKET"
+	testS3AccessEnv   = "TEST_S3_ACCESS"
+	testS3SecretEnv   = "TEST_S3_SECRET"
+
+	testS3Bucket = "shopify-test"
+)
+
+func putTestImage(t *testing.T, store ImageStore, itemID, name,
+	body string) {
+
+	err := store.Put(itemID, name, strings.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatalf("put %s/%s: %v", itemID, name, err)
+	}
+}
+
+func readTestImage(t *testing.T, store ImageStore, itemID,
+	name string) string {
+
+	var (
+		in   io.ReadSeekCloser
+		info imageInfo
+		body []byte
+		err  error
+	)
+
+	if in, info, err = store.Get(itemID, name); err != nil {
+		t.Fatalf("get %s/%s: %v", itemID, name, err)
+	}
+	defer in.Close()
+
+	if body, err = io.ReadAll(in); err != nil {
+		t.Fatalf("read %s/%s: %v", itemID, name, err)
+	}
+
+	if info.Size != int64(len(body)) || info.ModTime.IsZero() {
+		t.Fatalf("get %s/%s: got info %+v for %d bytes", itemID, name,
+			info, len(body))
+	}
+
+	return string(body)
+}
+
+// Checks that the images of an item (with the given prefix) are "want".
+func checkTestImages(t *testing.T, store ImageStore, itemID, prefix string,
+	want ...string) {
+
+	names, err := store.List(itemID, prefix)
+	if err != nil {
+		t.Fatalf("list %s/%s: %v", itemID, prefix, err)
+	}
+	sort.Strings(names)
+
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Fatalf("list %s/%s: got %v, want %v", itemID, prefix, names, want)
+	}
+}
+
+func hasTestItem(t *testing.T, store ImageStore, itemID string) bool {
+	itemIDs, err := store.Items()
+	if err != nil {
+		t.Fatalf("items: %v", err)
+	}
+
+	return contains(itemIDs, itemID)
+}
+
+// Checks the behaviour that the rest of the server expects of every
+// ImageStore.
+func testImageStore(t *testing.T, store ImageStore) {
+	var (
+		itemA = genItemHash()
+		itemB = genItemHash()
+		info  imageInfo
+		err   error
+	)
+
+	t.Cleanup(func() {
+		store.DeleteAll(itemA)
+		store.DeleteAll(itemB)
+	})
+
+	// Put, Get and Stat.
+	putTestImage(t, store, itemA, "image_a", "first")
+	putTestImage(t, store, itemA, "image_a", "second")
+	putTestImage(t, store, itemA, "thumb_a", "thumb")
+	putTestImage(t, store, itemB, "image_b", "other")
+
+	if body := readTestImage(t, store, itemA, "image_a"); body != "second" {
+		t.Fatalf("get: got %q, want %q", body, "second")
+	}
+
+	if info, err = store.Stat(itemA, "image_a"); err != nil ||
+		info.Size != int64(len("second")) {
+		t.Fatalf("stat: got %+v, %v", info, err)
+	}
+
+	_, _, err = store.Get(itemA, "missing")
+	if !errors.Is(err, errImageNotFound) {
+		t.Fatalf("get missing: got %v, want %v", err, errImageNotFound)
+	}
+
+	_, err = store.Stat(itemA, "missing")
+	if !errors.Is(err, errImageNotFound) {
+		t.Fatalf("stat missing: got %v, want %v", err, errImageNotFound)
+	}
+
+	// List and Items.
+	checkTestImages(t, store, itemA, "", "image_a", "thumb_a")
+	checkTestImages(t, store, itemA, "thumb_", "thumb_a")
+	checkTestImages(t, store, genItemHash(), "")
+
+	if !hasTestItem(t, store, itemA) || !hasTestItem(t, store, itemB) {
+		t.Fatal("items: missing an item")
+	}
+
+	// Move.
+	if err = store.Move(itemA, "image_a", "image_c"); err != nil {
+		t.Fatalf("move: %v", err)
+	}
+
+	if body := readTestImage(t, store, itemA, "image_c"); body != "second" {
+		t.Fatalf("get moved: got %q, want %q", body, "second")
+	}
+
+	_, err = store.Stat(itemA, "image_a")
+	if !errors.Is(err, errImageNotFound) {
+		t.Fatalf("stat moved: got %v, want %v", err, errImageNotFound)
+	}
+
+	err = store.Move(itemA, "missing", "image_d")
+	if !errors.Is(err, errImageNotFound) {
+		t.Fatalf("move missing: got %v, want %v", err, errImageNotFound)
+	}
+
+	// Delete and DeleteAll.
+	if err = store.Delete(itemA, "thumb_a"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	if err = store.Delete(itemA, "thumb_a"); err != nil {
+		t.Fatalf("delete missing: %v", err)
+	}
+
+	checkTestImages(t, store, itemA, "", "image_c")
+
+	if err = store.DeleteAll(itemA); err != nil {
+		t.Fatalf("delete all: %v", err)
+	}
+
+	checkTestImages(t, store, itemA, "")
+
+	if hasTestItem(t, store, itemA) || !hasTestItem(t, store, itemB) {
+		t.Fatal("items after delete all: wrong items")
+	}
+}
+
+func TestLocalImageStore(t *testing.T) {
+	var (
+		store *localImageStore
+		err   error
+	)
+
+	if store, err = newLocalImageStore(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	testImageStore(t, store)
+}
+
+func TestS3ImageStore(t *testing.T) {
+	var (
+		cfg = s3Config{
+			Endpoint:  os.Getenv(testS3EndpointEnv),
+			Bucket:    os.Getenv(testS3BucketEnv),
+			Prefix:    "test-" + genItemHash(),
+			AccessKey: os.Getenv(testS3AccessEnv),
+			SecretKey: os.Getenv(testS3SecretEnv),
+		}
+		store *s3ImageStore
+		err   error
+	)
+
+	if len(cfg.Endpoint) <= 0 {
+		t.Skipf("%s is not set", testS3EndpointEnv)
+	}
+
+	if len(cfg.Bucket) <= 0 {
+		cfg.Bucket = testS3Bucket
+	}
+
+	if store, err = newS3ImageStore(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	testImageStore(t, store)
+}
+
+func TestThumbCacheImageStore(t *testing.T) {
+	var (
+		store *localImageStore
+		err   error
+	)
+
+	if store, err = newLocalImageStore(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	testImageStore(t, newThumbCache(store, 0))
+}
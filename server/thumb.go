@@ -0,0 +1,307 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/nfnt/resize"
+)
+
+// Resizes an image to fit a thumbnail of h x w pixels, as per the mode:
+//   - "fit": the image is scaled to fit in the box (the aspect ratio is
+//     kept, so the thumbnail may be smaller than the box).
+//   - "fill": the image is scaled to cover the box, and the overflow is
+//     cropped evenly from both sides.
+//   - "smart": like "fill", but the crop is placed where the image is the
+//     busiest (has the highest entropy).
+//   - "exact": the image is stretched to the box.
+//
+// If either of h or w is zero, the aspect ratio is kept for every mode.
+func resizeThumb(height, width uint, mode string, img image.Image) image.Image {
+	var (
+		cover image.Image
+		rect  image.Rectangle
+	)
+
+	// (resize.Thumbnail takes a zero to be a zero-sized box.)
+	if height == 0 || width == 0 {
+		return resize.Resize(width, height, img, resize.Lanczos3)
+	}
+
+	switch mode {
+	case imgModeExact:
+		return resize.Resize(width, height, img, resize.Lanczos3)
+
+	case imgModeFill, imgModeSmart:
+		cover = resizeCover(height, width, img)
+		if mode == imgModeFill {
+			rect = centerCrop(height, width, cover.Bounds())
+		} else {
+			rect = entropyCrop(height, width, cover)
+		}
+		return cropImage(cover, rect)
+
+	default:
+		return resize.Thumbnail(width, height, img, resize.Lanczos3)
+	}
+}
+
+// Scales an image (keeping the aspect ratio) so that it covers h x w.
+func resizeCover(height, width uint, img image.Image) image.Image {
+	var (
+		bounds = img.Bounds()
+		scale  float64
+	)
+
+	scale = math.Max(
+		float64(width)/float64(bounds.Dx()),
+		float64(height)/float64(bounds.Dy()),
+	)
+
+	return resize.Resize(
+		uint(math.Max(math.Ceil(float64(bounds.Dx())*scale), float64(width))),
+		uint(math.Max(math.Ceil(float64(bounds.Dy())*scale), float64(height))),
+		img, resize.Lanczos3,
+	)
+}
+
+func centerCrop(height, width uint, bounds image.Rectangle) image.Rectangle {
+	var (
+		x = bounds.Min.X + (bounds.Dx()-int(width))/2
+		y = bounds.Min.Y + (bounds.Dy()-int(height))/2
+	)
+
+	return image.Rect(x, y, x+int(width), y+int(height))
+}
+
+// Slides an h x w window along the longer side of an image (that already
+// covers h x w), and returns the window with the highest entropy.
+func entropyCrop(height, width uint, img image.Image) image.Rectangle {
+	var (
+		bounds  = img.Bounds()
+		gray    *image.Gray
+		extraX  = bounds.Dx() - int(width)
+		extraY  = bounds.Dy() - int(height)
+		step    int
+		best    image.Rectangle
+		bestEnt float64 = -1
+		ent     float64
+		rect    image.Rectangle
+	)
+
+	gray = image.NewGray(bounds)
+	draw.Draw(gray, bounds, img, bounds.Min, draw.Src)
+
+	// Only one of these is non-zero (up to rounding).
+	step = (extraX + extraY) / imgSmartCropSteps
+	if step < 1 {
+		step = 1
+	}
+
+	for dx, dy := 0, 0; dx <= extraX && dy <= extraY; {
+		rect = image.Rect(
+			bounds.Min.X+dx, bounds.Min.Y+dy,
+			bounds.Min.X+dx+int(width), bounds.Min.Y+dy+int(height),
+		)
+
+		if ent = grayEntropy(gray, rect); ent > bestEnt {
+			best, bestEnt = rect, ent
+		}
+
+		if extraX >= extraY {
+			dx += step
+		} else {
+			dy += step
+		}
+	}
+
+	return best
+}
+
+func grayEntropy(gray *image.Gray, rect image.Rectangle) float64 {
+	var (
+		hist  [256]int
+		total float64
+		ent   float64
+		p     float64
+	)
+
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		row := gray.Pix[gray.PixOffset(rect.Min.X, y):gray.PixOffset(rect.Max.X, y)]
+		for _, v := range row {
+			hist[v]++
+		}
+	}
+
+	total = float64(rect.Dx() * rect.Dy())
+	for _, n := range hist {
+		if n > 0 {
+			p = float64(n) / total
+			ent -= p * math.Log2(p)
+		}
+	}
+
+	return ent
+}
+
+// Copies a part of an image into a new one (with the origin at 0, 0).
+func cropImage(img image.Image, rect image.Rectangle) image.Image {
+	var out = image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+
+	draw.Draw(out, out.Bounds(), img, rect.Min, draw.Src)
+
+	return out
+}
+
+// Parses thumbnail presets from a comma separated list of presets, each of
+// the form "name=HxW[:mode[:quality]]" (e.g., "card=320x240:fill:85").
+func parseImgPresets(spec string) (map[string]imgPreset, error) {
+	var (
+		presets = make(map[string]imgPreset)
+		preset  imgPreset
+		name    string
+		parts   []string
+		height  uint64
+		width   uint64
+		quality int64
+		err     error
+	)
+
+	for _, entry := range strings.Split(spec, ",") {
+		if entry = strings.TrimSpace(entry); len(entry) <= 0 {
+			continue
+		}
+
+		if parts = strings.SplitN(entry, "=", 2); len(parts) != 2 {
+			return nil, fmt.Errorf("bad preset: %q", entry)
+		}
+
+		name = parts[0]
+		if len(name) <= 0 || strings.IndexFunc(name, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		}) >= 0 {
+			return nil, fmt.Errorf("bad preset name: %q", entry)
+		}
+
+		parts = strings.Split(parts[1], ":")
+		if _, err = fmt.Sscanf(parts[0], "%dx%d", &height, &width); err != nil {
+			return nil, fmt.Errorf("bad preset size: %q", entry)
+		}
+
+		if height > uint64(maxImageThumbPx) || width > uint64(maxImageThumbPx) ||
+			(height == 0 && width == 0) {
+			return nil, fmt.Errorf("bad preset size: %q", entry)
+		}
+
+		preset = imgPreset{
+			Height: uint(height), Width: uint(width), Mode: imgModeFit,
+		}
+
+		if len(parts) > 1 {
+			preset.Mode = parts[1]
+			if !contains(imgModes, preset.Mode) {
+				return nil, fmt.Errorf("bad preset mode: %q", entry)
+			}
+		}
+
+		if len(parts) > 2 {
+			quality, err = strconv.ParseInt(parts[2], 10, 64)
+			if err != nil || quality < 1 || quality > 100 {
+				return nil, fmt.Errorf("bad preset quality: %q", entry)
+			}
+			preset.Quality = int(quality)
+		}
+
+		if len(parts) > 3 {
+			return nil, fmt.Errorf("bad preset: %q", entry)
+		}
+
+		presets[name] = preset
+	}
+
+	return presets, nil
+}
+
+// Starts the workers that generate the preset thumbnails of an image in the
+// background, so that the first viewer does not have to wait for them.
+func startThumbPregen(store ImageStore, mux *itemLocker, workers int) {
+	if len(imgPresets) <= 0 || workers <= 0 {
+		return
+	}
+
+	thumbPregenQueue = make(chan thumbPregenJob, thumbPregenQueueSize)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range thumbPregenQueue {
+				mux.RLock(job.itemID)
+				pregenImageThumbs(store, job.itemID, job.image)
+				mux.RUnlock(job.itemID)
+			}
+		}()
+	}
+}
+
+// Queues an image for the generation of its preset thumbnails; the image
+// is skipped (and its thumbnails generated on demand) if the queue is full.
+func queueThumbPregen(itemID, image string) {
+	if thumbPregenQueue == nil {
+		return
+	}
+
+	select {
+	case thumbPregenQueue <- thumbPregenJob{itemID, image}:
+	default:
+		log.Printf(
+			"img: pre-generation queue is full, skipping: %s/%s",
+			itemID, image,
+		)
+	}
+}
+
+// Generates the preset thumbnails of an image, in the format of the image
+// and in WebP (which is what browsers ask for).
+func pregenImageThumbs(store ImageStore, itemID, image string) {
+	var (
+		format  string
+		formats []string
+		err     error
+	)
+
+	if format, err = detectItemImage(store, itemID, image); err != nil {
+		log.Printf(
+			"img: pre-generation failed for %s/%s: %v",
+			itemID, image, err,
+		)
+		return
+	}
+
+	formats = []string{format}
+	if format != "webp" {
+		formats = append(formats, "webp")
+	}
+
+	for name, preset := range imgPresets {
+		for _, format = range formats {
+			_, err = genImageThumb(imgThumbSpec{
+				Image:   image,
+				Height:  preset.Height,
+				Width:   preset.Width,
+				Mode:    preset.Mode,
+				Format:  format,
+				Quality: imageQuality(format, preset.Quality),
+			}, itemID, store)
+			if err != nil {
+				log.Printf(
+					"img: pre-generation of %q failed for %s/%s: %v",
+					name, itemID, image, err,
+				)
+			}
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Begins transactions; a pool (*sqlx.DB), or a single connection out of one
+// (*sqlx.Conn).
+type txBeginner interface {
+	BeginTxx(ctx context.Context, opts *sql.TxOptions) (*sqlx.Tx, error)
+}
+
+// Runs "fn" in a transaction, which is committed if "fn" returns nil, and
+// rolled back if it fails (or panics, in which case the panic goes on once
+// the transaction is rolled back). Every statement of "fn" has to go
+// through "dbTx" for it to be a part of the transaction.
+func withTx(db txBeginner, fn func(dbTx *sqlx.Tx) error) (err error) {
+	var dbTx *sqlx.Tx
+
+	if dbTx, err = db.BeginTxx(context.Background(), nil); err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			dbTx.Rollback()
+			panic(p)
+		}
+		if err != nil {
+			dbTx.Rollback()
+		}
+	}()
+
+	if err = fn(dbTx); err != nil {
+		return err
+	}
+
+	if err = dbTx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Environment variable with the DSN of a Postgres database to run the
+// integration tests against; they are skipped if it is not set. The schema
+// is migrated up before the tests run.
+const testDSNEnv = "TEST_DB_DSN"
+
+func newTestPgStore(t *testing.T) *pgInventoryStore {
+	var (
+		dsn = os.Getenv(testDSNEnv)
+		s   *pgInventoryStore
+		err error
+	)
+
+	if len(dsn) <= 0 {
+		t.Skipf("%s is not set", testDSNEnv)
+	}
+
+	if err = migrateUp(dsn); err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+
+	if s, err = newPgInventoryStore(dsn); err != nil {
+		t.Fatalf("failed to setup store: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	return s
+}
+
+func newTestItem(t *testing.T) inventoryRow {
+	var (
+		item inventoryRow
+		err  error
+	)
+
+	item.ItemID = genItemHash()
+	item.CreatedAt = time.Now().UTC()
+	item.UpdatedAt = item.CreatedAt
+	item.ItemCount = 5
+	item.ItemCurrency = defaultCurrency
+	item.ItemBrand = "brand"
+	item.ItemName = "name"
+	item.ItemDesc = "desc"
+
+	if item.ItemPrice, err = parsePrice("19.99"); err != nil {
+		t.Fatal(err)
+	}
+
+	return item
+}
+
+// Removes an item (and its ledger) once the test is done.
+func cleanupTestItem(t *testing.T, s *pgInventoryStore, itemID string) {
+	t.Cleanup(func() {
+		s.db.Exec(
+			fmt.Sprintf("DELETE FROM %s WHERE item_id = $1", dbMovementTable),
+			itemID,
+		)
+		s.db.Exec(
+			fmt.Sprintf("DELETE FROM %s WHERE item_id = $1", dbTable),
+			itemID,
+		)
+	})
+}
+
+func countMovements(t *testing.T, s *pgInventoryStore, itemID string) int {
+	var (
+		n   int
+		err error
+	)
+
+	err = s.db.Get(&n, fmt.Sprintf(
+		"SELECT COUNT(*) FROM %s WHERE item_id = $1", dbMovementTable,
+	), itemID)
+	if err != nil {
+		t.Fatalf("failed to count movements: %v", err)
+	}
+
+	return n
+}
+
+func insertTestItem(dbTx *sqlx.Tx, item *inventoryRow) error {
+	_, err := dbTx.Exec(
+		fmt.Sprintf(queryAddItem, dbTable),
+		item.ItemID, item.CreatedAt, item.UpdatedAt, item.ItemCount,
+		item.ItemPrice, item.ItemCurrency, item.ItemBrand, item.ItemName,
+		item.ItemDesc,
+	)
+
+	return err
+}
+
+func TestWithTxRollsBackOnError(t *testing.T) {
+	var (
+		s    = newTestPgStore(t)
+		item = newTestItem(t)
+		fail = errors.New("fail")
+		err  error
+	)
+
+	cleanupTestItem(t, s, item.ItemID)
+
+	err = withTx(s.db, func(dbTx *sqlx.Tx) error {
+		if err := insertTestItem(dbTx, &item); err != nil {
+			return err
+		}
+
+		return fail
+	})
+	if !errors.Is(err, fail) {
+		t.Fatalf("got error %v, want %v", err, fail)
+	}
+
+	if _, err = s.GetItem(item.ItemID); !errors.Is(err, errItemNotFound) {
+		t.Fatalf("item was committed (error: %v)", err)
+	}
+}
+
+func TestWithTxRollsBackOnPanic(t *testing.T) {
+	var (
+		s    = newTestPgStore(t)
+		item = newTestItem(t)
+		err  error
+	)
+
+	cleanupTestItem(t, s, item.ItemID)
+
+	func() {
+		defer func() {
+			if p := recover(); p != "fail" {
+				t.Fatalf("got panic %v, want %q", p, "fail")
+			}
+		}()
+
+		withTx(s.db, func(dbTx *sqlx.Tx) error {
+			if err := insertTestItem(dbTx, &item); err != nil {
+				return err
+			}
+
+			panic("fail")
+		})
+	}()
+
+	if _, err = s.GetItem(item.ItemID); !errors.Is(err, errItemNotFound) {
+		t.Fatalf("item was committed (error: %v)", err)
+	}
+}
+
+func TestUpdateItemRollsBackOnLedgerFailure(t *testing.T) {
+	var (
+		s      = newTestPgStore(t)
+		item   = newTestItem(t)
+		before inventoryRow
+		after  inventoryRow
+		moves  int
+		count  uint64 = 10
+		name          = "changed"
+		err    error
+	)
+
+	cleanupTestItem(t, s, item.ItemID)
+
+	if _, err = s.AddItem(item, "", imageMeta{}, "test"); err != nil {
+		t.Fatalf("failed to add item: %v", err)
+	}
+
+	if before, err = s.GetItem(item.ItemID); err != nil {
+		t.Fatalf("failed to get item: %v", err)
+	}
+	moves = countMovements(t, s, item.ItemID)
+
+	// The actor does not fit in the ledger, so recording the change in
+	// count fails.
+	_, err = s.UpdateItem(item.ItemID, itemChange{
+		ItemCount: &count,
+		ItemName:  &name,
+	}, itemWrite{At: time.Now().UTC(), Actor: strings.Repeat("a", 512)})
+	if err == nil {
+		t.Fatal("update did not fail")
+	}
+
+	if after, err = s.GetItem(item.ItemID); err != nil {
+		t.Fatalf("failed to get item: %v", err)
+	}
+
+	if after.ItemCount != before.ItemCount ||
+		after.ItemName != before.ItemName ||
+		after.Version != before.Version {
+		t.Fatalf("item changed: %+v, was %+v", after, before)
+	}
+
+	if n := countMovements(t, s, item.ItemID); n != moves {
+		t.Fatalf("got %d movements, want %d", n, moves)
+	}
+}
+
+func TestDeleteTrashedItemChecksVersion(t *testing.T) {
+	var (
+		s    = newTestPgStore(t)
+		item = newTestItem(t)
+		at   = time.Now().UTC()
+		err  error
+	)
+
+	cleanupTestItem(t, s, item.ItemID)
+
+	if _, err = s.AddItem(item, "", imageMeta{}, "test"); err != nil {
+		t.Fatalf("failed to add item: %v", err)
+	}
+
+	if err = s.TrashItem(item.ItemID, itemWrite{At: at}); err != nil {
+		t.Fatalf("failed to trash item: %v", err)
+	}
+
+	err = s.DeleteItem(item.ItemID, itemWrite{
+		At: at, IfMatch: true, Versions: []int64{1},
+	})
+	if !errors.Is(err, errVersionMismatch) {
+		t.Fatalf("got error %v, want %v", err, errVersionMismatch)
+	}
+
+	err = s.DeleteItem(item.ItemID, itemWrite{
+		At: at, IfMatch: true, Versions: []int64{2},
+	})
+	if err != nil {
+		t.Fatalf("failed to delete item: %v", err)
+	}
+}
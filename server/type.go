@@ -9,32 +9,137 @@ type itemID struct {
 }
 
 type itemData struct {
-	ItemCount uint64  `db:"item_count" json:"item_count" binding:"required,numeric"`
-	ItemPrice float64 `db:"item_price" json:"item_price" binding:"required,numeric"`
-	ItemBrand string  `db:"item_brand" json:"item_brand" binding:"required,ascii`
-	ItemName  string  `db:"item_name" json:"item_name" binding:"required,ascii"`
-	ItemDesc  string  `db:"item_desc" json:"item_desc" binding:"required,ascii"`
+	ItemCount    uint64 `db:"item_count" json:"item_count" form:"item_count" binding:"required,numeric,max=2147483647"`
+	ItemPrice    price  `db:"item_price" json:"item_price" form:"item_price" binding:"required"`
+	ItemCurrency string `db:"item_currency" json:"item_currency" form:"item_currency" binding:"omitempty,len=3,alpha"`
+	ItemBrand    string `db:"item_brand" json:"item_brand" form:"item_brand" binding:"required,ascii"`
+	ItemName     string `db:"item_name" json:"item_name" form:"item_name" binding:"required,ascii"`
+	ItemDesc     string `db:"item_desc" json:"item_desc" form:"item_desc" binding:"required,ascii"`
 }
 
 type inventoryRow struct {
 	itemID
-	CreatedAt time.Time `db:"created_at" json:"created_at" binding:"required,datetime" time_format:"unix"`
-	UpdatedAt time.Time `db:"updated_at" json:"updated_at" binding:"required,datetime" time_format:"unix"`
+	CreatedAt time.Time  `db:"created_at" json:"created_at" binding:"required,datetime" time_format:"unix"`
+	UpdatedAt time.Time  `db:"updated_at" json:"updated_at" binding:"required,datetime" time_format:"unix"`
+	Version   int64      `db:"item_version" json:"item_version"`
+	DeletedAt *time.Time `db:"deleted_at" json:"deleted_at,omitempty"`
 	itemData
+	Image *imageRow `db:"-" json:"image,omitempty"`
+}
+
+type imageID struct {
+	itemID
+	ImageID string `db:"image_id" json:"image_id" uri:"image_id" binding:"required,alphanum,len=8"`
+}
+
+type imageRow struct {
+	ImageID   string    `db:"image_id" json:"image_id"`
+	ItemID    string    `db:"item_id" json:"item_id"`
+	ImageName string    `db:"image_name" json:"-"`
+	Position  int       `db:"position" json:"position"`
+	Primary   bool      `db:"is_primary" json:"primary"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+	Width     *int      `db:"image_width" json:"width,omitempty"`
+	Height    *int      `db:"image_height" json:"height,omitempty"`
+	Size      *int64    `db:"image_size" json:"size,omitempty"`
+	MIMEType  *string   `db:"image_mime" json:"mime_type,omitempty"`
+	Staged    *string   `db:"staged_name" json:"-"`
+}
+
+// What is recorded about an image when it is uploaded (see sanitizeImage).
+type imageMeta struct {
+	Width    int
+	Height   int
+	Size     int64
+	MIMEType string
 }
 
 type itemImage struct {
 	ImgBase64 string `json:"image_base64" binding:"required,base64"`
 }
 
+type listFilter struct {
+	OrderBy  string  `form:"order_by,default=updated_at" binding:"oneof=created_at updated_at"`
+	Order    string  `form:"order,default=desc" binding:"oneof=asc desc"`
+	Brand    string  `form:"item_brand" binding:"omitempty,ascii"`
+	MinPrice *price  `form:"min_price"`
+	MaxPrice *price  `form:"max_price"`
+	MinCount *uint64 `form:"min_count" binding:"omitempty,numeric"`
+	MaxCount *uint64 `form:"max_count" binding:"omitempty,numeric"`
+}
+
 type apiRequestListQuery struct {
-	OrderBy string `form:"order_by,default=updated_at" binding:"oneof=created_at updated_at"`
-	Order   string `form:"order,default=desc" binding:"oneof=asc desc"`
+	listFilter
+	Limit  uint   `form:"limit,default=50" binding:"gte=1,lte=500"`
+	Cursor string `form:"cursor" binding:"omitempty,base64url"`
+}
+
+type apiRequestExportQuery struct {
+	listFilter
+	Format string `form:"format,default=csv" binding:"oneof=csv jsonl"`
+	Images bool   `form:"images,default=false"`
+	Excel  bool   `form:"excel,default=false"`
+}
+
+type exportRow struct {
+	inventoryRow
+	ImageURL string `json:"image_url,omitempty"`
+}
+
+type listCursor struct {
+	At time.Time
+	ID string
+}
+
+type apiRequestSearchQuery struct {
+	Query  string `form:"q" binding:"required,max=256"`
+	Prefix bool   `form:"prefix,default=true"`
+	Limit  uint   `form:"limit,default=20" binding:"gte=1,lte=100"`
+	Cursor string `form:"cursor" binding:"omitempty,base64url"`
+}
+
+type searchRow struct {
+	inventoryRow
+	Rank    float32 `db:"rank" json:"rank"`
+	NameHl  string  `db:"item_name_hl" json:"item_name_highlight"`
+	BrandHl string  `db:"item_brand_hl" json:"item_brand_highlight"`
+	DescHl  string  `db:"item_desc_hl" json:"item_desc_highlight"`
 }
 
 type imgRequestGetQuery struct {
-	Height uint16 `form:"h,default=0" binding:"number,gte=0,lte=8192"`
-	Width  uint16 `form:"w,default=0" binding:"number,gte=0,lte=8192"`
+	Height  uint16 `form:"h,default=0" binding:"number,gte=0,lte=8192"`
+	Width   uint16 `form:"w,default=0" binding:"number,gte=0,lte=8192"`
+	Format  string `form:"fmt" binding:"omitempty,oneof=jpeg png webp"`
+	Mode    string `form:"mode,default=fit" binding:"oneof=fit fill smart exact"`
+	Quality int    `form:"q" binding:"omitempty,gte=1,lte=100"`
+	Preset  string `form:"preset" binding:"omitempty,alphanum"`
+	Image   string `form:"image" binding:"omitempty,alphanum,len=8"`
+	Index   *uint  `form:"index" binding:"omitempty"`
+}
+
+type thumbCacheStats struct {
+	Entries   int    `json:"entries"`
+	Bytes     int64  `json:"bytes"`
+	Quota     int64  `json:"quota"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+}
+
+type imgPreset struct {
+	Height  uint
+	Width   uint
+	Mode    string
+	Quality int
+}
+
+type imgThumbSpec struct {
+	Image   string
+	Height  uint
+	Width   uint
+	Mode    string
+	Format  string
+	Quality int
 }
 
 type apiRequestAddBody struct {
@@ -42,20 +147,114 @@ type apiRequestAddBody struct {
 	itemImage
 }
 
+type apiRequestImageOrderBody struct {
+	ImageIDs []string `json:"image_ids" binding:"required,min=1,dive,alphanum,len=8"`
+}
+
+type thumbPregenJob struct {
+	itemID string
+	image  string
+}
+
 type apiRequestUpdateQuery struct {
-	UpdateField string `form:"update_field" binding:"required,oneof=item_count item_price item_brand item_name item_desc image_base64"`
+	UpdateField string `form:"update_field" binding:"required,oneof=item_count item_price item_currency item_brand item_name item_desc image_base64 image"`
 }
 
 type apiRequestUpdateBody struct {
-	ItemCount   uint64  `db:"item_count,omitempty" json:"item_count" binding:"numeric"`
-	ItemPrice   float64 `db:"item_price,omitempty" json:"item_price" binding:"numeric"`
-	ItemBrand   string  `db:"item_brand,omitempty" json:"item_brand" binding:"ascii`
-	ItemName    string  `db:"item_name,omitempty" json:"item_name" binding:"ascii"`
-	ItemDesc    string  `db:"item_desc,omitempty" json:"item_desc" binding:"ascii"`
-	ImageBase64 string  `json:"image_base64,omitempty" binding:"ascii"`
+	ItemCount    uint64 `db:"item_count,omitempty" json:"item_count" form:"item_count" binding:"numeric,max=2147483647"`
+	ItemPrice    price  `db:"item_price,omitempty" json:"item_price" form:"item_price"`
+	ItemCurrency string `db:"item_currency,omitempty" json:"item_currency" form:"item_currency" binding:"omitempty,len=3,alpha"`
+	ItemBrand    string `db:"item_brand,omitempty" json:"item_brand" form:"item_brand" binding:"ascii"`
+	ItemName     string `db:"item_name,omitempty" json:"item_name" form:"item_name" binding:"ascii"`
+	ItemDesc     string `db:"item_desc,omitempty" json:"item_desc" form:"item_desc" binding:"ascii"`
+	ImageBase64  string `json:"image_base64,omitempty" binding:"ascii"`
+}
+
+type apiRequestPatchBody struct {
+	ItemCount    *uint64 `json:"item_count" form:"item_count" binding:"omitempty,numeric,max=2147483647"`
+	ItemPrice    *price  `json:"item_price" form:"item_price"`
+	ItemCurrency *string `json:"item_currency" form:"item_currency" binding:"omitempty,len=3,alpha"`
+	ItemBrand    *string `json:"item_brand" form:"item_brand" binding:"omitempty,ascii"`
+	ItemName     *string `json:"item_name" form:"item_name" binding:"omitempty,ascii"`
+	ItemDesc     *string `json:"item_desc" form:"item_desc" binding:"omitempty,ascii"`
+	ImageBase64  *string `json:"image_base64" form:"image_base64" binding:"omitempty,base64"`
+}
+
+type apiRequestStockBody struct {
+	Delta  int64  `json:"delta" binding:"required,min=-2147483648,max=2147483647"`
+	Reason string `json:"reason" binding:"omitempty,oneof=sale return restock correction damage"`
+}
+
+type stockResult struct {
+	itemID
+	ItemCount uint64 `db:"item_count" json:"item_count"`
+	Delta     int64  `json:"delta"`
+	Reason    string `json:"reason"`
+}
+
+type apiRequestDeleteQuery struct {
+	Purge bool `form:"purge,default=false"`
+}
+
+type apiRequestTrashQuery struct {
+	Limit  uint   `form:"limit,default=50" binding:"gte=1,lte=500"`
+	Cursor string `form:"cursor" binding:"omitempty,base64url"`
+}
+
+type apiRequestHistoryQuery struct {
+	Limit  uint   `form:"limit,default=50" binding:"gte=1,lte=500"`
+	Cursor string `form:"cursor" binding:"omitempty,base64url"`
+}
+
+type stockMovement struct {
+	MovementID int64     `db:"movement_id" json:"movement_id"`
+	ItemID     string    `db:"item_id" json:"item_id"`
+	Delta      int64     `db:"delta" json:"delta"`
+	Reason     string    `db:"reason" json:"reason"`
+	Actor      string    `db:"actor" json:"actor"`
+	CreatedAt  time.Time `db:"created_at" json:"created_at"`
+}
+
+type apiRequestImportQuery struct {
+	Format    string `form:"format" binding:"omitempty,oneof=csv jsonl"`
+	BatchSize int    `form:"batch_size,default=100" binding:"gte=1,lte=1000"`
+}
+
+type importRow struct {
+	itemData
+	ImageURL    string `json:"image_url" binding:"omitempty,url"`
+	ImagePath   string `json:"image_path"`
+	ImageBase64 string `json:"image_base64" binding:"omitempty,base64"`
+}
+
+type importItem struct {
+	inventoryRow
+	row       int
+	imgStaged string
+	imgMeta   imageMeta
+	image     imageRow
+}
+
+type importResult struct {
+	Row    int    `json:"row"`
+	ItemID string `json:"item_id,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type importReport struct {
+	Imported int            `json:"imported"`
+	Failed   int            `json:"failed"`
+	Rows     []importResult `json:"rows"`
+}
+
+type apiResponsePage struct {
+	Total      int64  `json:"total"`
+	Limit      uint   `json:"limit"`
+	NextCursor string `json:"next_cursor"`
 }
 
 type apiResponse struct {
-	Data  interface{} `json:"data"`
-	Error interface{} `json:"error"`
+	Data  interface{}      `json:"data"`
+	Error interface{}      `json:"error"`
+	Page  *apiResponsePage `json:"page,omitempty"`
 }
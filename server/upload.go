@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"mime/multipart"
+	"net/http"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+var (
+	errImageTooLarge = errors.New("image too large")
+	errImageMIMEType = errors.New("bad image MIME type")
+)
+
+// An error caused by the upload itself (as opposed to the server); the
+// handlers respond to these with a 400.
+type uploadError struct {
+	err error
+}
+
+func (e *uploadError) Error() string {
+	return e.err.Error()
+}
+
+func (e *uploadError) Unwrap() error {
+	return e.err
+}
+
+// Like io.LimitedReader, but fails instead of stopping at the limit, so
+// that an image that is too large is never stored truncated. Errors from
+// the underlying reader are kept, to tell them apart from store errors.
+type imageLimitReader struct {
+	in       io.Reader
+	left     int64
+	exceeded bool
+	readErr  error
+}
+
+func (r *imageLimitReader) Read(p []byte) (int, error) {
+	var (
+		n   int
+		err error
+	)
+
+	if r.exceeded {
+		return 0, errImageTooLarge
+	}
+
+	if int64(len(p)) > r.left+1 {
+		p = p[:r.left+1]
+	}
+
+	n, err = r.in.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) {
+		r.readErr = err
+	}
+
+	if r.left -= int64(n); r.left < 0 {
+		r.exceeded = true
+		return 0, errImageTooLarge
+	}
+
+	return n, err
+}
+
+func isMultipartRequest(ctx *gin.Context) bool {
+	return ctx.ContentType() == binding.MIMEMultipartPOSTForm
+}
+
+// Streams an image to the store under a staging name (see publishItemImage),
+// checking its MIME type from the first few bytes, and its size as it goes.
+// The metadata of the image is dropped on the way (see imageMetaFilter), and
+// the rest of the sanitizing (see sanitizeImage) is done on the staged image.
+func streamItemImage(store ImageStore, itemID string,
+	in io.Reader) (string, imageMeta, error) {
+
+	var (
+		head   []byte
+		name   string
+		meta   imageMeta
+		format string
+		n      int
+		limit  *imageLimitReader
+		filter *imageMetaFilter
+		err    error
+	)
+
+	head = make([]byte, imgSniffSize)
+	n, err = io.ReadFull(in, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		if errors.Is(err, io.EOF) {
+			return "", meta, &uploadError{errors.New("empty image")}
+		}
+		return "", meta, &uploadError{err}
+	}
+	head = head[:n]
+
+	meta.MIMEType = mimetype.Detect(head).String()
+	if !mimetype.EqualsAny(meta.MIMEType, allowedImgMIMETypes...) {
+		return "", meta, &uploadError{errImageMIMEType}
+	}
+
+	if format, err = imageFormat(meta.MIMEType); err != nil {
+		return "", meta, &uploadError{errImageMIMEType}
+	}
+
+	limit = &imageLimitReader{
+		in:   io.MultiReader(bytes.NewReader(head), in),
+		left: maxUploadImageSize,
+	}
+	filter = newImageMetaFilter(format, limit, !imgKeepMeta)
+
+	name = imgStagePrefix + genItemHash()
+	if err = store.Put(itemID, name, filter, -1); err != nil {
+		store.Delete(itemID, name)
+		if limit.exceeded {
+			return "", meta, &uploadError{errImageTooLarge}
+		}
+		if limit.readErr != nil {
+			return "", meta, &uploadError{limit.readErr}
+		}
+		if filter.bad {
+			return "", meta, &uploadError{errBadImageData}
+		}
+		return "", meta, err
+	}
+
+	err = sanitizeStagedImage(store, itemID, name, format, filter, &meta)
+	if err != nil {
+		store.Delete(itemID, name)
+		return "", meta, err
+	}
+
+	return name, meta, nil
+}
+
+// Finishes sanitizing an image that has been staged through a metadata
+// filter: the image is turned upright as per its EXIF orientation, or
+// else the RIFF size of a WebP that had metadata is fixed. Either is done
+// from the staged image into the store (not in memory). The size of the
+// image is checked, and recorded in "meta", last of all.
+func sanitizeStagedImage(store ImageStore, itemID, name, format string,
+	filter *imageMetaFilter, meta *imageMeta) error {
+
+	var (
+		orientation int
+		err         error
+	)
+
+	if orientation = exifOrientation(filter.exif); orientation > 1 {
+		err = restageImage(store, itemID, name,
+			func(in io.ReadSeeker, out io.Writer) error {
+				img, err := decodeImage(format, in)
+				if err != nil {
+					return &uploadError{err}
+				}
+
+				return encodeImage(
+					format, imageQuality(format, imgOrientQuality),
+					orientImage(img, orientation), out,
+				)
+			},
+		)
+	} else if format == "webp" && filter.dropped > 0 {
+		err = restageImage(store, itemID, name,
+			func(in io.ReadSeeker, out io.Writer) error {
+				fixed := newImageMetaFilter(format, in, true)
+				fixed.webpSize = filter.strippedWebpSize()
+
+				_, err := io.Copy(out, fixed)
+				return err
+			},
+		)
+	}
+	if err != nil {
+		return err
+	}
+
+	return stagedImageMeta(store, itemID, name, format, meta)
+}
+
+// Replaces a staged image with what "fn" writes out from it, through a pipe
+// into the store. The store only swaps the new image in once it is whole.
+func restageImage(store ImageStore, itemID, name string,
+	fn func(in io.ReadSeeker, out io.Writer) error) error {
+
+	var (
+		in     io.ReadSeekCloser
+		pr, pw = io.Pipe()
+		done   = make(chan error, 1)
+		err    error
+	)
+
+	if in, _, err = store.Get(itemID, name); err != nil {
+		return err
+	}
+	defer in.Close()
+
+	go func() {
+		err := fn(in, pw)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+
+	err = store.Put(itemID, name, pr, -1)
+	pr.Close()
+
+	// An error from "fn" fails the write too, but is the one to report;
+	// "fn" only sees a closed pipe if the store failed on its own.
+	if fnErr := <-done; fnErr != nil && !errors.Is(fnErr, io.ErrClosedPipe) {
+		return fnErr
+	}
+
+	return err
+}
+
+// Checks the size (see checkImagePixels) of a staged image, and records its
+// dimensions and size in "meta".
+func stagedImageMeta(store ImageStore, itemID, name, format string,
+	meta *imageMeta) error {
+
+	var (
+		in   io.ReadSeekCloser
+		info imageInfo
+		cfg  image.Config
+		err  error
+	)
+
+	if in, info, err = store.Get(itemID, name); err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if err = checkImageSeeker(format, in); err != nil {
+		return &uploadError{err}
+	}
+
+	if cfg, _, err = image.DecodeConfig(in); err != nil {
+		return &uploadError{err}
+	}
+
+	meta.Width = cfg.Width
+	meta.Height = cfg.Height
+	meta.Size = info.Size
+
+	return nil
+}
+
+// Reads a multipart/form-data body, streaming the file in the "image" part
+// (if any) to the store, and binds the rest of the parts into "obj". The
+// name (and metadata) of the staged image is returned; the caller should
+// discard it if the request fails later on.
+func bindMultipartUpload(ctx *gin.Context, store ImageStore, itemID string,
+	obj interface{}) (string, imageMeta, error) {
+
+	var (
+		reader *multipart.Reader
+		part   *multipart.Part
+		form   multipart.Form
+		staged string
+		meta   imageMeta
+		value  []byte
+		err    error
+	)
+
+	ctx.Request.Body = http.MaxBytesReader(
+		ctx.Writer, ctx.Request.Body, maxUploadFormSize,
+	)
+
+	if reader, err = ctx.Request.MultipartReader(); err != nil {
+		return "", meta, &uploadError{err}
+	}
+
+	form.Value = make(map[string][]string)
+
+	fail := func(err error) (string, imageMeta, error) {
+		if len(staged) > 0 {
+			store.Delete(itemID, staged)
+		}
+		return "", meta, err
+	}
+
+	for {
+		if part, err = reader.NextPart(); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return fail(&uploadError{err})
+		}
+
+		if part.FormName() == uploadImageField {
+			if len(staged) > 0 {
+				return fail(&uploadError{
+					errors.New("more than one image"),
+				})
+			}
+
+			staged, meta, err = streamItemImage(store, itemID, part)
+			if err != nil {
+				return fail(err)
+			}
+			continue
+		}
+
+		value, err = io.ReadAll(io.LimitReader(part, maxUploadFieldSize+1))
+		if err != nil {
+			return fail(&uploadError{err})
+		}
+
+		if int64(len(value)) > maxUploadFieldSize {
+			return fail(&uploadError{
+				fmt.Errorf("field too large: %q", part.FormName()),
+			})
+		}
+
+		form.Value[part.FormName()] = append(
+			form.Value[part.FormName()], string(value),
+		)
+	}
+
+	// The body has been read already; hand the fields over to the usual
+	// form binding (which then does the validation).
+	ctx.Request.MultipartForm = &form
+	if err = ctx.ShouldBindWith(obj, binding.FormMultipart); err != nil {
+		return fail(&uploadError{err})
+	}
+
+	return staged, meta, nil
+}
+
+// Maps an error from bindMultipartUpload to a response status and message.
+func uploadErrorStatus(err error) (int, string) {
+	var uerr *uploadError
+
+	switch {
+	case errors.Is(err, errImageTooLarge), errors.Is(err, errImagePixels):
+		return http.StatusRequestEntityTooLarge, "Image Too Large"
+	case errors.Is(err, errImageMIMEType):
+		return http.StatusBadRequest, "Bad Image MIME type"
+	case errors.As(err, &uerr):
+		return http.StatusBadRequest, "Malformed Request"
+	default:
+		return http.StatusInternalServerError, "Image Write Failed"
+	}
+}
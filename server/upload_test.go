@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/chai2010/webp"
+)
+
+// An image store that counts the reads and writes of images.
+type countingImageStore struct {
+	ImageStore
+	gets int
+	puts int
+}
+
+func (s *countingImageStore) Get(itemID,
+	name string) (io.ReadSeekCloser, imageInfo, error) {
+
+	s.gets++
+	return s.ImageStore.Get(itemID, name)
+}
+
+func (s *countingImageStore) Put(itemID, name string, in io.Reader,
+	size int64) error {
+
+	s.puts++
+	return s.ImageStore.Put(itemID, name, in, size)
+}
+
+func TestStreamItemImageWritesOnce(t *testing.T) {
+	var (
+		local  *localImageStore
+		store  *countingImageStore
+		itemID = genItemHash()
+		img    []byte
+		name   string
+		meta   imageMeta
+		err    error
+	)
+
+	if local, err = newLocalImageStore(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	store = &countingImageStore{ImageStore: local}
+
+	img, err = base64.StdEncoding.DecodeString(testImageBase64(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name, meta, err = streamItemImage(store, itemID, bytes.NewReader(img))
+	if err != nil {
+		t.Fatalf("stream: %v", err)
+	}
+
+	// The staged image is read back for its dimensions (and pixel count).
+	if store.gets != 1 || store.puts != 1 {
+		t.Fatalf("stream: got %d reads and %d writes, want 1 and 1",
+			store.gets, store.puts)
+	}
+
+	if body := readTestImage(t, local, itemID, name); body != string(img) ||
+		meta.Size != int64(len(img)) || meta.Width != 4 {
+		t.Fatalf("stream: got %d bytes, meta %+v", len(body), meta)
+	}
+}
+
+// Some metadata that should not survive an upload.
+const testSecret = "Somewhere, 51.5N 0.1W"
+
+// EXIF data (a TIFF header, and an IFD with just the orientation), with the
+// secret in an unused tag.
+func testExif(orientation uint16) []byte {
+	var buf bytes.Buffer
+
+	buf.WriteString("Exif\x00\x00II*\x00")
+	binary.Write(&buf, binary.LittleEndian, []uint32{8})
+	binary.Write(&buf, binary.LittleEndian, []uint16{2, 0x0112, 3})
+	binary.Write(&buf, binary.LittleEndian, []uint32{1})
+	binary.Write(&buf, binary.LittleEndian, []uint16{orientation, 0})
+	binary.Write(&buf, binary.LittleEndian, []uint16{0x010e, 2})
+	binary.Write(&buf, binary.LittleEndian, []uint32{
+		uint32(len(testSecret) + 1), 38, 0,
+	})
+	buf.WriteString(testSecret + "\x00")
+
+	return buf.Bytes()
+}
+
+func testRGBA(w, h int) *image.RGBA {
+	return image.NewRGBA(image.Rect(0, 0, w, h))
+}
+
+// A w x h JPEG with an EXIF segment, and a comment.
+func testJpeg(t *testing.T, w, h int, orientation uint16) []byte {
+	var (
+		buf  bytes.Buffer
+		out  bytes.Buffer
+		data []byte
+	)
+
+	if err := jpeg.Encode(&buf, testRGBA(w, h), nil); err != nil {
+		t.Fatal(err)
+	}
+	data = buf.Bytes()
+
+	out.Write(data[:2])
+	for marker, body := range map[byte][]byte{
+		0xe1: testExif(orientation),
+		0xfe: []byte(testSecret),
+	} {
+		out.Write([]byte{0xff, marker})
+		binary.Write(&out, binary.BigEndian, uint16(len(body)+2))
+		out.Write(body)
+	}
+	out.Write(data[2:])
+
+	return out.Bytes()
+}
+
+// The test image (see testImageBase64), with a text chunk.
+func testPngWithText(t *testing.T) []byte {
+	var (
+		data  []byte
+		chunk bytes.Buffer
+		err   error
+	)
+
+	if data, err = base64.StdEncoding.DecodeString(
+		testImageBase64(t),
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	binary.Write(&chunk, binary.BigEndian, uint32(len(testSecret)+8))
+	chunk.WriteString("tEXtComment\x00" + testSecret)
+	binary.Write(&chunk, binary.BigEndian, crc32.ChecksumIEEE(
+		chunk.Bytes()[4:],
+	))
+
+	// After the IHDR chunk.
+	return append(append(append([]byte(nil), data[:33]...),
+		chunk.Bytes()...), data[33:]...)
+}
+
+// A 4x4 WebP in the extended format, with an EXIF chunk.
+func testWebp(t *testing.T) []byte {
+	var (
+		buf  bytes.Buffer
+		out  bytes.Buffer
+		body []byte
+		err  error
+	)
+
+	err = webp.Encode(&buf, testRGBA(4, 4), &webp.Options{Lossless: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out.WriteString("RIFF\x00\x00\x00\x00WEBP")
+	out.WriteString("VP8X\x0a\x00\x00\x00")
+	out.Write([]byte{0x08, 0, 0, 0, 3, 0, 0, 3, 0, 0})
+	out.Write(buf.Bytes()[12:])
+
+	body = testExif(1)
+	out.WriteString("EXIF")
+	binary.Write(&out, binary.LittleEndian, uint32(len(body)))
+	out.Write(body)
+	if len(body)%2 != 0 {
+		out.WriteByte(0)
+	}
+
+	body = out.Bytes()
+	binary.LittleEndian.PutUint32(body[4:], uint32(len(body)-8))
+
+	return body
+}
+
+func TestStreamItemImageStripsMeta(t *testing.T) {
+	var (
+		local  *localImageStore
+		itemID = genItemHash()
+		name   string
+		meta   imageMeta
+		body   string
+		err    error
+	)
+
+	if local, err = newLocalImageStore(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	for format, img := range map[string][]byte{
+		"jpeg": testJpeg(t, 4, 4, 1),
+		"png":  testPngWithText(t),
+		"webp": testWebp(t),
+	} {
+		if !strings.Contains(string(img), testSecret) {
+			t.Fatalf("%s: the test image has no metadata", format)
+		}
+
+		name, meta, err = streamItemImage(local, itemID, bytes.NewReader(img))
+		if err != nil {
+			t.Fatalf("%s: stream: %v", format, err)
+		}
+
+		body = readTestImage(t, local, itemID, name)
+		if strings.Contains(body, testSecret) {
+			t.Errorf("%s: the metadata was kept", format)
+		}
+
+		if _, _, err = image.Decode(strings.NewReader(body)); err != nil {
+			t.Errorf("%s: bad image: %v", format, err)
+		}
+
+		if meta.Width != 4 || meta.Height != 4 ||
+			meta.Size != int64(len(body)) {
+			t.Errorf("%s: got meta %+v for %d bytes", format, meta, len(body))
+		}
+
+		if format == "webp" && (binary.LittleEndian.Uint32(
+			[]byte(body[4:]),
+		) != uint32(len(body)-8) || body[20]&0x0c != 0) {
+			t.Errorf("webp: bad header %q", body[:30])
+		}
+	}
+}
+
+func TestStreamItemImageOrients(t *testing.T) {
+	var (
+		local  *localImageStore
+		store  *countingImageStore
+		itemID = genItemHash()
+		name   string
+		meta   imageMeta
+		body   string
+		err    error
+	)
+
+	if local, err = newLocalImageStore(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	store = &countingImageStore{ImageStore: local}
+
+	// Rotated by 90 degrees, so that it is 2x4 when upright.
+	name, meta, err = streamItemImage(
+		store, itemID, bytes.NewReader(testJpeg(t, 4, 2, 6)),
+	)
+	if err != nil {
+		t.Fatalf("stream: %v", err)
+	}
+
+	if store.puts != 2 {
+		t.Fatalf("stream: got %d writes, want 2", store.puts)
+	}
+
+	body = readTestImage(t, local, itemID, name)
+	if strings.Contains(body, testSecret) {
+		t.Fatal("stream: the metadata was kept")
+	}
+
+	if meta.Width != 2 || meta.Height != 4 || meta.Size != int64(len(body)) {
+		t.Fatalf("stream: got meta %+v for %d bytes", meta, len(body))
+	}
+}
+
+func TestStreamItemImageRefusesBadImages(t *testing.T) {
+	var (
+		local  *localImageStore
+		itemID = genItemHash()
+		img    = testJpeg(t, 4, 4, 1)
+		err    error
+	)
+
+	if local, err = newLocalImageStore(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cut in the middle of the headers.
+	_, _, err = streamItemImage(local, itemID, bytes.NewReader(img[:40]))
+	if status, _ := uploadErrorStatus(err); status != http.StatusBadRequest {
+		t.Fatalf("stream: got %d (%v), want %d", status, err,
+			http.StatusBadRequest)
+	}
+
+	_, _, err = streamItemImage(local, itemID, bytes.NewReader(
+		testPngOfSize(t, 10000, 10000),
+	))
+	status, _ := uploadErrorStatus(err)
+	if status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("stream: got %d (%v), want %d", status, err,
+			http.StatusRequestEntityTooLarge)
+	}
+
+	if images, _ := local.List(itemID, ""); len(images) != 0 {
+		t.Fatalf("stream: left %v behind", images)
+	}
+}
@@ -1,37 +1,47 @@
 package main
 
 import (
+	"bytes"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"html"
 	"image"
+	"image/draw"
+	"image/gif"
 	"image/jpeg"
 	"image/png"
+	"io"
+	"log"
 	"math/rand"
-	"os"
+	"net/http"
 	"path"
-	"reflect"
-	"sync"
+	"strconv"
+	"strings"
 	"time"
+	"unicode"
 
+	"github.com/chai2010/webp"
 	"github.com/gabriel-vasile/mimetype"
 	"github.com/gin-gonic/gin"
-	"github.com/jmoiron/sqlx"
-	"github.com/nfnt/resize"
-
-	_ "github.com/lib/pq"
 )
 
 var (
 	seed *rand.Rand = rand.New(rand.NewSource(time.Now().UnixNano()))
 )
 
-func invalidArgs(rnPort, dbPort *int,
+func invalidArgs(rnPort, dbPort *int, invKind,
 	dbHost, dbName, dbUser, dbPass *string) error {
 
 	if *rnPort <= minPortRange || *rnPort > maxPortRange {
 		return fmt.Errorf("bad port range for '-port': %d", *rnPort)
 	}
 
+	// The in-memory store needs no database.
+	if *invKind == "memory" {
+		return nil
+	}
+
 	if *dbPort <= minPortRange || *dbPort > maxPortRange {
 		return fmt.Errorf("bad port range for '-dbport': %d", *dbPort)
 	}
@@ -57,14 +67,14 @@ func getDBConnStr(dbPort *int, dbHost, dbName, dbUser, dbPass *string) string {
 	)
 }
 
-func useDbMiddleware(db *sqlx.DB) func(*gin.Context) {
+func useInventoryMiddleware(inv InventoryStore) func(*gin.Context) {
 	return func(ctx *gin.Context) {
-		ctx.Set(dbSiteKey, db)
+		ctx.Set(invSiteKey, inv)
 		ctx.Next()
 	}
 }
 
-func useMuxMiddleware(mux *sync.Mutex) func(*gin.Context) {
+func useMuxMiddleware(mux *itemLocker) func(*gin.Context) {
 	return func(ctx *gin.Context) {
 		ctx.Set(muxSiteKey, mux)
 		ctx.Next()
@@ -89,40 +99,61 @@ func useCORSMiddleware() func(*gin.Context) {
 			"Access-Control-Allow-Headers",
 			"Content-Type, Content-Length, Accept-Encoding, "+
 				"X-CSRF-Token, Authorization, accept, origin, "+
-				"Cache-Control, X-Requested-With",
+				"Cache-Control, X-Requested-With, If-Match, "+
+				"If-None-Match, X-Actor",
 		)
+		c.Header("Access-Control-Expose-Headers", "ETag")
 		c.Header(
 			"Access-Control-Allow-Methods",
-			"GET, POST, PUT, DELETE, OPTIONS",
+			"GET, POST, PUT, PATCH, DELETE, OPTIONS",
 		)
 		c.Next()
 	}
 }
 
-func ensureDbMiddleware(ctx *gin.Context) (*sqlx.DB, error) {
+func useImgStoreMiddleware(store ImageStore) func(*gin.Context) {
+	return func(ctx *gin.Context) {
+		ctx.Set(imgStoreSiteKey, store)
+		ctx.Next()
+	}
+}
+
+func ensureInventoryMiddleware(ctx *gin.Context) (InventoryStore, error) {
 	var (
-		dbConn *sqlx.DB
-		ok     bool
+		inv InventoryStore
+		ok  bool
 	)
-	if dbConn, ok = ctx.MustGet(dbSiteKey).(*sqlx.DB); !ok {
-		return nil, fmt.Errorf("router: database undefined in context")
+	if inv, ok = ctx.MustGet(invSiteKey).(InventoryStore); !ok {
+		return nil, fmt.Errorf("router: inventory undefined in context")
 	}
 
-	return dbConn, nil
+	return inv, nil
 }
 
-func ensureMuxMiddleware(ctx *gin.Context) (*sync.Mutex, error) {
+func ensureMuxMiddleware(ctx *gin.Context) (*itemLocker, error) {
 	var (
-		mux *sync.Mutex
+		mux *itemLocker
 		ok  bool
 	)
-	if mux, ok = ctx.MustGet(muxSiteKey).(*sync.Mutex); !ok {
-		return nil, fmt.Errorf("router: mutex undefined in context")
+	if mux, ok = ctx.MustGet(muxSiteKey).(*itemLocker); !ok {
+		return nil, fmt.Errorf("router: item locks undefined in context")
 	}
 
 	return mux, nil
 }
 
+func ensureImgStoreMiddleware(ctx *gin.Context) (ImageStore, error) {
+	var (
+		store ImageStore
+		ok    bool
+	)
+	if store, ok = ctx.MustGet(imgStoreSiteKey).(ImageStore); !ok {
+		return nil, fmt.Errorf("router: image store undefined in context")
+	}
+
+	return store, nil
+}
+
 func genItemHash() string {
 	var buff []byte = make([]byte, hashStrSize)
 
@@ -133,90 +164,390 @@ func genItemHash() string {
 	return string(buff)
 }
 
-func resizePng(height, width uint, in *os.File, out *os.File) error {
+// Rewinds an image once it has been checked (see checkImagePixels), so
+// that nothing too large is ever decoded.
+func checkImageSeeker(format string, in io.ReadSeeker) error {
 	var (
-		inBuff  image.Image
-		outBuff image.Image
-		err     error
+		start int64
+		err   error
 	)
 
-	if inBuff, err = png.Decode(in); err != nil {
+	if start, err = in.Seek(0, io.SeekCurrent); err != nil {
 		return err
 	}
 
-	outBuff = resize.Thumbnail(width, height, inBuff, resize.Lanczos3)
-
-	if err = png.Encode(out, outBuff); err != nil {
+	if err = checkImagePixels(format, in); err != nil {
 		return err
 	}
 
-	return nil
+	_, err = in.Seek(start, io.SeekStart)
+
+	return err
+}
+
+func decodeImage(format string, in io.ReadSeeker) (image.Image, error) {
+	if err := checkImageSeeker(format, in); err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case "png":
+		return png.Decode(in)
+	case "jpeg":
+		return jpeg.Decode(in)
+	case "gif":
+		// Only the first frame; see resizeGif for animations.
+		return gif.Decode(in)
+	case "webp":
+		return webp.Decode(in)
+	default:
+		return nil, errors.New("bad image format")
+	}
 }
 
-func resizeJpg(height, width uint, in *os.File, out *os.File) error {
+func encodeImage(format string, quality int, img image.Image,
+	out io.Writer) error {
+
+	switch format {
+	case "png":
+		return png.Encode(out, img)
+	case "jpeg":
+		return jpeg.Encode(out, img, &jpeg.Options{Quality: quality})
+	case "gif":
+		return gif.Encode(out, img, nil)
+	case "webp":
+		return webp.Encode(out, img, &webp.Options{
+			Quality: float32(quality),
+		})
+	default:
+		return errors.New("bad image format")
+	}
+}
+
+func resizeImage(spec imgThumbSpec, inFormat string, in io.ReadSeeker,
+	out io.Writer) error {
+
 	var (
 		inBuff  image.Image
 		outBuff image.Image
 		err     error
 	)
 
-	if inBuff, err = jpeg.Decode(in); err != nil {
+	if inFormat == "gif" && spec.Format == "gif" {
+		return resizeGif(spec, in, out)
+	}
+
+	if inBuff, err = decodeImage(inFormat, in); err != nil {
 		return err
 	}
 
-	outBuff = resize.Thumbnail(width, height, inBuff, resize.Lanczos3)
+	outBuff = resizeThumb(spec.Height, spec.Width, spec.Mode, inBuff)
 
-	if err = jpeg.Encode(out, outBuff, nil); err != nil {
+	return encodeImage(spec.Format, spec.Quality, outBuff, out)
+}
+
+// Resizes every frame of a (possibly animated) GIF. Frames may only cover
+// a part of the image, so they are drawn onto a canvas (as a viewer would)
+// and the whole canvas is resized for every frame. A smart crop could move
+// from one frame to the next, so the crop is centered for animations.
+func resizeGif(spec imgThumbSpec, in io.ReadSeeker, out io.Writer) error {
+	var (
+		inGif   *gif.GIF
+		outGif  gif.GIF
+		canvas  *image.RGBA
+		prev    *image.RGBA
+		thumb   image.Image
+		frame   *image.Paletted
+		outRect image.Rectangle
+		mode    string
+		err     error
+	)
+
+	if err = checkImageSeeker("gif", in); err != nil {
 		return err
 	}
 
-	return nil
+	if inGif, err = gif.DecodeAll(in); err != nil {
+		return err
+	}
+
+	if mode = spec.Mode; mode == imgModeSmart && len(inGif.Image) > 1 {
+		mode = imgModeFill
+	}
+
+	canvas = image.NewRGBA(image.Rect(
+		0, 0, inGif.Config.Width, inGif.Config.Height,
+	))
+	prev = image.NewRGBA(canvas.Bounds())
+
+	for i, src := range inGif.Image {
+		if inGif.Disposal[i] == gif.DisposalPrevious {
+			copy(prev.Pix, canvas.Pix)
+		}
+
+		draw.Draw(canvas, src.Bounds(), src, src.Bounds().Min, draw.Over)
+
+		thumb = resizeThumb(spec.Height, spec.Width, mode, canvas)
+		outRect = thumb.Bounds().Sub(thumb.Bounds().Min)
+
+		frame = image.NewPaletted(outRect, src.Palette)
+		draw.FloydSteinberg.Draw(frame, outRect, thumb, thumb.Bounds().Min)
+
+		outGif.Image = append(outGif.Image, frame)
+		outGif.Delay = append(outGif.Delay, inGif.Delay[i])
+		outGif.Disposal = append(outGif.Disposal, gif.DisposalBackground)
+
+		switch inGif.Disposal[i] {
+		case gif.DisposalBackground:
+			draw.Draw(
+				canvas, src.Bounds(), image.Transparent,
+				image.Point{}, draw.Src,
+			)
+		case gif.DisposalPrevious:
+			copy(canvas.Pix, prev.Pix)
+		}
+	}
+
+	outGif.LoopCount = inGif.LoopCount
+
+	return gif.EncodeAll(out, &outGif)
 }
 
-func genImageThumb(height, width uint, imgDir string) (string, error) {
+// Returns the format (see imgFormatMIMETypes) of an image of an item.
+func detectItemImage(store ImageStore, itemID, image string) (string, error) {
 	var (
-		in      *os.File
-		out     *os.File
-		mtype   *mimetype.MIME
-		inPath  string
-		outPath string
-		err     error
+		in    io.ReadSeekCloser
+		mtype *mimetype.MIME
+		err   error
 	)
 
-	inPath = path.Join(imgDir, "original")
-	if mtype, err = mimetype.DetectFile(inPath); err != nil {
+	if in, _, err = store.Get(itemID, image); err != nil {
 		return "", err
 	}
+	defer in.Close()
 
-	if in, err = os.Open(inPath); err != nil {
+	if mtype, err = mimetype.DetectReader(in); err != nil {
 		return "", err
 	}
-	defer in.Close()
 
-	outPath = path.Join(imgDir, fmt.Sprintf("thumb_%dx%d", height, width))
-	if _, err = os.Stat(outPath); err == nil {
-		return outPath, nil
+	return imageFormat(mtype.String())
+}
+
+func imageFormat(mimeType string) (string, error) {
+	for format, mt := range imgFormatMIMETypes {
+		if mt == mimeType {
+			return format, nil
+		}
 	}
 
-	if out, err = os.Create(outPath); err != nil {
-		return "", err
+	return "", errors.New("bad image format")
+}
+
+// Picks the format for a thumbnail from an "Accept" header. The formats
+// are ranked by their "q" values; at the same "q", a format that is named
+// in the header wins over one that matches a wildcard, and the format of
+// the image wins over a conversion.
+func negotiateImageFormat(accept, orig string) (string, bool) {
+	var (
+		ranges   []string
+		params   []string
+		mt       string
+		q        float64
+		best     string
+		bestQ    float64
+		bestExpl bool
+		err      error
+	)
+
+	if len(strings.TrimSpace(accept)) <= 0 {
+		return orig, true
+	}
+
+	ranges = strings.Split(accept, ",")
+
+	for _, format := range append([]string{orig}, imgOutputFormats...) {
+		var (
+			fmtQ    float64 = -1
+			fmtExpl bool
+			fmtSpec int = -1
+		)
+
+		mt = imgFormatMIMETypes[format]
+		for _, r := range ranges {
+			params = strings.Split(r, ";")
+			params[0] = strings.ToLower(strings.TrimSpace(params[0]))
+
+			spec := -1
+			switch {
+			case params[0] == mt:
+				spec = 2
+			case params[0] == "image/*":
+				spec = 1
+			case params[0] == "*/*":
+				spec = 0
+			}
+
+			// The most specific range decides the "q" of a format.
+			if spec <= fmtSpec {
+				continue
+			}
+
+			q = 1
+			for _, param := range params[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					q, err = strconv.ParseFloat(param[2:], 64)
+					if err != nil {
+						q = 0
+					}
+				}
+			}
+
+			fmtQ, fmtSpec, fmtExpl = q, spec, spec == 2
+		}
+
+		if fmtQ <= 0 {
+			continue
+		}
+
+		if fmtQ > bestQ || (fmtQ == bestQ && fmtExpl && !bestExpl) {
+			best, bestQ, bestExpl = format, fmtQ, fmtExpl
+		}
 	}
-	defer out.Close()
 
-	switch mtype.Extension() {
-	case ".png":
-		if err = resizePng(height, width, in, out); err != nil {
-			return "", err
+	return best, len(best) > 0
+}
+
+// Returns the quality to encode a format with; the requested quality is
+// only used for the lossy formats.
+func imageQuality(format string, quality int) int {
+	switch format {
+	case "jpeg":
+		if quality > 0 {
+			return quality
 		}
-	case ".jpg", ".jpeg":
-		if err = resizeJpg(height, width, in, out); err != nil {
-			return "", err
+		return jpeg.DefaultQuality
+	case "webp":
+		if quality > 0 {
+			return quality
 		}
+		return imgWebpQuality
 	default:
-		return "", errors.New("bad image format")
+		return 0
+	}
+}
+
+// The prefix for the names of the thumbnails of an image.
+func imageThumbPrefix(image string) string {
+	return imgThumbPrefix + image + "_"
+}
+
+// Thumbnails are named after everything that tells them apart, so that
+// variants of the same image do not collide.
+func imageThumbName(spec imgThumbSpec) string {
+	if spec.Quality > 0 {
+		return fmt.Sprintf(
+			"%s%dx%d_%s_q%d.%s", imageThumbPrefix(spec.Image),
+			spec.Height, spec.Width, spec.Mode, spec.Quality,
+			spec.Format,
+		)
+	}
+
+	return fmt.Sprintf(
+		"%s%dx%d_%s.%s", imageThumbPrefix(spec.Image), spec.Height,
+		spec.Width, spec.Mode, spec.Format,
+	)
+}
+
+// Generates (unless it exists already) a thumbnail for the image of an
+// item, as per the spec. Concurrent requests for the same thumbnail share
+// one generation, and generations are limited to a few at a time (see
+// "-thumbworkers"), so that a burst of requests does not hog the CPU.
+func genImageThumb(spec imgThumbSpec, itemID string,
+	store ImageStore) (string, error) {
+
+	var (
+		outName   string
+		cache, _  = store.(*thumbCache)
+		generated bool
+		err       error
+	)
+
+	outName = imageThumbName(spec)
+	if _, err = store.Stat(itemID, outName); err == nil {
+		cache.count(false)
+		return outName, nil
 	}
 
-	return outPath, nil
+	render := func() (interface{}, error) {
+		// The thumbnail may have been generated while this was waiting.
+		if _, err := store.Stat(itemID, outName); err == nil {
+			return nil, nil
+		}
+
+		thumbSlots <- struct{}{}
+		defer func() { <-thumbSlots }()
+
+		generated = true
+		return nil, renderImageThumb(spec, itemID, outName, store)
+	}
+
+	_, err, _ = thumbFlight.Do(path.Join(itemID, outName), render)
+	if err != nil {
+		return "", err
+	}
+
+	// Only the request that generated the thumbnail counts as a miss; those
+	// that waited for it got it from the cache.
+	cache.count(generated)
+
+	return outName, nil
+}
+
+// Resizes the image of an item into a thumbnail. The store makes sure that
+// the thumbnail is never seen half-written.
+func renderImageThumb(spec imgThumbSpec, itemID, outName string,
+	store ImageStore) error {
+
+	var (
+		in       io.ReadSeekCloser
+		out      bytes.Buffer
+		mtype    *mimetype.MIME
+		inFormat string
+		err      error
+	)
+
+	if in, _, err = store.Get(itemID, spec.Image); err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if mtype, err = mimetype.DetectReader(in); err != nil {
+		return err
+	}
+
+	if inFormat, err = imageFormat(mtype.String()); err != nil {
+		return err
+	}
+
+	if _, err = in.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if err = resizeImage(spec, inFormat, in, &out); err != nil {
+		return err
+	}
+
+	return store.Put(itemID, outName, &out, int64(out.Len()))
+}
+
+// Turns a highlighted snippet (see "searchHlOpts") into HTML: the text is
+// escaped, and the highlights are wrapped in "<mark>" tags.
+func markHighlights(hl string) string {
+	hl = html.EscapeString(hl)
+	hl = strings.ReplaceAll(hl, searchHlStart, "<mark>")
+
+	return strings.ReplaceAll(hl, searchHlStop, "</mark>")
 }
 
 func contains(haystack []string, needle string) bool {
@@ -229,28 +560,390 @@ func contains(haystack []string, needle string) bool {
 	return false
 }
 
-func getFieldFromTag(tag, val string, data interface{}) (interface{}, bool) {
+func encodeListCursor(cur listCursor) string {
+	return base64.URLEncoding.EncodeToString(
+		[]byte(cur.At.Format(time.RFC3339Nano) + cursorSep + cur.ID),
+	)
+}
+
+func decodeListCursor(str string) (listCursor, error) {
+	var (
+		cur   listCursor
+		raw   []byte
+		parts []string
+		err   error
+	)
+
+	if raw, err = base64.URLEncoding.DecodeString(str); err != nil {
+		return cur, err
+	}
+
+	parts = strings.SplitN(string(raw), cursorSep, 2)
+	if len(parts) != 2 || len(parts[1]) != hashStrSize {
+		return cur, errors.New("bad cursor format")
+	}
+
+	if cur.At, err = time.Parse(time.RFC3339Nano, parts[0]); err != nil {
+		return cur, err
+	}
+	cur.ID = parts[1]
+
+	return cur, nil
+}
+
+func encodeNumCursor(num uint64) string {
+	return base64.URLEncoding.EncodeToString(
+		[]byte(strconv.FormatUint(num, 10)),
+	)
+}
+
+func decodeNumCursor(str string) (uint64, error) {
+	var (
+		raw []byte
+		num uint64
+		err error
+	)
+
+	if raw, err = base64.URLEncoding.DecodeString(str); err != nil {
+		return 0, err
+	}
+
+	if num, err = strconv.ParseUint(string(raw), 10, 63); err != nil {
+		return 0, err
+	}
+
+	return num, nil
+}
+
+// Splits a search query into (lowercase) words, every one of which an item
+// has to match.
+func searchTerms(str string) ([]string, error) {
+	var words []string
+
+	words = strings.FieldsFunc(strings.ToLower(str), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	if len(words) <= 0 {
+		return nil, errors.New("no search terms")
+	}
+
+	if len(words) > maxSearchTerms {
+		words = words[:maxSearchTerms]
+	}
+
+	return words, nil
+}
+
+// Sanitizes an image (see sanitizeImage), and stores it in the directory of
+// an item, to be published later.
+func stageItemImage(store ImageStore, itemID string,
+	imgBuff []byte) (string, imageMeta, error) {
+
 	var (
-		sVal   reflect.Value
-		sType  reflect.Type
-		sField reflect.StructField
-		sTag   string
-		ok     bool
-		r      interface{}
+		name string
+		meta imageMeta
+		err  error
 	)
 
-	sVal = reflect.ValueOf(data)
-	sType = reflect.TypeOf(data)
+	if imgBuff, meta, err = sanitizeImage(imgBuff); err != nil {
+		return "", meta, &uploadError{err}
+	}
+
+	name = imgStagePrefix + genItemHash()
+	err = store.Put(itemID, name, bytes.NewReader(imgBuff), int64(len(imgBuff)))
+	if err != nil {
+		return "", meta, err
+	}
+
+	return name, meta, nil
+}
+
+// Swaps a staged image in as an image of an item (replacing the image, if
+// it exists already). The row of the image (added, or updated with the
+// staged name, in the transaction that committed the upload) is marked as
+// published; a crash before then is repaired by reconcileImages.
+func publishItemImage(inv InventoryStore, store ImageStore, image imageRow,
+	staged string) error {
+
+	var err error
+
+	if err = store.Move(image.ItemID, staged, image.ImageName); err != nil {
+		return err
+	}
+
+	// Thumbnails of the previous image are stale now.
+	err = deleteImageThumbs(store, image.ItemID, image.ImageName)
+	if err != nil {
+		return err
+	}
+
+	if err = inv.ClearStagedImage(image.ImageID, staged); err != nil {
+		return err
+	}
 
-	for i := 0; i < sType.NumField(); i++ {
-		sField = sType.Field(i)
-		if sTag, ok = sField.Tag.Lookup(tag); ok {
-			if len(sTag) > 0 && sTag == val {
-				r = reflect.Indirect(sVal).Field(i).Interface()
-				return r, true
+	queueThumbPregen(image.ItemID, image.ImageName)
+
+	return nil
+}
+
+func deleteItemImage(store ImageStore, itemID, image string) error {
+	var err error
+
+	if err = store.Delete(itemID, image); err != nil {
+		return err
+	}
+
+	return deleteImageThumbs(store, itemID, image)
+}
+
+func deleteImageThumbs(store ImageStore, itemID, image string) error {
+	var (
+		thumbs []string
+		err    error
+	)
+
+	if thumbs, err = store.List(itemID, imageThumbPrefix(image)); err != nil {
+		return err
+	}
+
+	for _, thumb := range thumbs {
+		if err = store.Delete(itemID, thumb); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func itemETag(version int64) string {
+	return fmt.Sprintf("\"%d\"", version)
+}
+
+// Returns the versions listed in an "If-Match" or "If-None-Match" header,
+// and whether the header matches any version ("*"). Weak tags are only
+// considered for weak comparison (i.e., for "If-None-Match").
+func parseETagVersions(header string, weak bool) ([]int64, bool) {
+	var (
+		version  int64
+		versions []int64
+		err      error
+	)
+
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return nil, true
+		}
+
+		if strings.HasPrefix(tag, "W/") {
+			if !weak {
+				continue
 			}
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+
+		version, err = strconv.ParseInt(strings.Trim(tag, "\""), 10, 64)
+		if err == nil {
+			versions = append(versions, version)
+		}
+	}
+
+	return versions, false
+}
+
+func ifMatchVersions(ctx *gin.Context) ([]int64, bool) {
+	var (
+		header   string
+		versions []int64
+		wildcard bool
+	)
+
+	if header = ctx.GetHeader("If-Match"); len(header) <= 0 {
+		return nil, false
+	}
+
+	if versions, wildcard = parseETagVersions(header, false); wildcard {
+		return nil, false
+	}
+
+	return versions, true
+}
+
+func ifNoneMatch(ctx *gin.Context, version int64) bool {
+	var (
+		header   string
+		versions []int64
+		wildcard bool
+	)
+
+	if header = ctx.GetHeader("If-None-Match"); len(header) <= 0 {
+		return false
+	}
+
+	if versions, wildcard = parseETagVersions(header, true); wildcard {
+		return true
+	}
+
+	for _, v := range versions {
+		if v == version {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the write that a request makes to an item at the given time (see
+// itemWrite).
+func requestWrite(ctx *gin.Context, at time.Time) itemWrite {
+	var w = itemWrite{At: at, Actor: requestActor(ctx)}
+
+	w.Versions, w.IfMatch = ifMatchVersions(ctx)
+
+	return w
+}
+
+// Responds to a request whose write to the inventory failed.
+func respondInventoryError(ctx *gin.Context, err error) {
+	var (
+		status    int
+		statusMsg string
+	)
+
+	switch {
+	case errors.Is(err, errItemNotFound):
+		status, statusMsg = http.StatusNotFound, "Item Not Found"
+	case errors.Is(err, errVersionMismatch):
+		status, statusMsg = http.StatusPreconditionFailed, "Precondition Failed"
+	case errors.Is(err, errItemNotInTrash):
+		status, statusMsg = http.StatusNotFound, "Item Not In Trash"
+	case errors.Is(err, errNoSuchImage):
+		status, statusMsg = http.StatusNotFound, "Image Not Found"
+	case errors.Is(err, errBadImageOrder):
+		status, statusMsg = http.StatusBadRequest, "Bad Image Order"
+	case errors.Is(err, errInsufficientStock):
+		status, statusMsg = http.StatusConflict, "Insufficient Stock"
+	case errors.Is(err, errStockOverflow):
+		status, statusMsg = http.StatusConflict, "Stock Count Too Large"
+	case errors.Is(err, errUnknownCurrency):
+		status, statusMsg = http.StatusBadRequest, "Unknown Currency"
+	case errors.Is(err, errPricePrecision):
+		status, statusMsg = http.StatusBadRequest, "Bad Price Precision"
+	default:
+		log.Printf("db: %v", err)
+		status, statusMsg = http.StatusInternalServerError,
+			"Internal Server Error"
+	}
+
+	ctx.JSON(status, apiResponse{Error: statusMsg})
+}
+
+// There is no authentication (yet), so the actor is whoever the client
+// says it is, or the address the request came from.
+func requestActor(ctx *gin.Context) string {
+	var actor string
+
+	if actor = ctx.GetHeader(actorHeader); len(actor) > 0 {
+		if len(actor) > maxActorSize {
+			actor = actor[:maxActorSize]
 		}
+		return actor
 	}
 
-	return nil, false
+	return ctx.ClientIP()
+}
+
+func requestBaseURL(ctx *gin.Context) string {
+	var scheme = "http"
+
+	if ctx.Request.TLS != nil {
+		scheme = "https"
+	} else if proto := ctx.GetHeader("X-Forwarded-Proto"); len(proto) > 0 {
+		scheme = proto
+	}
+
+	return fmt.Sprintf("%s://%s", scheme, ctx.Request.Host)
+}
+
+// Spreadsheets evaluate cells that look like formulae; those are escaped
+// for exports that are meant to be opened in one.
+func excelEscape(cell string) string {
+	if len(cell) > 0 && strings.ContainsRune("=+-@\t\r", rune(cell[0])) {
+		return "'" + cell
+	}
+
+	return cell
+}
+
+func exportCSVRecord(row *exportRow, excel bool) []string {
+	var rec []string
+
+	rec = []string{
+		row.ItemID,
+		row.CreatedAt.Format(time.RFC3339Nano),
+		row.UpdatedAt.Format(time.RFC3339Nano),
+		strconv.FormatUint(row.ItemCount, 10),
+		row.ItemPrice.String(),
+		row.ItemCurrency,
+		row.ItemBrand,
+		row.ItemName,
+		row.ItemDesc,
+	}
+
+	if len(row.ImageURL) > 0 {
+		rec = append(rec, row.ImageURL)
+	}
+
+	if excel {
+		for i := range rec {
+			rec[i] = excelEscape(rec[i])
+		}
+	}
+
+	return rec
+}
+
+// Removes items that have been in the trash for longer than the retention
+// period, along with their images.
+func purgeTrash(inv InventoryStore, mux *itemLocker, store ImageStore,
+	retention time.Duration) error {
+
+	var (
+		itemIDs []string
+		err     error
+	)
+
+	itemIDs, err = inv.PurgeTrash(time.Now().UTC().Add(-retention))
+	if err != nil {
+		return err
+	}
+
+	for _, itemID := range itemIDs {
+		mux.Lock(itemID)
+		if err = store.DeleteAll(itemID); err != nil {
+			log.Printf("fs: failed to delete images: %v", err)
+		}
+		mux.Unlock(itemID)
+	}
+
+	if len(itemIDs) > 0 {
+		log.Printf("purge: removed %d item(s) from the trash", len(itemIDs))
+	}
+
+	return nil
+}
+
+func runTrashPurger(inv InventoryStore, mux *itemLocker, store ImageStore,
+	retention, interval time.Duration) {
+
+	var ticker = time.NewTicker(interval)
+
+	defer ticker.Stop()
+	for {
+		if err := purgeTrash(inv, mux, store, retention); err != nil {
+			log.Printf("purge: failed to purge trash: %v", err)
+		}
+		<-ticker.C
+	}
 }